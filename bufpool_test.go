@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type BufPoolTestSuite struct{ MainTestSuite }
+
+func (s *BufPoolTestSuite) TestReuse() {
+	pool := newBufPool("test", 1, 0)
+
+	buf := pool.Get(100 * 1024)
+	buf.Write(make([]byte, 100*1024))
+	pool.Put(buf)
+
+	assert.True(s.T(), buf == pool.Get(50*1024))
+}
+
+func (s *BufPoolTestSuite) TestGetResets() {
+	pool := newBufPool("test", 1, 0)
+
+	buf := pool.Get(0)
+	buf.WriteString("test")
+	pool.Put(buf)
+
+	assert.Equal(s.T(), 0, pool.Get(0).Len())
+}
+
+func (s *BufPoolTestSuite) TestDropsTooBigBuffers() {
+	conf.BufferPoolCalibrationThreshold = 64
+
+	pool := newBufPool("test", 1, 0)
+
+	// Calibrate the pool with small buffers
+	for i := 0; i < 64; i++ {
+		buf := pool.Get(0)
+		buf.WriteString("test")
+		pool.Put(buf)
+	}
+
+	big := pool.Get(1024 * 1024)
+	big.Write(make([]byte, 1024*1024))
+	pool.Put(big)
+
+	assert.False(s.T(), big == pool.Get(0))
+}
+
+func TestBufPool(t *testing.T) {
+	suite.Run(t, new(BufPoolTestSuite))
+}
+
+const benchmarkBufSize = 512 * 1024
+
+var benchmarkData = make([]byte, benchmarkBufSize)
+
+func BenchmarkBufPool(b *testing.B) {
+	pool := newBufPool("benchmark", 1, benchmarkBufSize)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		buf := pool.Get(benchmarkBufSize)
+		buf.Write(benchmarkData)
+		pool.Put(buf)
+	}
+}
+
+func BenchmarkNoBufPool(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		buf := new(bytes.Buffer)
+		buf.Grow(benchmarkBufSize)
+		buf.Write(benchmarkData)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"runtime"
 	"strconv"
@@ -17,6 +18,21 @@ func intEnvConfig(i *int, name string) {
 	}
 }
 
+// nonNegativeIntEnvConfig keeps the default value and logs a warning
+// when the env var is set but isn't a non-negative integer
+func nonNegativeIntEnvConfig(i *int, name string) {
+	env := os.Getenv(name)
+	if len(env) == 0 {
+		return
+	}
+
+	if v, err := strconv.Atoi(env); err == nil && v >= 0 {
+		*i = v
+	} else {
+		logWarning("%s should be a non-negative integer, now - %s. Using the default value: %d", name, env, *i)
+	}
+}
+
 func floatEnvConfig(i *float64, name string) {
 	if env, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
 		*i = env
@@ -59,6 +75,86 @@ func hexEnvConfig(b *[]securityKey, name string) {
 	}
 }
 
+func sourcePatternsEnvConfig(s *[]*sourcePattern, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		parts := strings.Split(env, ",")
+
+		patterns := make([]*sourcePattern, 0, len(parts))
+
+		for _, part := range parts {
+			if part = strings.TrimSpace(part); len(part) > 0 {
+				pattern, err := newSourcePattern(part)
+				if err != nil {
+					logFatal("%s has invalid pattern: %s\n", name, err)
+				}
+
+				patterns = append(patterns, pattern)
+			}
+		}
+
+		*s = patterns
+	}
+}
+
+func strSliceEnvConfig(s *[]string, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		parts := strings.Split(env, ",")
+
+		for i, part := range parts {
+			parts[i] = strings.TrimSpace(part)
+		}
+
+		*s = parts
+	}
+}
+
+func headersEnvConfig(h *map[string]string, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		parts := strings.Split(env, ",")
+
+		headers := make(map[string]string, len(parts))
+
+		for _, part := range parts {
+			kv := strings.SplitN(part, ":", 2)
+
+			if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+				logFatal("%s expected to contain comma-separated Name:value pairs. Invalid: %s\n", name, part)
+			}
+
+			headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+
+		*h = headers
+	}
+}
+
+func formatFallbacksEnvConfig(m *map[imageType]imageType, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		parts := strings.Split(env, ",")
+
+		fallbacks := make(map[imageType]imageType, len(parts))
+
+		for _, part := range parts {
+			kv := strings.SplitN(part, ":", 2)
+
+			if len(kv) != 2 {
+				logFatal("%s expected to contain comma-separated format:fallback pairs. Invalid: %s\n", name, part)
+			}
+
+			from, fromOk := imageTypes[strings.TrimSpace(kv[0])]
+			to, toOk := imageTypes[strings.TrimSpace(kv[1])]
+
+			if !fromOk || !toOk {
+				logFatal("%s contains unknown image format. Invalid: %s\n", name, part)
+			}
+
+			fallbacks[from] = to
+		}
+
+		*m = fallbacks
+	}
+}
+
 func hexFileConfig(b *[]securityKey, filepath string) {
 	if len(filepath) == 0 {
 		return
@@ -132,30 +228,56 @@ type config struct {
 	ReadTimeout      int
 	WriteTimeout     int
 	KeepAliveTimeout int
+	ShutdownTimeout  int
 	DownloadTimeout  int
+	DownloadRetries  int
 	Concurrency      int
 	MaxClients       int
 	TTL              int
 	SoReuseport      bool
 
-	MaxSrcDimension    int
-	MaxSrcResolution   int
-	MaxSrcFileSize     int
-	MaxAnimationFrames int
+	MaxSrcDimension               int
+	MaxSrcResolution              int
+	MaxSrcFileSize                int
+	MaxAnimationFrames            int
+	RejectExceededAnimationFrames bool
+	MaxDpr                        float64
+
+	MaxDimension  int
+	MaxResolution int
 
 	JpegProgressive       bool
+	JpegSubsample         string
+	PngCompression        int
 	PngInterlaced         bool
 	PngQuantize           bool
 	PngQuantizationColors int
+	PngQuantizationDither float64
+	TiffCompression       string
 	Quality               int
+	JpegQuality           int
+	WebpQuality           int
+	AvifQuality           int
+	HeicQuality           int
+	StripMetadata         bool
+	EmbedSRGBProfile      bool
 	GZipCompression       int
+	FormatFallbacks       map[imageType]imageType
+	StrictFormat          bool
 
 	EnableWebpDetection bool
 	EnforceWebp         bool
+	EnableAvifDetection bool
+	EnforceAvif         bool
 	EnableClientHints   bool
 
 	UseLinearColorspace bool
 	DisableShrinkOnLoad bool
+	ResizeKernel        string
+	SvgDpi              float64
+	Enlarge             bool
+	Extend              bool
+	Background          string
 
 	Keys          []securityKey
 	Salts         []securityKey
@@ -166,7 +288,13 @@ type config struct {
 
 	AllowOrigin string
 
-	UserAgent string
+	AllowedSources []*sourcePattern
+
+	PostSourceEnabled bool
+
+	UserAgent            string
+	SourceHeaders        map[string]string
+	SourceForwardHeaders []string
 
 	IgnoreSslVerification bool
 	DevelopmentErrorsMode bool
@@ -175,10 +303,14 @@ type config struct {
 	S3Enabled           bool
 	S3Region            string
 	S3Endpoint          string
+	GCSEnabled          bool
 	GCSKey              string
 
 	ETagEnabled bool
 
+	ServerTimingEnabled  bool
+	CropBoxHeaderEnabled bool
+
 	BaseURL string
 
 	Presets     presets
@@ -187,12 +319,21 @@ type config struct {
 	WatermarkData    string
 	WatermarkPath    string
 	WatermarkURL     string
+	Watermark2xData  string
+	Watermark2xPath  string
+	Watermark2xURL   string
 	WatermarkOpacity float64
 
+	FallbackImage                    string
+	FallbackImageHTTPCode            int
+	UnsupportedFallbackImage         string
+	UnsupportedFallbackImageHTTPCode int
+
 	NewRelicAppName string
 	NewRelicKey     string
 
 	PrometheusBind string
+	PrometheusPath string
 
 	BugsnagKey        string
 	BugsnagStage      string
@@ -202,10 +343,26 @@ type config struct {
 	SentryEnvironment string
 	SentryRelease     string
 
+	LogFormat string
+
+	VipsConcurrency int
+	VipsCacheMem    int
+	VipsCacheMaxOps int
+
 	FreeMemoryInterval             int
 	DownloadBufferSize             int
 	GZipBufferSize                 int
 	BufferPoolCalibrationThreshold int
+	StreamSource                   bool
+}
+
+// Formats to save images in when libvips can't save the requested format
+var defaultFormatFallbacks = map[imageType]imageType{
+	imageTypeAVIF: imageTypeWEBP,
+	imageTypeWEBP: imageTypeJPEG,
+	imageTypeHEIC: imageTypeJPEG,
+	imageTypeTIFF: imageTypeJPEG,
+	imageTypeGIF:  imageTypePNG,
 }
 
 var conf = config{
@@ -213,22 +370,34 @@ var conf = config{
 	ReadTimeout:                    10,
 	WriteTimeout:                   10,
 	KeepAliveTimeout:               10,
+	ShutdownTimeout:                10,
 	DownloadTimeout:                5,
+	DownloadRetries:                2,
 	Concurrency:                    runtime.NumCPU() * 2,
 	TTL:                            3600,
 	MaxSrcResolution:               16800000,
 	MaxAnimationFrames:             1,
+	MaxDpr:                         8,
 	SignatureSize:                  32,
+	JpegSubsample:                  "4:2:0",
+	ResizeKernel:                   "lanczos3",
+	PngCompression:                 6,
 	PngQuantizationColors:          256,
+	PngQuantizationDither:          1,
+	TiffCompression:                "lzw",
+	FormatFallbacks:                defaultFormatFallbacks,
 	Quality:                        80,
+	SvgDpi:                         72,
 	GZipCompression:                5,
 	UserAgent:                      fmt.Sprintf("imgproxy/%s", version),
 	Presets:                        make(presets),
 	WatermarkOpacity:               1,
+	FallbackImageHTTPCode:          200,
 	BugsnagStage:                   "production",
 	HoneybadgerEnv:                 "production",
 	SentryEnvironment:              "production",
 	SentryRelease:                  fmt.Sprintf("imgproxy/%s", version),
+	LogFormat:                      "pretty",
 	FreeMemoryInterval:             10,
 	BufferPoolCalibrationThreshold: 1024,
 }
@@ -245,6 +414,13 @@ func configure() {
 		os.Exit(0)
 	}
 
+	// Log format is applied first, so the rest of the configuration is logged with it
+	strEnvConfig(&conf.LogFormat, "IMGPROXY_LOG_FORMAT")
+	if conf.LogFormat != "pretty" && conf.LogFormat != "json" {
+		logFatal("Unsupported log format: %s\n", conf.LogFormat)
+	}
+	initLog()
+
 	if port := os.Getenv("PORT"); len(port) > 0 {
 		conf.Bind = fmt.Sprintf(":%s", port)
 	}
@@ -253,7 +429,9 @@ func configure() {
 	intEnvConfig(&conf.ReadTimeout, "IMGPROXY_READ_TIMEOUT")
 	intEnvConfig(&conf.WriteTimeout, "IMGPROXY_WRITE_TIMEOUT")
 	intEnvConfig(&conf.KeepAliveTimeout, "IMGPROXY_KEEP_ALIVE_TIMEOUT")
+	intEnvConfig(&conf.ShutdownTimeout, "IMGPROXY_SHUTDOWN_TIMEOUT")
 	intEnvConfig(&conf.DownloadTimeout, "IMGPROXY_DOWNLOAD_TIMEOUT")
+	intEnvConfig(&conf.DownloadRetries, "IMGPROXY_DOWNLOAD_RETRIES")
 	intEnvConfig(&conf.Concurrency, "IMGPROXY_CONCURRENCY")
 	intEnvConfig(&conf.MaxClients, "IMGPROXY_MAX_CLIENTS")
 
@@ -263,6 +441,8 @@ func configure() {
 
 	intEnvConfig(&conf.MaxSrcDimension, "IMGPROXY_MAX_SRC_DIMENSION")
 	megaIntEnvConfig(&conf.MaxSrcResolution, "IMGPROXY_MAX_SRC_RESOLUTION")
+	intEnvConfig(&conf.MaxDimension, "IMGPROXY_MAX_DIMENSION")
+	megaIntEnvConfig(&conf.MaxResolution, "IMGPROXY_MAX_RESOLUTION")
 	intEnvConfig(&conf.MaxSrcFileSize, "IMGPROXY_MAX_SRC_FILE_SIZE")
 
 	if _, ok := os.LookupEnv("IMGPROXY_MAX_GIF_FRAMES"); ok {
@@ -270,24 +450,46 @@ func configure() {
 		intEnvConfig(&conf.MaxAnimationFrames, "IMGPROXY_MAX_GIF_FRAMES")
 	}
 	intEnvConfig(&conf.MaxAnimationFrames, "IMGPROXY_MAX_ANIMATION_FRAMES")
+	boolEnvConfig(&conf.RejectExceededAnimationFrames, "IMGPROXY_REJECT_EXCEEDED_ANIMATION_FRAMES")
+	floatEnvConfig(&conf.MaxDpr, "IMGPROXY_MAX_DPR")
 
 	boolEnvConfig(&conf.JpegProgressive, "IMGPROXY_JPEG_PROGRESSIVE")
+	strEnvConfig(&conf.JpegSubsample, "IMGPROXY_JPEG_SUBSAMPLE")
+	intEnvConfig(&conf.PngCompression, "IMGPROXY_PNG_COMPRESSION")
 	boolEnvConfig(&conf.PngInterlaced, "IMGPROXY_PNG_INTERLACED")
 	boolEnvConfig(&conf.PngQuantize, "IMGPROXY_PNG_QUANTIZE")
 	intEnvConfig(&conf.PngQuantizationColors, "IMGPROXY_PNG_QUANTIZATION_COLORS")
+	floatEnvConfig(&conf.PngQuantizationDither, "IMGPROXY_PNG_QUANTIZATION_DITHER")
+	strEnvConfig(&conf.TiffCompression, "IMGPROXY_TIFF_COMPRESSION")
 	intEnvConfig(&conf.Quality, "IMGPROXY_QUALITY")
+	intEnvConfig(&conf.JpegQuality, "IMGPROXY_JPEG_QUALITY")
+	intEnvConfig(&conf.WebpQuality, "IMGPROXY_WEBP_QUALITY")
+	intEnvConfig(&conf.AvifQuality, "IMGPROXY_AVIF_QUALITY")
+	intEnvConfig(&conf.HeicQuality, "IMGPROXY_HEIC_QUALITY")
+	boolEnvConfig(&conf.StripMetadata, "IMGPROXY_STRIP_METADATA")
+	boolEnvConfig(&conf.EmbedSRGBProfile, "IMGPROXY_EMBED_SRGB_PROFILE")
 	intEnvConfig(&conf.GZipCompression, "IMGPROXY_GZIP_COMPRESSION")
+	formatFallbacksEnvConfig(&conf.FormatFallbacks, "IMGPROXY_FORMAT_FALLBACKS")
+	boolEnvConfig(&conf.StrictFormat, "IMGPROXY_STRICT_FORMAT")
 
 	boolEnvConfig(&conf.EnableWebpDetection, "IMGPROXY_ENABLE_WEBP_DETECTION")
 	boolEnvConfig(&conf.EnforceWebp, "IMGPROXY_ENFORCE_WEBP")
+	boolEnvConfig(&conf.EnableAvifDetection, "IMGPROXY_ENABLE_AVIF_DETECTION")
+	boolEnvConfig(&conf.EnforceAvif, "IMGPROXY_ENFORCE_AVIF")
 	boolEnvConfig(&conf.EnableClientHints, "IMGPROXY_ENABLE_CLIENT_HINTS")
 
 	boolEnvConfig(&conf.UseLinearColorspace, "IMGPROXY_USE_LINEAR_COLORSPACE")
 	boolEnvConfig(&conf.DisableShrinkOnLoad, "IMGPROXY_DISABLE_SHRINK_ON_LOAD")
+	strEnvConfig(&conf.ResizeKernel, "IMGPROXY_RESIZE_KERNEL")
+	floatEnvConfig(&conf.SvgDpi, "IMGPROXY_SVG_DPI")
+	boolEnvConfig(&conf.Enlarge, "IMGPROXY_ENLARGE")
+	boolEnvConfig(&conf.Extend, "IMGPROXY_EXTEND")
+	strEnvConfig(&conf.Background, "IMGPROXY_BACKGROUND")
 
 	hexEnvConfig(&conf.Keys, "IMGPROXY_KEY")
 	hexEnvConfig(&conf.Salts, "IMGPROXY_SALT")
 	intEnvConfig(&conf.SignatureSize, "IMGPROXY_SIGNATURE_SIZE")
+	boolEnvConfig(&conf.AllowInsecure, "IMGPROXY_ALLOW_INSECURE")
 
 	hexFileConfig(&conf.Keys, *keyPath)
 	hexFileConfig(&conf.Salts, *saltPath)
@@ -296,7 +498,13 @@ func configure() {
 
 	strEnvConfig(&conf.AllowOrigin, "IMGPROXY_ALLOW_ORIGIN")
 
+	sourcePatternsEnvConfig(&conf.AllowedSources, "IMGPROXY_ALLOWED_SOURCES")
+
+	boolEnvConfig(&conf.PostSourceEnabled, "IMGPROXY_ENABLE_POST_SOURCE")
+
 	strEnvConfig(&conf.UserAgent, "IMGPROXY_USER_AGENT")
+	headersEnvConfig(&conf.SourceHeaders, "IMGPROXY_SOURCE_HEADERS")
+	strSliceEnvConfig(&conf.SourceForwardHeaders, "IMGPROXY_SOURCE_FORWARD_HEADERS")
 
 	boolEnvConfig(&conf.IgnoreSslVerification, "IMGPROXY_IGNORE_SSL_VERIFICATION")
 	boolEnvConfig(&conf.DevelopmentErrorsMode, "IMGPROXY_DEVELOPMENT_ERRORS_MODE")
@@ -307,10 +515,14 @@ func configure() {
 	strEnvConfig(&conf.S3Region, "IMGPROXY_S3_REGION")
 	strEnvConfig(&conf.S3Endpoint, "IMGPROXY_S3_ENDPOINT")
 
+	boolEnvConfig(&conf.GCSEnabled, "IMGPROXY_USE_GCS")
 	strEnvConfig(&conf.GCSKey, "IMGPROXY_GCS_KEY")
 
 	boolEnvConfig(&conf.ETagEnabled, "IMGPROXY_USE_ETAG")
 
+	boolEnvConfig(&conf.ServerTimingEnabled, "IMGPROXY_ENABLE_SERVER_TIMING")
+	boolEnvConfig(&conf.CropBoxHeaderEnabled, "IMGPROXY_ENABLE_CROP_BOX_HEADER")
+
 	strEnvConfig(&conf.BaseURL, "IMGPROXY_BASE_URL")
 
 	presetEnvConfig(conf.Presets, "IMGPROXY_PRESETS")
@@ -320,12 +532,21 @@ func configure() {
 	strEnvConfig(&conf.WatermarkData, "IMGPROXY_WATERMARK_DATA")
 	strEnvConfig(&conf.WatermarkPath, "IMGPROXY_WATERMARK_PATH")
 	strEnvConfig(&conf.WatermarkURL, "IMGPROXY_WATERMARK_URL")
+	strEnvConfig(&conf.Watermark2xData, "IMGPROXY_WATERMARK_2X_DATA")
+	strEnvConfig(&conf.Watermark2xPath, "IMGPROXY_WATERMARK_2X_PATH")
+	strEnvConfig(&conf.Watermark2xURL, "IMGPROXY_WATERMARK_2X_URL")
 	floatEnvConfig(&conf.WatermarkOpacity, "IMGPROXY_WATERMARK_OPACITY")
 
+	strEnvConfig(&conf.FallbackImage, "IMGPROXY_FALLBACK_IMAGE")
+	intEnvConfig(&conf.FallbackImageHTTPCode, "IMGPROXY_FALLBACK_IMAGE_HTTP_CODE")
+	strEnvConfig(&conf.UnsupportedFallbackImage, "IMGPROXY_UNSUPPORTED_FALLBACK_IMAGE")
+	intEnvConfig(&conf.UnsupportedFallbackImageHTTPCode, "IMGPROXY_UNSUPPORTED_FALLBACK_IMAGE_HTTP_CODE")
+
 	strEnvConfig(&conf.NewRelicAppName, "IMGPROXY_NEW_RELIC_APP_NAME")
 	strEnvConfig(&conf.NewRelicKey, "IMGPROXY_NEW_RELIC_KEY")
 
 	strEnvConfig(&conf.PrometheusBind, "IMGPROXY_PROMETHEUS_BIND")
+	strEnvConfig(&conf.PrometheusPath, "IMGPROXY_PROMETHEUS_PATH")
 
 	strEnvConfig(&conf.BugsnagKey, "IMGPROXY_BUGSNAG_KEY")
 	strEnvConfig(&conf.BugsnagStage, "IMGPROXY_BUGSNAG_STAGE")
@@ -335,14 +556,22 @@ func configure() {
 	strEnvConfig(&conf.SentryEnvironment, "IMGPROXY_SENTRY_ENVIRONMENT")
 	strEnvConfig(&conf.SentryRelease, "IMGPROXY_SENTRY_RELEASE")
 
+	nonNegativeIntEnvConfig(&conf.VipsConcurrency, "IMGPROXY_VIPS_CONCURRENCY")
+	nonNegativeIntEnvConfig(&conf.VipsCacheMem, "IMGPROXY_VIPS_CACHE_MEM")
+	nonNegativeIntEnvConfig(&conf.VipsCacheMaxOps, "IMGPROXY_VIPS_CACHE_MAX_OPS")
+
 	intEnvConfig(&conf.FreeMemoryInterval, "IMGPROXY_FREE_MEMORY_INTERVAL")
 	intEnvConfig(&conf.DownloadBufferSize, "IMGPROXY_DOWNLOAD_BUFFER_SIZE")
 	intEnvConfig(&conf.GZipBufferSize, "IMGPROXY_GZIP_BUFFER_SIZE")
 	intEnvConfig(&conf.BufferPoolCalibrationThreshold, "IMGPROXY_BUFFER_POOL_CALIBRATION_THRESHOLD")
+	boolEnvConfig(&conf.StreamSource, "IMGPROXY_STREAM_SOURCE")
 
 	if len(conf.Keys) != len(conf.Salts) {
 		logFatal("Number of keys and number of salts should be equal. Keys: %d, salts: %d", len(conf.Keys), len(conf.Salts))
 	}
+	if conf.AllowInsecure && len(conf.Keys) > 0 {
+		logWarning("Signature checking is disabled by IMGPROXY_ALLOW_INSECURE")
+	}
 	if len(conf.Keys) == 0 {
 		logWarning("No keys defined, so signature checking is disabled")
 		conf.AllowInsecure = true
@@ -352,6 +581,18 @@ func configure() {
 		conf.AllowInsecure = true
 	}
 
+	if len(conf.Secret) > 0 {
+		for _, name := range conf.SourceForwardHeaders {
+			if secretHeaders[http.CanonicalHeaderKey(name)] {
+				logWarning("%s header is not forwarded to the source when IMGPROXY_SECRET is set", name)
+			}
+		}
+	}
+
+	if conf.PostSourceEnabled && len(conf.Secret) == 0 {
+		logFatal("IMGPROXY_ENABLE_POST_SOURCE requires IMGPROXY_SECRET to be set")
+	}
+
 	if conf.SignatureSize < 1 || conf.SignatureSize > 32 {
 		logFatal("Signature size should be within 1 and 32, now - %d\n", conf.SignatureSize)
 	}
@@ -371,10 +612,18 @@ func configure() {
 		logFatal("KeepAlive timeout should be greater than or equal to 0, now - %d\n", conf.KeepAliveTimeout)
 	}
 
+	if conf.ShutdownTimeout <= 0 {
+		logFatal("Shutdown timeout should be greater than 0, now - %d\n", conf.ShutdownTimeout)
+	}
+
 	if conf.DownloadTimeout <= 0 {
 		logFatal("Download timeout should be greater than 0, now - %d\n", conf.DownloadTimeout)
 	}
 
+	if conf.DownloadRetries < 0 {
+		logFatal("Download retries number should be greater than or equal to 0, now - %d\n", conf.DownloadRetries)
+	}
+
 	if conf.Concurrency <= 0 {
 		logFatal("Concurrency should be greater than 0, now - %d\n", conf.Concurrency)
 	}
@@ -397,6 +646,14 @@ func configure() {
 		logFatal("Max src resolution should be greater than 0, now - %d\n", conf.MaxSrcResolution)
 	}
 
+	if conf.MaxDimension < 0 {
+		logFatal("Max dimension should be greater than or equal to 0, now - %d\n", conf.MaxDimension)
+	}
+
+	if conf.MaxResolution < 0 {
+		logFatal("Max resolution should be greater than or equal to 0, now - %d\n", conf.MaxResolution)
+	}
+
 	if conf.MaxSrcFileSize < 0 {
 		logFatal("Max src file size should be greater than or equal to 0, now - %d\n", conf.MaxSrcFileSize)
 	}
@@ -405,24 +662,69 @@ func configure() {
 		logFatal("Max animation frames should be greater than 0, now - %d\n", conf.MaxAnimationFrames)
 	}
 
+	if conf.MaxDpr < 1 {
+		logFatal("Max DPR should be greater than or equal to 1, now - %f\n", conf.MaxDpr)
+	}
+
+	if _, ok := jpegSubsamples[conf.JpegSubsample]; !ok {
+		logFatal("Unsupported JPEG subsample mode: %s\n", conf.JpegSubsample)
+	}
+
+	if _, ok := resizeKernels[conf.ResizeKernel]; !ok {
+		logFatal("Unsupported resize kernel: %s\n", conf.ResizeKernel)
+	}
+
+	if conf.PngCompression < 0 || conf.PngCompression > 9 {
+		logFatal("Png compression should be within 0 and 9, now - %d\n", conf.PngCompression)
+	}
+
 	if conf.PngQuantizationColors < 2 {
 		logFatal("Png quantization colors should be greater than 1, now - %d\n", conf.PngQuantizationColors)
 	} else if conf.PngQuantizationColors > 256 {
 		logFatal("Png quantization colors can't be greater than 256, now - %d\n", conf.PngQuantizationColors)
 	}
 
+	if conf.PngQuantizationDither < 0 || conf.PngQuantizationDither > 1 {
+		logFatal("Png quantization dither should be within 0 and 1, now - %f\n", conf.PngQuantizationDither)
+	}
+
+	if _, ok := tiffCompressions[conf.TiffCompression]; !ok {
+		logFatal("Unsupported TIFF compression: %s\n", conf.TiffCompression)
+	}
+
+	if len(conf.Background) > 0 && conf.Background != "transparent" {
+		if _, err := colorFromString(conf.Background); err != nil {
+			logFatal("Invalid default background: %s\n", err)
+		}
+	}
+
 	if conf.Quality <= 0 {
 		logFatal("Quality should be greater than 0, now - %d\n", conf.Quality)
 	} else if conf.Quality > 100 {
 		logFatal("Quality can't be greater than 100, now - %d\n", conf.Quality)
 	}
 
+	for name, q := range map[string]int{
+		"JPEG": conf.JpegQuality,
+		"WebP": conf.WebpQuality,
+		"AVIF": conf.AvifQuality,
+		"HEIC": conf.HeicQuality,
+	} {
+		if q < 0 || q > 100 {
+			logFatal("%s quality should be within 0 and 100, now - %d\n", name, q)
+		}
+	}
+
 	if conf.GZipCompression < 0 {
 		logFatal("GZip compression should be greater than or equal to 0, now - %d\n", conf.GZipCompression)
 	} else if conf.GZipCompression > 9 {
 		logFatal("GZip compression can't be greater than 9, now - %d\n", conf.GZipCompression)
 	}
 
+	if conf.SvgDpi <= 0 {
+		logFatal("SVG DPI should be greater than 0, now - %f\n", conf.SvgDpi)
+	}
+
 	if conf.IgnoreSslVerification {
 		logWarning("Ignoring SSL verification is very unsafe")
 	}
@@ -445,12 +747,25 @@ func configure() {
 		logFatal(err.Error())
 	}
 
+	if len(conf.WatermarkData)+len(conf.WatermarkPath)+len(conf.WatermarkURL) == 0 &&
+		len(conf.Watermark2xData)+len(conf.Watermark2xPath)+len(conf.Watermark2xURL) > 0 {
+		logWarning("High-DPI watermark is set but the regular one is not, so watermarks are disabled")
+	}
+
 	if conf.WatermarkOpacity <= 0 {
 		logFatal("Watermark opacity should be greater than 0")
 	} else if conf.WatermarkOpacity > 1 {
 		logFatal("Watermark opacity should be less than or equal to 1")
 	}
 
+	if conf.FallbackImageHTTPCode < 200 || conf.FallbackImageHTTPCode > 599 {
+		logFatal("Fallback image HTTP code should be between 200 and 599, now - %d\n", conf.FallbackImageHTTPCode)
+	}
+
+	if conf.UnsupportedFallbackImageHTTPCode != 0 && (conf.UnsupportedFallbackImageHTTPCode < 200 || conf.UnsupportedFallbackImageHTTPCode > 599) {
+		logFatal("Unsupported fallback image HTTP code should be between 200 and 599, now - %d\n", conf.UnsupportedFallbackImageHTTPCode)
+	}
+
 	if len(conf.PrometheusBind) > 0 && conf.PrometheusBind == conf.Bind {
 		logFatal("Can't use the same binding for the main server and Prometheus")
 	}
@@ -474,4 +789,9 @@ func configure() {
 	if conf.BufferPoolCalibrationThreshold < 64 {
 		logFatal("Buffer pool calibration threshold should be greater than or equal to 64")
 	}
+
+	if conf.StreamSource && conf.ETagEnabled {
+		logWarning("ETag is calculated from the whole source image, so IMGPROXY_STREAM_SOURCE is ignored when IMGPROXY_USE_ETAG is set")
+		conf.StreamSource = false
+	}
 }
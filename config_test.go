@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigTestSuite struct{ MainTestSuite }
+
+func (s *ConfigTestSuite) TearDownTest() {
+	s.MainTestSuite.TearDownTest()
+
+	os.Unsetenv("IMGPROXY_VIPS_CACHE_MEM")
+}
+
+func (s *ConfigTestSuite) TestNonNegativeIntEnvConfig() {
+	os.Setenv("IMGPROXY_VIPS_CACHE_MEM", "1048576")
+
+	v := 0
+	nonNegativeIntEnvConfig(&v, "IMGPROXY_VIPS_CACHE_MEM")
+
+	assert.Equal(s.T(), 1048576, v)
+}
+
+func (s *ConfigTestSuite) TestNonNegativeIntEnvConfigNegative() {
+	os.Setenv("IMGPROXY_VIPS_CACHE_MEM", "-1")
+
+	v := 100
+	nonNegativeIntEnvConfig(&v, "IMGPROXY_VIPS_CACHE_MEM")
+
+	assert.Equal(s.T(), 100, v)
+}
+
+func (s *ConfigTestSuite) TestNonNegativeIntEnvConfigNonNumeric() {
+	os.Setenv("IMGPROXY_VIPS_CACHE_MEM", "100Mb")
+
+	v := 100
+	nonNegativeIntEnvConfig(&v, "IMGPROXY_VIPS_CACHE_MEM")
+
+	assert.Equal(s.T(), 100, v)
+}
+
+func TestConfig(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
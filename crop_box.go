@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var cropBoxCtxKey = ctxKey("cropBox")
+
+// cropBox holds the area chosen by the last smart crop.
+// The area is set in the coordinates of the image the smart crop was applied to
+type cropBox struct {
+	mutex sync.Mutex
+	set   bool
+
+	Left, Top, Width, Height int
+}
+
+func startCropBox(ctx context.Context) context.Context {
+	if !conf.CropBoxHeaderEnabled {
+		return ctx
+	}
+
+	return context.WithValue(ctx, cropBoxCtxKey, &cropBox{})
+}
+
+func getCropBox(ctx context.Context) *cropBox {
+	cb, _ := ctx.Value(cropBoxCtxKey).(*cropBox)
+	return cb
+}
+
+func setCropBox(ctx context.Context, left, top, width, height int) {
+	cb := getCropBox(ctx)
+	if cb == nil {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.Left, cb.Top, cb.Width, cb.Height = left, top, width, height
+	cb.set = true
+}
+
+func (cb *cropBox) String() string {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if !cb.set {
+		return ""
+	}
+
+	return fmt.Sprintf("left=%d, top=%d, width=%d, height=%d", cb.Left, cb.Top, cb.Width, cb.Height)
+}
+
+func setCropBoxHeader(ctx context.Context, rw http.ResponseWriter) {
+	if cb := getCropBox(ctx); cb != nil {
+		if value := cb.String(); len(value) > 0 {
+			rw.Header().Set("X-Crop-Box", value)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type CropBoxTestSuite struct{ MainTestSuite }
+
+func (s *CropBoxTestSuite) TestDisabled() {
+	ctx := startCropBox(context.Background())
+	setCropBox(ctx, 1, 2, 3, 4)
+
+	rw := httptest.NewRecorder()
+	setCropBoxHeader(ctx, rw)
+
+	assert.Empty(s.T(), rw.Header().Get("X-Crop-Box"))
+}
+
+func (s *CropBoxTestSuite) TestNotSet() {
+	conf.CropBoxHeaderEnabled = true
+
+	ctx := startCropBox(context.Background())
+
+	rw := httptest.NewRecorder()
+	setCropBoxHeader(ctx, rw)
+
+	assert.Empty(s.T(), rw.Header().Get("X-Crop-Box"))
+}
+
+func (s *CropBoxTestSuite) TestSet() {
+	conf.CropBoxHeaderEnabled = true
+
+	ctx := startCropBox(context.Background())
+	setCropBox(ctx, 1, 2, 3, 4)
+
+	rw := httptest.NewRecorder()
+	setCropBoxHeader(ctx, rw)
+
+	assert.Equal(s.T(), "left=1, top=2, width=3, height=4", rw.Header().Get("X-Crop-Box"))
+}
+
+func (s *CropBoxTestSuite) TestSmartCrop() {
+	if !vipsSupportSmartcrop {
+		s.T().Skip("libvips doesn't support smart crop")
+	}
+
+	conf.CropBoxHeaderEnabled = true
+
+	// Gray image with a bright red square on the right
+	src := image.NewRGBA(image.Rect(0, 0, 60, 20))
+	for x := 0; x < 60; x++ {
+		for y := 0; y < 20; y++ {
+			if x >= 44 && x < 56 && y >= 4 && y < 16 {
+				src.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				src.Set(x, y, color.RGBA{128, 128, 128, 255})
+			}
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Resize = resizeFill
+	po.Width = 20
+	po.Height = 20
+	po.Gravity.Type = gravitySmart
+
+	ctx := startCropBox(context.Background())
+	ctx = context.WithValue(ctx, imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	_, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	cb := getCropBox(ctx)
+	require.True(s.T(), cb.set)
+
+	assert.Equal(s.T(), 20, cb.Width)
+	assert.Equal(s.T(), 20, cb.Height)
+	assert.Equal(s.T(), 0, cb.Top)
+	assert.True(s.T(), cb.Left > 20, "left: %d", cb.Left)
+}
+
+func TestCropBox(t *testing.T) {
+	suite.Run(t, new(CropBoxTestSuite))
+}
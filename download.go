@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	_ "image/gif"
@@ -24,13 +28,63 @@ var (
 	imageTypeCtxKey = ctxKey("imageType")
 	imageDataCtxKey = ctxKey("imageData")
 
+	forwardedHeadersCtxKey = ctxKey("forwardedHeaders")
+
+	downloadRetryDelay = 100 * time.Millisecond
+
 	errSourceDimensionsTooBig      = newError(422, "Source image dimensions are too big", "Invalid source image")
 	errSourceResolutionTooBig      = newError(422, "Source image resolution is too big", "Invalid source image")
 	errSourceFileTooBig            = newError(422, "Source image file is too big", "Invalid source image")
-	errSourceImageTypeNotSupported = newError(422, "Source image type not supported", "Invalid source image")
+	errSourceImageTypeNotSupported = newSourceImageTypeErrorWithMessage(msgSourceImageTypeNotSupported, "Invalid source image")
+	errSourceImageEmpty            = newError(422, "Source image is empty", "Invalid source image")
+	errSourceTooManyFrames         = newError(422, "Source image has too many animation frames", "Invalid source image")
+	errSourceNotAllowed            = newError(403, "Source image URL is not allowed", "Invalid source image")
+	errInvalidDataURI              = newError(422, "Invalid data URI", "Invalid source image")
+)
+
+const (
+	msgSourceImageIsUnreachable    = "Source image is unreachable"
+	msgSourceImageTypeNotSupported = "Source image type not supported"
 )
 
-const msgSourceImageIsUnreachable = "Source image is unreachable"
+// newSourceImageTypeError returns the error for the image of unsupported or unknown type.
+// The message contains the first bytes of the image, so its actual type can be figured out
+func newSourceImageTypeError(data []byte) *imgproxyError {
+	if len(data) == 0 {
+		return errSourceImageTypeNotSupported
+	}
+
+	head := fmt.Sprintf("%x", data[:minInt(len(data), 16)])
+	if len(data) > 16 {
+		head += "..."
+	}
+
+	return newSourceImageTypeErrorWithMessage(
+		fmt.Sprintf("%s: %s", msgSourceImageTypeNotSupported, head),
+		fmt.Sprintf("Unsupported source image format: %s", head),
+	)
+}
+
+func newSourceImageTypeErrorWithMessage(msg, pub string) *imgproxyError {
+	err := newError(422, msg, pub)
+	err.sourceImageType = true
+	return err
+}
+
+func isSourceImageTypeError(err error) bool {
+	ierr, ok := err.(*imgproxyError)
+	return ok && ierr.sourceImageType
+}
+
+// Types that are fully decoded by Go decoders while detecting. If detection failed,
+// such images are broken for sure, so Content-Type and extension can't be trusted
+var reliableSniffTypes = map[imageType]bool{
+	imageTypeJPEG: true,
+	imageTypePNG:  true,
+	imageTypeGIF:  true,
+	imageTypeICO:  true,
+	imageTypeBMP:  true,
+}
 
 var downloadBufPool *bufPool
 
@@ -75,18 +129,51 @@ func initDownloading() {
 		transport.RegisterProtocol("s3", newS3Transport())
 	}
 
-	if len(conf.GCSKey) > 0 {
+	if conf.GCSEnabled || len(conf.GCSKey) > 0 {
 		transport.RegisterProtocol("gs", newGCSTransport())
 	}
 
 	downloadClient = &http.Client{
-		Timeout:   time.Duration(conf.DownloadTimeout) * time.Second,
-		Transport: transport,
+		Timeout:       time.Duration(conf.DownloadTimeout) * time.Second,
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
 	}
 
 	downloadBufPool = newBufPool("download", conf.Concurrency, conf.DownloadBufferSize)
 }
 
+func isAllowedSource(imageURL string) bool {
+	if len(conf.AllowedSources) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range conf.AllowedSources {
+		if allowed.Match(u) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRedirect doesn't allow redirects to the sources that are not allowed
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	if !isAllowedSource(req.URL.String()) {
+		return errSourceNotAllowed
+	}
+
+	return nil
+}
+
 func checkDimensions(width, height int) error {
 	if conf.MaxSrcDimension > 0 && (width > conf.MaxSrcDimension || height > conf.MaxSrcDimension) {
 		return errSourceDimensionsTooBig
@@ -120,6 +207,44 @@ func checkTypeAndDimensions(r io.Reader) (imageType, error) {
 	return imgtype, nil
 }
 
+// detectImageType reconciles the image type sniffed from the first bytes of the image
+// with the types from the Content-Type header and the URL extension.
+// When the sniff fails because the content is unknown or can't be parsed (some WebP
+// variants, for example), the type from the header or the extension is used
+func detectImageType(ctx context.Context, sniffed imageType, sniffErr error, contentType, imageURL string) (imageType, error) {
+	headerType := imageTypeFromMime(contentType)
+	extType := imageTypeFromURL(imageURL)
+
+	if sniffErr == nil {
+		if headerType != imageTypeUnknown && headerType != sniffed {
+			logRequestWarning(getRequestID(ctx), "Source image type mismatch: %s detected, but Content-Type is %s", sniffed, contentType)
+		} else if extType != imageTypeUnknown && extType != sniffed {
+			logRequestWarning(getRequestID(ctx), "Source image type mismatch: %s detected, but extension is %s", sniffed, extType)
+		}
+
+		return sniffed, nil
+	}
+
+	// Size and dimensions errors should not be bypassed
+	if ierr, ok := sniffErr.(*imgproxyError); ok && ierr != errSourceImageTypeNotSupported {
+		return imageTypeUnknown, sniffErr
+	}
+
+	hinted := headerType
+	if hinted == imageTypeUnknown {
+		hinted = extType
+	}
+
+	if hinted == imageTypeUnknown || reliableSniffTypes[hinted] || !vipsTypeSupportLoad[hinted] {
+		return imageTypeUnknown, sniffErr
+	}
+
+	// We can't check dimensions of such images before loading them
+	logRequestWarning(getRequestID(ctx), "Can't detect source image type by its content (%s), using %s from Content-Type or extension", sniffErr, hinted)
+
+	return hinted, nil
+}
+
 func readAndCheckImage(ctx context.Context, res *http.Response) (context.Context, context.CancelFunc, error) {
 	var contentLength int
 
@@ -143,20 +268,164 @@ func readAndCheckImage(ctx context.Context, res *http.Response) (context.Context
 	}
 
 	imgtype, err := checkTypeAndDimensions(io.TeeReader(body, buf))
+
+	if err == errSourceImageTypeNotSupported && buf.Len() == 0 {
+		return ctx, cancel, errSourceImageEmpty
+	}
+
+	imgtype, err = detectImageType(ctx, imgtype, err, res.Header.Get("Content-Type"), getImageURL(ctx))
+	if err == errSourceImageTypeNotSupported {
+		return ctx, cancel, newSourceImageTypeError(buf.Bytes())
+	}
 	if err != nil {
 		return ctx, cancel, err
 	}
 
+	ctx = context.WithValue(ctx, imageTypeCtxKey, imgtype)
+	ctx = context.WithValue(ctx, imageDataCtxKey, buf)
+
+	// The rest of the image is read by libvips while it's decoded
+	if isSourceStreamed(ctx) && vipsTypeSupportStream[imgtype] {
+		stream := newImageStream(buf, body)
+		ctx = context.WithValue(ctx, imageStreamCtxKey, stream)
+
+		return ctx, func() {
+			stream.Close()
+			cancel()
+		}, nil
+	}
+
 	if _, err = buf.ReadFrom(body); err != nil {
+		if err == errSourceFileTooBig {
+			return ctx, cancel, err
+		}
 		return ctx, cancel, newError(404, err.Error(), msgSourceImageIsUnreachable)
 	}
 
-	ctx = context.WithValue(ctx, imageTypeCtxKey, imgtype)
-	ctx = context.WithValue(ctx, imageDataCtxKey, buf)
-
 	return ctx, cancel, nil
 }
 
+// readDataURI decodes the image from data URI like data:image/png;base64,...
+func readDataURI(ctx context.Context, uri string) (context.Context, context.CancelFunc, error) {
+	commaInd := strings.IndexByte(uri, ',')
+	if commaInd < 0 {
+		return ctx, func() {}, errInvalidDataURI
+	}
+
+	meta, payload := strings.TrimPrefix(uri[:commaInd], "data:"), uri[commaInd+1:]
+
+	isBase64 := strings.HasSuffix(meta, ";base64")
+
+	mediatype := strings.Split(meta, ";")[0]
+	if !strings.HasPrefix(mediatype, "image/") {
+		return ctx, func() {}, errSourceImageTypeNotSupported
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+
+	if isBase64 {
+		data, err = base64.StdEncoding.DecodeString(payload)
+	} else {
+		var unescaped string
+		unescaped, err = url.PathUnescape(payload)
+		data = []byte(unescaped)
+	}
+
+	if err != nil {
+		return ctx, func() {}, errInvalidDataURI
+	}
+
+	res := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Type": {mediatype}},
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+	}
+
+	return readAndCheckImage(ctx, res)
+}
+
+// readRequestBody reads the source image from the POST request body instead of downloading it.
+// The body is checked the same way as the downloaded image, including IMGPROXY_MAX_SRC_FILE_SIZE
+func readRequestBody(ctx context.Context, r *http.Request) (context.Context, context.CancelFunc, error) {
+	res := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Type": {r.Header.Get("Content-Type")}},
+		ContentLength: r.ContentLength,
+		Body:          r.Body,
+	}
+
+	return readAndCheckImage(ctx, res)
+}
+
+// requestSource sends the request to the source. Requests failed because of connection
+// or server errors are retried up to IMGPROXY_DOWNLOAD_RETRIES times with exponential backoff.
+// All the attempts are bound to the request context, so they stop when it's done
+func requestSource(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		res, err := downloadClient.Do(req)
+
+		if uerr, ok := err.(*url.Error); ok && uerr.Err == errSourceNotAllowed {
+			return res, errSourceNotAllowed
+		}
+
+		if attempt >= conf.DownloadRetries || (err == nil && res.StatusCode < 500) {
+			return res, err
+		}
+
+		if res != nil {
+			res.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(downloadRetryDelay << uint(attempt)):
+		}
+	}
+}
+
+// secretHeaders can carry imgproxy's own credentials, so they are not forwarded
+// to the source when IMGPROXY_SECRET is set
+var secretHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+}
+
+// forwardedHeaders returns the incoming request headers that should be sent to the source
+func forwardedHeaders(r *http.Request) http.Header {
+	headers := make(http.Header)
+
+	for _, name := range conf.SourceForwardHeaders {
+		name = http.CanonicalHeaderKey(name)
+
+		if len(conf.Secret) > 0 && secretHeaders[name] {
+			continue
+		}
+
+		if values, ok := r.Header[name]; ok {
+			headers[name] = values
+		}
+	}
+
+	return headers
+}
+
+// sourceErrorStatus returns the response status for the source response status.
+// Client errors like 403 and 404 mean that the source image can't be found,
+// and server errors mean that the source is broken
+func sourceErrorStatus(status int) int {
+	if status >= 500 {
+		return 502
+	}
+	return 404
+}
+
 func downloadImage(ctx context.Context) (context.Context, context.CancelFunc, error) {
 	url := getImageURL(ctx)
 
@@ -169,28 +438,73 @@ func downloadImage(ctx context.Context) (context.Context, context.CancelFunc, er
 		defer startPrometheusDuration(prometheusDownloadDuration)()
 	}
 
+	if !isAllowedSource(url) {
+		return ctx, func() {}, errSourceNotAllowed
+	}
+
+	if strings.HasPrefix(url, "data:") {
+		return readDataURI(ctx, url)
+	}
+
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return ctx, func() {}, newError(404, err.Error(), msgSourceImageIsUnreachable)
 	}
 
+	// IMGPROXY_DOWNLOAD_TIMEOUT limits the whole download including the retries.
+	// Streamed response body is read after downloadImage returns, so the deadline
+	// is canceled with the returned cancel function
+	downloadCtx, downloadCancel := context.WithTimeout(ctx, time.Duration(conf.DownloadTimeout)*time.Second)
+	req = req.WithContext(downloadCtx)
+
 	req.Header.Set("User-Agent", conf.UserAgent)
 
-	res, err := downloadClient.Do(req)
-	if res != nil {
-		defer res.Body.Close()
+	for name, value := range conf.SourceHeaders {
+		req.Header.Set(name, value)
+	}
+
+	if headers, ok := ctx.Value(forwardedHeadersCtxKey).(http.Header); ok {
+		for name, values := range headers {
+			req.Header[name] = values
+		}
 	}
+
+	res, err := requestSource(req)
 	if err != nil {
+		downloadCancel()
+		if res != nil {
+			res.Body.Close()
+		}
+		if err == errSourceNotAllowed {
+			return ctx, func() {}, err
+		}
+		checkTimeout(ctx)
 		return ctx, func() {}, newError(404, err.Error(), msgSourceImageIsUnreachable)
 	}
 
 	if res.StatusCode != 200 {
+		defer downloadCancel()
+		defer res.Body.Close()
+
 		body, _ := ioutil.ReadAll(res.Body)
 		msg := fmt.Sprintf("Can't download image; Status: %d; %s", res.StatusCode, string(body))
-		return ctx, func() {}, newError(404, msg, msgSourceImageIsUnreachable)
+		return ctx, func() {}, newError(sourceErrorStatus(res.StatusCode), msg, msgSourceImageIsUnreachable)
 	}
 
-	return readAndCheckImage(ctx, res)
+	ctx, cancel, err := readAndCheckImage(ctx, res)
+
+	// Streamed response body is closed with cancel when the image is processed
+	if getImageStream(ctx) == nil {
+		res.Body.Close()
+		downloadCancel()
+
+		return ctx, cancel, err
+	}
+
+	return ctx, func() {
+		cancel()
+		downloadCancel()
+	}, err
 }
 
 func getImageType(ctx context.Context) imageType {
@@ -10,6 +10,9 @@ type imgproxyError struct {
 	StatusCode    int
 	Message       string
 	PublicMessage string
+
+	// sourceImageType is set for the errors of unsupported or unknown source image types
+	sourceImageType bool
 }
 
 func (e *imgproxyError) Error() string {
@@ -17,14 +20,14 @@ func (e *imgproxyError) Error() string {
 }
 
 func newError(status int, msg string, pub string) *imgproxyError {
-	return &imgproxyError{status, msg, pub}
+	return &imgproxyError{StatusCode: status, Message: msg, PublicMessage: pub}
 }
 
 func newUnexpectedError(msg string, skip int) *imgproxyError {
 	return &imgproxyError{
-		500,
-		fmt.Sprintf("Unexpected error: %s\n%s", msg, stacktrace(skip+3)),
-		"Internal error",
+		StatusCode:    500,
+		Message:       fmt.Sprintf("Unexpected error: %s\n%s", msg, stacktrace(skip+3)),
+		PublicMessage: "Internal error",
 	}
 }
 
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"hash"
+	"strings"
 	"sync"
 )
 
@@ -40,5 +41,19 @@ func calcETag(ctx context.Context) string {
 	c.enc.Encode(conf)
 	c.enc.Encode(getProcessingOptions(ctx))
 
-	return hex.EncodeToString(c.hash.Sum(nil))
+	return `"` + hex.EncodeToString(c.hash.Sum(nil)) + `"`
+}
+
+// eTagMatches checks if the If-None-Match header value matches the ETag.
+// RFC 7232 requires weak comparison for If-None-Match, so W/ prefix is ignored
+func eTagMatches(header, eTag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+		if candidate == "*" || candidate == eTag {
+			return true
+		}
+	}
+
+	return false
 }
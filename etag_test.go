@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ETagTestSuite struct{ MainTestSuite }
+
+func (s *ETagTestSuite) etagCtx(data string, width int) context.Context {
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Width = width
+
+	ctx := context.WithValue(context.Background(), imageDataCtxKey, bytes.NewBufferString(data))
+	return context.WithValue(ctx, processingOptionsCtxKey, po)
+}
+
+func (s *ETagTestSuite) TestCalcETag() {
+	eTag := calcETag(s.etagCtx("image", 100))
+
+	assert.Regexp(s.T(), `^"[0-9a-f]{64}"$`, eTag)
+	assert.Equal(s.T(), eTag, calcETag(s.etagCtx("image", 100)))
+	assert.NotEqual(s.T(), eTag, calcETag(s.etagCtx("image", 200)))
+	assert.NotEqual(s.T(), eTag, calcETag(s.etagCtx("other image", 100)))
+}
+
+func (s *ETagTestSuite) TestETagMatches() {
+	eTag := `"abcdef"`
+
+	assert.True(s.T(), eTagMatches(`"abcdef"`, eTag))
+	assert.True(s.T(), eTagMatches(`W/"abcdef"`, eTag))
+	assert.True(s.T(), eTagMatches(`"123456", "abcdef"`, eTag))
+	assert.True(s.T(), eTagMatches(`*`, eTag))
+
+	assert.False(s.T(), eTagMatches(``, eTag))
+	assert.False(s.T(), eTagMatches(`abcdef`, eTag))
+	assert.False(s.T(), eTagMatches(`"123456"`, eTag))
+}
+
+func TestETag(t *testing.T) {
+	suite.Run(t, new(ETagTestSuite))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	fallbackImageData []byte
+	fallbackImageType imageType
+
+	unsupportedFallbackImageData []byte
+	unsupportedFallbackImageType imageType
+)
+
+func initFallbackImage() {
+	var err error
+
+	if fallbackImageData, fallbackImageType, err = loadFallbackImage(conf.FallbackImage); err != nil {
+		logFatal(err.Error())
+	}
+
+	if unsupportedFallbackImageData, unsupportedFallbackImageType, err = loadFallbackImage(conf.UnsupportedFallbackImage); err != nil {
+		logFatal(err.Error())
+	}
+}
+
+func loadFallbackImage(path string) ([]byte, imageType, error) {
+	if len(path) == 0 {
+		return nil, imageTypeUnknown, nil
+	}
+
+	if strings.Contains(path, "://") {
+		return remoteFallbackImageData(path)
+	}
+
+	return fileFallbackImageData(path)
+}
+
+func fileFallbackImageData(path string) ([]byte, imageType, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, imageTypeUnknown, fmt.Errorf("Can't read fallback image: %s", err)
+	}
+
+	imgtype, err := checkTypeAndDimensions(bytes.NewReader(data))
+	if err != nil {
+		return nil, imageTypeUnknown, fmt.Errorf("Can't decode fallback image: %s", err)
+	}
+
+	return data, imgtype, nil
+}
+
+func remoteFallbackImageData(url string) ([]byte, imageType, error) {
+	ctx := context.WithValue(context.Background(), imageURLCtxKey, url)
+	ctx, cancel, err := downloadImage(ctx)
+	defer cancel()
+
+	if err != nil {
+		return nil, imageTypeUnknown, fmt.Errorf("Can't download fallback image: %s", err)
+	}
+
+	// Downloaded data belongs to the buffer pool, so we need to copy it
+	data := make([]byte, getImageData(ctx).Len())
+	copy(data, getImageData(ctx).Bytes())
+
+	return data, getImageType(ctx), nil
+}
+
+// fallbackImageFor returns the fallback image and the response status code for the error.
+// Unsupported source images have their own fallback image when it's set
+func fallbackImageFor(err error) ([]byte, imageType, int) {
+	if unsupportedFallbackImageData != nil && isSourceImageTypeError(err) {
+		statusCode := conf.UnsupportedFallbackImageHTTPCode
+		if statusCode == 0 {
+			statusCode = conf.FallbackImageHTTPCode
+		}
+
+		return unsupportedFallbackImageData, unsupportedFallbackImageType, statusCode
+	}
+
+	return fallbackImageData, fallbackImageType, conf.FallbackImageHTTPCode
+}
+
+// withFallbackImage replaces the source image in the context with the fallback image
+func withFallbackImage(ctx context.Context, data []byte, imgtype imageType) context.Context {
+	ctx = context.WithValue(ctx, imageTypeCtxKey, imgtype)
+	ctx = context.WithValue(ctx, imageStreamCtxKey, (*imageStream)(nil))
+	return context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type FallbackImageTestSuite struct {
+	MainTestSuite
+
+	data []byte
+}
+
+func (s *FallbackImageTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	buf := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+
+	s.data = buf.Bytes()
+}
+
+func (s *FallbackImageTestSuite) TestNotSet() {
+	data, imgtype, err := loadFallbackImage("")
+
+	require.Nil(s.T(), err)
+	assert.Nil(s.T(), data)
+	assert.Equal(s.T(), imageTypeUnknown, imgtype)
+}
+
+func (s *FallbackImageTestSuite) TestFile() {
+	f, err := ioutil.TempFile("", "fallback*.png")
+	require.Nil(s.T(), err)
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(s.data)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), f.Close())
+
+	data, imgtype, err := loadFallbackImage(f.Name())
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), s.data, data)
+	assert.Equal(s.T(), imageTypePNG, imgtype)
+}
+
+func (s *FallbackImageTestSuite) TestURL() {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "image/png")
+		rw.Write(s.data)
+	}))
+	defer server.Close()
+
+	data, imgtype, err := loadFallbackImage(server.URL + "/fallback.png")
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), s.data, data)
+	assert.Equal(s.T(), imageTypePNG, imgtype)
+}
+
+func (s *FallbackImageTestSuite) TestInvalidFile() {
+	f, err := ioutil.TempFile("", "fallback*.png")
+	require.Nil(s.T(), err)
+	defer os.Remove(f.Name())
+
+	_, err = f.Write([]byte("not an image"))
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), f.Close())
+
+	_, _, err = loadFallbackImage(f.Name())
+
+	assert.NotNil(s.T(), err)
+}
+
+func TestFallbackImage(t *testing.T) {
+	suite.Run(t, new(FallbackImageTestSuite))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 type fsTransport struct {
@@ -13,7 +14,22 @@ func newFsTransport() fsTransport {
 	return fsTransport{fs: http.Dir(conf.LocalFileSystemRoot)}
 }
 
+func containsDotDot(path string) bool {
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
 func (t fsTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	// http.Dir doesn't let the path escape the root, but it silently serves another file,
+	// so we reject such paths explicitly
+	if containsDotDot(req.URL.Path) {
+		return nil, fmt.Errorf("%s is outside of the local filesystem root", req.URL.Path)
+	}
+
 	f, err := t.fs.Open(req.URL.Path)
 
 	if err != nil {
@@ -22,10 +38,12 @@ func (t fsTransport) RoundTrip(req *http.Request) (resp *http.Response, err erro
 
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
 	if fi.IsDir() {
+		f.Close()
 		return nil, fmt.Errorf("%s is a directory", req.URL.Path)
 	}
 
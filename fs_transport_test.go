@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type FsTransportTestSuite struct {
+	MainTestSuite
+
+	root   string
+	client *http.Client
+}
+
+func (s *FsTransportTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	dir, err := ioutil.TempDir("", "imgproxy-fs-test")
+	require.Nil(s.T(), err)
+
+	s.root = filepath.Join(dir, "root")
+
+	require.Nil(s.T(), os.MkdirAll(filepath.Join(s.root, "images"), 0755))
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(s.root, "images", "test.png"), []byte("image"), 0644))
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(dir, "secret.png"), []byte("secret"), 0644))
+
+	conf.LocalFileSystemRoot = s.root
+
+	s.client = newTestTransportClient("local", newFsTransport())
+}
+
+func (s *FsTransportTestSuite) TearDownTest() {
+	os.RemoveAll(filepath.Dir(s.root))
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *FsTransportTestSuite) TestServeFile() {
+	res, err := s.client.Get("local:///images/test.png")
+	require.Nil(s.T(), err)
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), 200, res.StatusCode)
+	assert.Equal(s.T(), "image", string(body))
+}
+
+func (s *FsTransportTestSuite) TestMissingFile() {
+	_, err := s.client.Get("local:///images/missing.png")
+	assert.NotNil(s.T(), err)
+}
+
+func (s *FsTransportTestSuite) TestDirectory() {
+	_, err := s.client.Get("local:///images")
+	assert.NotNil(s.T(), err)
+}
+
+func (s *FsTransportTestSuite) TestPathTraversal() {
+	for _, url := range []string{
+		"local:///../secret.png",
+		"local:///images/../../secret.png",
+		"local:///images/%2e%2e/%2e%2e/secret.png",
+	} {
+		_, err := s.client.Get(url)
+		assert.NotNil(s.T(), err, url)
+	}
+}
+
+func newTestTransportClient(scheme string, rt http.RoundTripper) *http.Client {
+	transport := &http.Transport{}
+	transport.RegisterProtocol(scheme, rt)
+
+	return &http.Client{Transport: transport}
+}
+
+func TestFsTransport(t *testing.T) {
+	suite.Run(t, new(FsTransportTestSuite))
+}
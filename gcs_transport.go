@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,7 +16,14 @@ type gcsTransport struct {
 }
 
 func newGCSTransport() http.RoundTripper {
-	client, err := storage.NewClient(context.Background(), option.WithCredentialsJSON([]byte(conf.GCSKey)))
+	var opts []option.ClientOption
+
+	// Application default credentials are used when the key is not set
+	if len(conf.GCSKey) > 0 {
+		opts = append(opts, option.WithCredentialsJSON([]byte(conf.GCSKey)))
+	}
+
+	client, err := storage.NewClient(context.Background(), opts...)
 
 	if err != nil {
 		logFatal("Can't create GCS client: %s", err)
@@ -32,7 +40,22 @@ func (t gcsTransport) RoundTrip(req *http.Request) (resp *http.Response, err err
 		obj = obj.Generation(g)
 	}
 
-	reader, err := obj.NewReader(context.Background())
+	reader, err := obj.NewReader(req.Context())
+
+	if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+		return &http.Response{
+			Status:        "404 Not Found",
+			StatusCode:    404,
+			Proto:         "HTTP/1.0",
+			ProtoMajor:    1,
+			ProtoMinor:    0,
+			Header:        make(http.Header),
+			ContentLength: int64(len(err.Error())),
+			Body:          ioutil.NopCloser(strings.NewReader(err.Error())),
+			Close:         true,
+			Request:       req,
+		}, nil
+	}
 
 	if err != nil {
 		return nil, err
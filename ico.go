@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	icoHeaderSize   = 6
+	icoDirEntrySize = 16
+	icoMaxSize      = 256
+)
+
+type icoEntry struct {
+	Width, Height int
+	Data          []byte
+}
+
+// icoDimension returns the value of ICO directory entry width/height byte.
+// 0 means 256
+func icoDimension(size int) byte {
+	if size >= icoMaxSize {
+		return 0
+	}
+	return byte(size)
+}
+
+// icoPack packs PNG-encoded images into ICO container
+func icoPack(entries []icoEntry) []byte {
+	size := icoHeaderSize + icoDirEntrySize*len(entries)
+	for _, e := range entries {
+		size += len(e.Data)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+
+	// Reserved, type (1 for icons), number of images
+	binary.Write(buf, binary.LittleEndian, []uint16{0, 1, uint16(len(entries))})
+
+	offset := icoHeaderSize + icoDirEntrySize*len(entries)
+
+	for _, e := range entries {
+		// Width, height, number of palette colors, reserved
+		buf.Write([]byte{icoDimension(e.Width), icoDimension(e.Height), 0, 0})
+		// Color planes, bits per pixel
+		binary.Write(buf, binary.LittleEndian, []uint16{1, 32})
+		// Image data size and offset
+		binary.Write(buf, binary.LittleEndian, []uint32{uint32(len(e.Data)), uint32(offset)})
+
+		offset += len(e.Data)
+	}
+
+	for _, e := range entries {
+		buf.Write(e.Data)
+	}
+
+	return buf.Bytes()
+}
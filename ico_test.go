@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type IcoTestSuite struct{ MainTestSuite }
+
+func (s *IcoTestSuite) TestPack() {
+	small := testPng(s.T(), 16, 16).Bytes()
+	big := testPng(s.T(), 256, 128).Bytes()
+
+	data := icoPack([]icoEntry{
+		{Width: 16, Height: 16, Data: small},
+		{Width: 256, Height: 128, Data: big},
+	})
+
+	assert.Equal(s.T(), []byte{0, 0, 1, 0, 2, 0}, data[:6])
+
+	// Directory entries
+	assert.Equal(s.T(), []byte{16, 16, 0, 0, 1, 0, 32, 0}, data[6:14])
+	assert.Equal(s.T(), uint32(len(small)), binary.LittleEndian.Uint32(data[14:18]))
+	assert.Equal(s.T(), uint32(38), binary.LittleEndian.Uint32(data[18:22]))
+
+	assert.Equal(s.T(), []byte{0, 128, 0, 0, 1, 0, 32, 0}, data[22:30])
+	assert.Equal(s.T(), uint32(len(big)), binary.LittleEndian.Uint32(data[30:34]))
+	assert.Equal(s.T(), uint32(38+len(small)), binary.LittleEndian.Uint32(data[34:38]))
+
+	assert.Equal(s.T(), small, data[38:38+len(small)])
+	assert.Equal(s.T(), big, data[38+len(small):])
+}
+
+func (s *IcoTestSuite) TestPackDecode() {
+	data := icoPack([]icoEntry{
+		{Width: 16, Height: 16, Data: testPng(s.T(), 16, 16).Bytes()},
+		{Width: 32, Height: 32, Data: testPng(s.T(), 32, 32).Bytes()},
+	})
+
+	img, imgtype, err := image.Decode(bytes.NewReader(data))
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), "ico", imgtype)
+	assert.Equal(s.T(), image.Rect(0, 0, 32, 32), img.Bounds())
+}
+
+func TestIco(t *testing.T) {
+	suite.Run(t, new(IcoTestSuite))
+}
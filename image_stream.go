@@ -0,0 +1,153 @@
+package main
+
+/*
+#include "vips.h"
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+var (
+	imageStreamCtxKey  = ctxKey("imageStream")
+	streamSourceCtxKey = ctxKey("streamSource")
+
+	imageStreams          = make(map[C.guintptr]*imageStream)
+	imageStreamsMutex     sync.Mutex
+	imageStreamLastHandle C.guintptr
+)
+
+// imageStream is the source image that libvips decodes while it's being downloaded.
+// It starts with the data that was read while detecting the image type
+type imageStream struct {
+	handle C.guintptr
+	source *C.VipsObject
+
+	head   *bytes.Buffer
+	body   io.ReadCloser
+	reader io.Reader
+
+	read int
+	err  error
+}
+
+func newImageStream(head *bytes.Buffer, body io.ReadCloser) *imageStream {
+	s := &imageStream{
+		head:   head,
+		body:   body,
+		reader: io.MultiReader(bytes.NewReader(head.Bytes()), body),
+	}
+
+	imageStreamsMutex.Lock()
+	defer imageStreamsMutex.Unlock()
+
+	imageStreamLastHandle++
+	s.handle = imageStreamLastHandle
+	imageStreams[s.handle] = s
+
+	return s
+}
+
+func (s *imageStream) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	s.read += n
+
+	if err != nil && err != io.EOF && s.err == nil {
+		if err == errSourceFileTooBig {
+			s.err = err
+		} else {
+			s.err = newError(404, err.Error(), msgSourceImageIsUnreachable)
+		}
+	}
+
+	return n, err
+}
+
+// Buffer reads the rest of the image to the head buffer, so the image can be
+// loaded from the buffer. It can be used only before libvips started reading the stream
+func (s *imageStream) Buffer() error {
+	if s.read > 0 {
+		return newUnexpectedError("Can't buffer the image stream that is already read", 1)
+	}
+
+	if _, err := s.head.ReadFrom(s.body); err != nil {
+		if err == errSourceFileTooBig {
+			return err
+		}
+		return newError(404, err.Error(), msgSourceImageIsUnreachable)
+	}
+
+	return nil
+}
+
+// Len returns the number of the source image bytes read so far
+func (s *imageStream) Len() int {
+	return maxInt(s.head.Len(), s.read)
+}
+
+// vipsSource returns libvips source that reads the stream. The same source is used
+// for all the loads of the image, so libvips can rewind it while it's not decoded
+func (s *imageStream) vipsSource() (*C.VipsObject, error) {
+	if s.source == nil {
+		if s.source = C.vips_source_new_go(s.handle); s.source == nil {
+			return nil, vipsError()
+		}
+	}
+
+	return s.source, nil
+}
+
+func (s *imageStream) Close() {
+	imageStreamsMutex.Lock()
+	delete(imageStreams, s.handle)
+	imageStreamsMutex.Unlock()
+
+	if s.source != nil {
+		C.vips_source_unref_go(s.source)
+		s.source = nil
+	}
+
+	s.body.Close()
+}
+
+func getImageStream(ctx context.Context) *imageStream {
+	stream, _ := ctx.Value(imageStreamCtxKey).(*imageStream)
+	return stream
+}
+
+func isSourceStreamed(ctx context.Context) bool {
+	stream, _ := ctx.Value(streamSourceCtxKey).(bool)
+	return stream
+}
+
+//export imgproxyStreamRead
+func imgproxyStreamRead(handle C.guintptr, buf unsafe.Pointer, size C.gint64) C.gint64 {
+	imageStreamsMutex.Lock()
+	s, ok := imageStreams[handle]
+	imageStreamsMutex.Unlock()
+
+	if !ok {
+		return -1
+	}
+
+	if size > 1<<30 {
+		size = 1 << 30
+	}
+
+	p := (*[1 << 30]byte)(buf)[:size:size]
+
+	// libvips treats zero-length reads as the end of the stream
+	for {
+		n, err := s.Read(p)
+		if n > 0 || err == io.EOF {
+			return C.gint64(n)
+		}
+		if err != nil {
+			return -1
+		}
+	}
+}
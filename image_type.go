@@ -8,6 +8,7 @@ import "C"
 
 import (
 	"fmt"
+	"mime"
 	"net/url"
 	"path/filepath"
 	"strings"
@@ -24,6 +25,10 @@ const (
 	imageTypeICO     = imageType(C.ICO)
 	imageTypeSVG     = imageType(C.SVG)
 	imageTypeHEIC    = imageType(C.HEIC)
+	imageTypeAVIF    = imageType(C.AVIF)
+	imageTypePDF     = imageType(C.PDF)
+	imageTypeTIFF    = imageType(C.TIFF)
+	imageTypeBMP     = imageType(C.BMP)
 
 	contentDispositionFilenameFallback = "image"
 )
@@ -38,6 +43,12 @@ var (
 		"ico":  imageTypeICO,
 		"svg":  imageTypeSVG,
 		"heic": imageTypeHEIC,
+		"heif": imageTypeHEIC,
+		"avif": imageTypeAVIF,
+		"pdf":  imageTypePDF,
+		"tiff": imageTypeTIFF,
+		"tif":  imageTypeTIFF,
+		"bmp":  imageTypeBMP,
 	}
 
 	mimes = map[imageType]string{
@@ -47,6 +58,29 @@ var (
 		imageTypeGIF:  "image/gif",
 		imageTypeICO:  "image/x-icon",
 		imageTypeHEIC: "image/heif",
+		imageTypeAVIF: "image/avif",
+		imageTypeTIFF: "image/tiff",
+	}
+
+	// mimeTypes maps source Content-Type values to image types.
+	// It includes non-standard values that are used in the wild
+	mimeTypes = map[string]imageType{
+		"image/jpeg":               imageTypeJPEG,
+		"image/jpg":                imageTypeJPEG,
+		"image/pjpeg":              imageTypeJPEG,
+		"image/png":                imageTypePNG,
+		"image/webp":               imageTypeWEBP,
+		"image/gif":                imageTypeGIF,
+		"image/x-icon":             imageTypeICO,
+		"image/vnd.microsoft.icon": imageTypeICO,
+		"image/svg+xml":            imageTypeSVG,
+		"image/heif":               imageTypeHEIC,
+		"image/heic":               imageTypeHEIC,
+		"image/avif":               imageTypeAVIF,
+		"application/pdf":          imageTypePDF,
+		"image/tiff":               imageTypeTIFF,
+		"image/bmp":                imageTypeBMP,
+		"image/x-ms-bmp":           imageTypeBMP,
 	}
 
 	contentDispositionsFmt = map[imageType]string{
@@ -56,6 +90,8 @@ var (
 		imageTypeGIF:  "inline; filename=\"%s.gif\"",
 		imageTypeICO:  "inline; filename=\"%s.ico\"",
 		imageTypeHEIC: "inline; filename=\"%s.heic\"",
+		imageTypeAVIF: "inline; filename=\"%s.avif\"",
+		imageTypeTIFF: "inline; filename=\"%s.tiff\"",
 	}
 )
 
@@ -76,21 +112,77 @@ func (it imageType) Mime() string {
 	return "application/octet-stream"
 }
 
-func (it imageType) ContentDisposition(imageURL string) string {
+func (it imageType) SupportsAlpha() bool {
+	return it != imageTypeJPEG
+}
+
+func (it imageType) SupportsQuality() bool {
+	return it == imageTypeJPEG || it == imageTypeWEBP || it == imageTypeHEIC || it == imageTypeAVIF
+}
+
+// IsVector checks if the image can be rendered at any scale without quality loss
+func (it imageType) IsVector() bool {
+	return it == imageTypeSVG || it == imageTypePDF
+}
+
+func (it imageType) ContentDisposition(filename string) string {
 	format, ok := contentDispositionsFmt[it]
 	if !ok {
 		return "inline"
 	}
 
+	// Extension should match the resulting format
+	filename = sanitizeFilename(strings.TrimSuffix(filename, filepath.Ext(filename)))
+	if len(filename) == 0 {
+		filename = contentDispositionFilenameFallback
+	}
+
+	return fmt.Sprintf(format, filename)
+}
+
+// imageTypeFromMime returns the image type for the Content-Type header value
+func imageTypeFromMime(contentType string) imageType {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return imageTypeUnknown
+	}
+
+	if imgtype, ok := mimeTypes[mediatype]; ok {
+		return imgtype
+	}
+
+	return imageTypeUnknown
+}
+
+// imageTypeFromURL returns the image type for the extension of the source image URL
+func imageTypeFromURL(imageURL string) imageType {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filenameFromURL(imageURL)), "."))
+
+	if imgtype, ok := imageTypes[ext]; ok {
+		return imgtype
+	}
+
+	return imageTypeUnknown
+}
+
+// filenameFromURL returns the source image filename to be used in Content-Disposition
+func filenameFromURL(imageURL string) string {
 	url, err := url.Parse(imageURL)
 	if err != nil {
-		return fmt.Sprintf(format, contentDispositionFilenameFallback)
+		return ""
 	}
 
 	_, filename := filepath.Split(url.Path)
-	if len(filename) == 0 {
-		return fmt.Sprintf(format, contentDispositionFilenameFallback)
-	}
 
-	return fmt.Sprintf(format, strings.TrimSuffix(filename, filepath.Ext(filename)))
+	return filename
+}
+
+// sanitizeFilename removes characters that can break Content-Disposition header
+func sanitizeFilename(filename string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' || r == '\\' || r == '/' {
+			return -1
+		}
+		return r
+	}, filename)
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ImageTypeTestSuite struct{ MainTestSuite }
+
+func (s *ImageTypeTestSuite) TestContentDisposition() {
+	assert.Equal(s.T(), `inline; filename="ipsum.png"`, imageTypePNG.ContentDisposition("ipsum.jpg"))
+	assert.Equal(s.T(), `inline; filename="my image.webp"`, imageTypeWEBP.ContentDisposition("my image"))
+	assert.Equal(s.T(), `inline; filename="image.jpg"`, imageTypeJPEG.ContentDisposition(""))
+	assert.Equal(s.T(), "inline", imageTypeSVG.ContentDisposition("ipsum.svg"))
+}
+
+func (s *ImageTypeTestSuite) TestContentDispositionSanitize() {
+	assert.Equal(s.T(), `inline; filename="ipsum; foo=bar.jpg"`, imageTypeJPEG.ContentDisposition("ipsum\"; foo=\"bar.png"))
+	assert.Equal(s.T(), `inline; filename="ipsumSet-Cookie: a=b.jpg"`, imageTypeJPEG.ContentDisposition("ipsum\r\nSet-Cookie: a=b.png"))
+	assert.Equal(s.T(), `inline; filename="image.jpg"`, imageTypeJPEG.ContentDisposition("\"\".png"))
+}
+
+func (s *ImageTypeTestSuite) TestFilenameFromURL() {
+	assert.Equal(s.T(), "ipsum.jpg", filenameFromURL("http://images.dev/lorem/ipsum.jpg?foo=bar"))
+	assert.Equal(s.T(), "", filenameFromURL("http://images.dev/"))
+}
+
+func TestImageType(t *testing.T) {
+	suite.Run(t, new(ImageTypeTestSuite))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type imageInfo struct {
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	Format         string `json:"format"`
+	Orientation    int    `json:"orientation"`
+	HasAlpha       bool   `json:"has_alpha"`
+	Interpretation string `json:"interpretation"`
+	Frames         int    `json:"frames"`
+}
+
+func getImageInfo(ctx context.Context) (*imageInfo, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	defer vipsCleanup()
+
+	data := getImageData(ctx).Bytes()
+	imgtype := getImageType(ctx)
+
+	pages := 1
+	if vipsSupportAnimation(imgtype) {
+		pages = -1
+	}
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	// libvips loads images lazily, so only the header is read here
+	if err := img.Load(data, imgtype, 1, 1.0, 0, pages); err != nil {
+		return nil, err
+	}
+
+	info := imageInfo{
+		Width:          img.Width(),
+		Height:         img.Height(),
+		Format:         imgtype.String(),
+		Orientation:    img.Orientation(),
+		HasAlpha:       img.HasAlpha(),
+		Interpretation: img.Interpretation(),
+		Frames:         img.FramesCount(),
+	}
+
+	if info.Frames > 1 {
+		info.Height /= info.Frames
+	}
+
+	return &info, nil
+}
+
+func handleInfo(reqID string, rw http.ResponseWriter, r *http.Request) {
+	// Info requests load images with libvips, so they share the concurrency limit with processing
+	processingSem <- struct{}{}
+	defer func() { <-processingSem }()
+
+	ctx, timeoutCancel := startTimer(withRequestID(context.Background(), reqID), time.Duration(conf.WriteTimeout)*time.Second)
+	defer timeoutCancel()
+
+	ctx, err := parseRequestPath(ctx, r, strings.TrimPrefix(requestPath(r), "/info"))
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, downloadcancel, err := downloadImage(ctx)
+	defer downloadcancel()
+	if err != nil {
+		panic(err)
+	}
+
+	checkTimeout(ctx)
+
+	info, err := getImageInfo(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		panic(err)
+	}
+
+	logResponse(reqID, 200, "Respond with info: "+getImageURL(ctx))
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(200)
+	rw.Write(data)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type InfoTestSuite struct{ MainTestSuite }
+
+func (s *InfoTestSuite) getInfo(imgtype imageType, data *bytes.Buffer) *imageInfo {
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imgtype)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+
+	info, err := getImageInfo(ctx)
+	require.Nil(s.T(), err)
+
+	return info
+}
+
+func (s *InfoTestSuite) TestImageInfo() {
+	data, err := ioutil.ReadFile("testdata/cmyk.jpg")
+	require.Nil(s.T(), err)
+
+	info := s.getInfo(imageTypeJPEG, bytes.NewBuffer(data))
+
+	assert.Equal(s.T(), imageInfo{
+		Width:          16,
+		Height:         8,
+		Format:         "jpeg",
+		Orientation:    1,
+		HasAlpha:       false,
+		Interpretation: "cmyk",
+		Frames:         1,
+	}, *info)
+}
+
+func (s *InfoTestSuite) TestImageInfoAnimated() {
+	info := s.getInfo(imageTypeGIF, testAnimatedGif(s.T(), 3))
+
+	assert.Equal(s.T(), 8, info.Width)
+	assert.Equal(s.T(), 8, info.Height)
+	assert.Equal(s.T(), "gif", info.Format)
+	assert.Equal(s.T(), 3, info.Frames)
+}
+
+func (s *InfoTestSuite) TestHandleInfoConcurrency() {
+	conf.AllowInsecure = true
+	conf.Concurrency = 1
+	initProcessingHandler()
+
+	processingSem <- struct{}{}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		url := base64.RawURLEncoding.EncodeToString([]byte("data:image/gif;base64," + base64.StdEncoding.EncodeToString(testAnimatedGif(s.T(), 1).Bytes())))
+
+		rw := httptest.NewRecorder()
+		handleInfo("test", rw, httptest.NewRequest(http.MethodGet, "/info/unsafe/"+url+".gif", nil))
+
+		assert.Equal(s.T(), 200, rw.Code)
+	}()
+
+	select {
+	case <-done:
+		s.T().Fatal("Info request should wait for the processing slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-processingSem
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.T().Fatal("Info request should be handled when the processing slot is released")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	suite.Run(t, new(InfoTestSuite))
+}
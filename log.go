@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"log/syslog"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
 const (
@@ -15,12 +19,51 @@ const (
 	logWarningFmt        = "\033[1;33m[WARNING]\033[0m %s"
 	logWarningSyslogFmt  = "WARNING %s"
 	logFatalSyslogFmt    = "FATAL %s"
+
+	logRequestWarningFmt       = "[%s] \033[1;33m[WARNING]\033[0m %s"
+	logRequestWarningSyslogFmt = "WARNING [%s] %s"
 )
 
+type logFields map[string]interface{}
+
+var logJSONEnabled bool
+
+func initLog() {
+	if conf.LogFormat == "json" {
+		logJSONEnabled = true
+		// Entries have their own time field
+		log.SetFlags(0)
+	}
+}
+
+func logJSON(level, msg string, fields logFields) {
+	entry := logFields{
+		"time":  time.Now().Format(time.RFC3339),
+		"level": level,
+		"msg":   strings.TrimSuffix(msg, "\n"),
+	}
+
+	for k, v := range fields {
+		entry[k] = v
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf(`{"level":"error","msg":%q}`, fmt.Sprintf("Can't marshal log entry: %s", err))
+		return
+	}
+
+	log.Print(string(data))
+}
+
 func logRequest(reqID string, r *http.Request) {
 	path := r.URL.RequestURI()
 
-	log.Printf(logRequestFmt, reqID, r.Method, path)
+	if logJSONEnabled {
+		logJSON("info", "Started", logFields{"request_id": reqID, "method": r.Method, "request_url": path})
+	} else {
+		log.Printf(logRequestFmt, reqID, r.Method, path)
+	}
 
 	if syslogWriter != nil {
 		syslogWriter.Notice(fmt.Sprintf(logRequestSyslogFmt, reqID, r.Method, path))
@@ -28,17 +71,39 @@ func logRequest(reqID string, r *http.Request) {
 }
 
 func logResponse(reqID string, status int, msg string) {
-	var color int
+	logResponseWithFields(reqID, status, msg, nil)
+}
+
+// logResponseWithFields logs the response with additional fields.
+// The fields are logged only when JSON format is used
+func logResponseWithFields(reqID string, status int, msg string, fields logFields) {
+	if logJSONEnabled {
+		level := "info"
+		if status >= 500 {
+			level = "error"
+		} else if status >= 400 {
+			level = "warning"
+		}
 
-	if status >= 500 {
-		color = 31
-	} else if status >= 400 {
-		color = 33
+		entry := logFields{"request_id": reqID, "status": status}
+		for k, v := range fields {
+			entry[k] = v
+		}
+
+		logJSON(level, msg, entry)
 	} else {
-		color = 32
-	}
+		var color int
 
-	log.Printf(logResponseFmt, reqID, color, status, msg)
+		if status >= 500 {
+			color = 31
+		} else if status >= 400 {
+			color = 33
+		} else {
+			color = 32
+		}
+
+		log.Printf(logResponseFmt, reqID, color, status, msg)
+	}
 
 	if syslogWriter != nil {
 		msg := fmt.Sprintf(logResponseSyslogFmt, reqID, status, msg)
@@ -62,7 +127,11 @@ func logResponse(reqID string, status int, msg string) {
 func logNotice(f string, args ...interface{}) {
 	msg := fmt.Sprintf(f, args...)
 
-	log.Print(msg)
+	if logJSONEnabled {
+		logJSON("info", msg, nil)
+	} else {
+		log.Print(msg)
+	}
 
 	if syslogWriter != nil && syslogLevel >= syslog.LOG_NOTICE {
 		syslogWriter.Notice(msg)
@@ -72,13 +141,38 @@ func logNotice(f string, args ...interface{}) {
 func logWarning(f string, args ...interface{}) {
 	msg := fmt.Sprintf(f, args...)
 
-	log.Printf(logWarningFmt, msg)
+	if logJSONEnabled {
+		logJSON("warning", msg, nil)
+	} else {
+		log.Printf(logWarningFmt, msg)
+	}
 
 	if syslogWriter != nil && syslogLevel >= syslog.LOG_WARNING {
 		syslogWriter.Warning(fmt.Sprintf(logWarningSyslogFmt, msg))
 	}
 }
 
+// logRequestWarning logs the warning that relates to the request
+// so it can be matched with the request and response log entries
+func logRequestWarning(reqID string, f string, args ...interface{}) {
+	if len(reqID) == 0 {
+		logWarning(f, args...)
+		return
+	}
+
+	msg := fmt.Sprintf(f, args...)
+
+	if logJSONEnabled {
+		logJSON("warning", msg, logFields{"request_id": reqID})
+	} else {
+		log.Printf(logRequestWarningFmt, reqID, msg)
+	}
+
+	if syslogWriter != nil && syslogLevel >= syslog.LOG_WARNING {
+		syslogWriter.Warning(fmt.Sprintf(logRequestWarningSyslogFmt, reqID, msg))
+	}
+}
+
 func logFatal(f string, args ...interface{}) {
 	msg := fmt.Sprintf(f, args...)
 
@@ -86,5 +180,10 @@ func logFatal(f string, args ...interface{}) {
 		syslogWriter.Crit(fmt.Sprintf(logFatalSyslogFmt, msg))
 	}
 
+	if logJSONEnabled {
+		logJSON("fatal", msg, nil)
+		os.Exit(1)
+	}
+
 	log.Fatal(msg)
 }
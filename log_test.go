@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type LogTestSuite struct {
+	MainTestSuite
+
+	buf *bytes.Buffer
+}
+
+func (s *LogTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	s.buf = new(bytes.Buffer)
+	log.SetOutput(s.buf)
+}
+
+func (s *LogTestSuite) TearDownTest() {
+	s.MainTestSuite.TearDownTest()
+
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+	logJSONEnabled = false
+}
+
+func (s *LogTestSuite) TestPrettyIgnoresFields() {
+	logResponseWithFields("test-id", 200, "Processed", logFields{"output_size": 100})
+
+	assert.Contains(s.T(), s.buf.String(), "[test-id]")
+	assert.Contains(s.T(), s.buf.String(), "Processed")
+	assert.NotContains(s.T(), s.buf.String(), "output_size")
+}
+
+func (s *LogTestSuite) TestJSONResponse() {
+	logJSONEnabled = true
+	log.SetFlags(0)
+
+	logResponseWithFields("test-id", 404, "Not found", logFields{"error": "Not found"})
+
+	var entry map[string]interface{}
+	require.Nil(s.T(), json.Unmarshal(s.buf.Bytes(), &entry))
+
+	assert.Equal(s.T(), "warning", entry["level"])
+	assert.Equal(s.T(), "Not found", entry["msg"])
+	assert.Equal(s.T(), "Not found", entry["error"])
+	assert.Equal(s.T(), "test-id", entry["request_id"])
+	assert.Equal(s.T(), float64(404), entry["status"])
+	assert.NotEmpty(s.T(), entry["time"])
+}
+
+func (s *LogTestSuite) TestPrettyRequestWarning() {
+	logRequestWarning("test-id", "Fallback image is used: %s", "reason")
+
+	assert.Contains(s.T(), s.buf.String(), "[test-id]")
+	assert.Contains(s.T(), s.buf.String(), "[WARNING]")
+	assert.Contains(s.T(), s.buf.String(), "Fallback image is used: reason")
+}
+
+func (s *LogTestSuite) TestJSONRequestWarning() {
+	logJSONEnabled = true
+	log.SetFlags(0)
+
+	logRequestWarning("test-id", "Fallback image is used: %s", "reason")
+
+	var entry map[string]interface{}
+	require.Nil(s.T(), json.Unmarshal(s.buf.Bytes(), &entry))
+
+	assert.Equal(s.T(), "warning", entry["level"])
+	assert.Equal(s.T(), "Fallback image is used: reason", entry["msg"])
+	assert.Equal(s.T(), "test-id", entry["request_id"])
+}
+
+func (s *LogTestSuite) TestJSONRequestWarningWithoutID() {
+	logJSONEnabled = true
+	log.SetFlags(0)
+
+	logRequestWarning("", "Something happened")
+
+	var entry map[string]interface{}
+	require.Nil(s.T(), json.Unmarshal(s.buf.Bytes(), &entry))
+
+	assert.Equal(s.T(), "Something happened", entry["msg"])
+	assert.NotContains(s.T(), entry, "request_id")
+}
+
+func TestLog(t *testing.T) {
+	suite.Run(t, new(LogTestSuite))
+}
@@ -47,6 +47,8 @@ func main() {
 
 	<-stop
 
-	shutdownServer(s)
-	shutdownVips()
+	// libvips can't be shut down while images are being processed
+	if shutdownServer(s) {
+		shutdownVips()
+	}
 }
@@ -4,24 +4,38 @@ import (
 	"context"
 	"math"
 	"runtime"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
 const msgSmartCropNotSupported = "Smart crop is not supported by used version of libvips"
 
-func extractMeta(img *vipsImage) (int, int, int, bool) {
+func extractMeta(img *vipsImage, imgtype imageType) (int, int, int, bool) {
 	width := img.Width()
 	height := img.Height()
 
-	angle := vipsAngleD0
-	flip := false
+	orientation := 1
 
-	orientation := img.Orientation()
+	// libheif applies HEIF transformations on decode while EXIF orientation stays untouched,
+	// so we shouldn't rotate HEIC images once again
+	if imgtype != imageTypeHEIC {
+		orientation = img.Orientation()
+	}
 
 	if orientation >= 5 && orientation <= 8 {
 		width, height = height, width
 	}
+
+	angle, flip := orientationTransform(orientation)
+
+	return width, height, angle, flip
+}
+
+func orientationTransform(orientation int) (int, bool) {
+	angle := vipsAngleD0
+	flip := false
+
 	if orientation == 3 || orientation == 4 {
 		angle = vipsAngleD180
 	}
@@ -35,16 +49,55 @@ func extractMeta(img *vipsImage) (int, int, int, bool) {
 		flip = true
 	}
 
-	return width, height, angle, flip
+	return angle, flip
+}
+
+func vipsAngleFromDegrees(degrees int) int {
+	switch degrees {
+	case 90:
+		return vipsAngleD90
+	case 180:
+		return vipsAngleD180
+	case 270:
+		return vipsAngleD270
+	}
+
+	return vipsAngleD0
+}
+
+// calcScale returns horizontal and vertical scales. They differ only when
+// the force resizing type is used
+// applyMaxSize limits the requested size with the max sizes like fit resizing does.
+// When no size is requested, the image is fit into the max sizes. When only one side
+// is requested, the other one is calculated from it, and its max size crops the overflow
+func applyMaxSize(po *processingOptions) {
+	if po.MaxWidth == 0 && po.MaxHeight == 0 {
+		return
+	}
+
+	if po.Width == 0 && po.Height == 0 {
+		po.Width, po.Height = po.MaxWidth, po.MaxHeight
+		po.Resize = resizeFit
+		return
+	}
+
+	if po.MaxWidth > 0 && po.Width > po.MaxWidth {
+		po.Width = po.MaxWidth
+	}
+	if po.MaxHeight > 0 && po.Height > po.MaxHeight {
+		po.Height = po.MaxHeight
+	}
 }
 
-func calcScale(width, height int, po *processingOptions, imgtype imageType) float64 {
-	var scale float64
+func calcScale(width, height int, po *processingOptions, imgtype imageType) (float64, float64) {
+	var wscale, hscale float64
 
 	srcW, srcH := float64(width), float64(height)
 
-	if (po.Width == 0 || po.Width == width) && (po.Height == 0 || po.Height == height) {
-		scale = 1
+	if po.Scale > 0 {
+		wscale, hscale = po.Scale, po.Scale
+	} else if (po.Width == 0 || po.Width == width) && (po.Height == 0 || po.Height == height) {
+		wscale, hscale = 1, 1
 	} else {
 		wr := float64(po.Width) / srcW
 		hr := float64(po.Height) / srcH
@@ -63,35 +116,52 @@ func calcScale(width, height int, po *processingOptions, imgtype imageType) floa
 		}
 
 		if po.Width == 0 {
-			scale = hr
+			wscale, hscale = hr, hr
 		} else if po.Height == 0 {
-			scale = wr
+			wscale, hscale = wr, wr
 		} else if rt == resizeFit {
-			scale = math.Min(wr, hr)
+			wscale = math.Min(wr, hr)
+			hscale = wscale
+		} else if rt == resizeForce {
+			wscale, hscale = wr, hr
 		} else {
-			scale = math.Max(wr, hr)
+			// Both fill and min make the image cover the requested area
+			wscale = math.Max(wr, hr)
+			hscale = wscale
 		}
 	}
 
-	if !po.Enlarge && scale > 1 && imgtype != imageTypeSVG {
-		scale = 1
+	// Enlarge allows scaling the image content up. Extend never affects the scale
+	// since it only pads the canvas after resizing. fill-down never scales up
+	if (!po.Enlarge || po.Resize == resizeFillDown) && !imgtype.IsVector() {
+		wscale = math.Min(wscale, 1)
+		hscale = math.Min(hscale, 1)
 	}
 
-	scale = scale * po.Dpr
+	wscale = wscale * po.Dpr
+	hscale = hscale * po.Dpr
+
+	keepAspect := po.Resize != resizeForce
 
-	if srcW*scale < 1 {
-		scale = 1 / srcW
+	if srcW*wscale < 1 {
+		wscale = 1 / srcW
+		if keepAspect {
+			hscale = wscale
+		}
 	}
 
-	if srcH*scale < 1 {
-		scale = 1 / srcH
+	if srcH*hscale < 1 {
+		hscale = 1 / srcH
+		if keepAspect {
+			wscale = hscale
+		}
 	}
 
-	return scale
+	return wscale, hscale
 }
 
 func canScaleOnLoad(imgtype imageType, scale float64) bool {
-	if imgtype == imageTypeSVG {
+	if imgtype.IsVector() {
 		return true
 	}
 
@@ -102,6 +172,103 @@ func canScaleOnLoad(imgtype imageType, scale float64) bool {
 	return imgtype == imageTypeJPEG || imgtype == imageTypeWEBP
 }
 
+// getResizeKernel returns the kernel to resize the image with.
+// Without antialiasing, pixels are neither blended nor smoothed, so nearest neighbour is used
+func getResizeKernel(po *processingOptions) resizeKernel {
+	if po.NoAntialias {
+		return resizeKernelNearest
+	}
+	return po.Kernel
+}
+
+// canUseThumbnail checks if vips_thumbnail can replace scale-on-load and resizing.
+// We use it only for downscaling of the whole image when nothing has to be done before resizing
+func canUseThumbnail(po *processingOptions, imgtype imageType, wscale, hscale float64) bool {
+	if !vipsSupportThumbnail || conf.DisableShrinkOnLoad {
+		return false
+	}
+
+	if imgtype != imageTypeJPEG && imgtype != imageTypePNG && imgtype != imageTypeWEBP {
+		return false
+	}
+
+	if po.Resize != resizeFit && po.Resize != resizeFill && po.Resize != resizeMin && po.Resize != resizeFillDown {
+		return false
+	}
+
+	if po.Crop.Width > 0 || po.Crop.Height > 0 || po.Rotate >= 90 {
+		return false
+	}
+
+	// vips_thumbnail always uses lanczos3
+	if getResizeKernel(po) != resizeKernelLanczos3 {
+		return false
+	}
+
+	return wscale <= 1 && hscale <= 1 && (wscale < 1 || hscale < 1)
+}
+
+// canPassthrough checks if processing wouldn't change the image,
+// so the source data can be sent as is
+func canPassthrough(img *vipsImage, data []byte, po *processingOptions, imgtype imageType) bool {
+	if po.Format != imgtype || !img.IsSRGB() {
+		return false
+	}
+
+	// The source data keeps its own encoding settings and ICC profile
+	if po.SaveOptionsSet || vipsConf.EmbedSRGBProfile != 0 {
+		return false
+	}
+
+	// Only the first frame is loaded unless we process animation,
+	// but the source data contains all of them
+	if nPages, err := img.GetInt("n-pages"); err == nil && nPages > 1 {
+		return false
+	}
+
+	srcWidth, srcHeight, angle, flip := extractMeta(img, imgtype)
+	if angle != vipsAngleD0 || flip {
+		return false
+	}
+
+	if wscale, hscale := calcScale(srcWidth, srcHeight, po, imgtype); wscale != 1 || hscale != 1 {
+		return false
+	}
+
+	dprWidth := roundToInt(float64(po.Width) * po.Dpr)
+	dprHeight := roundToInt(float64(po.Height) * po.Dpr)
+
+	if (dprWidth != 0 && dprWidth != srcWidth) || (dprHeight != 0 && dprHeight != srcHeight) {
+		return false
+	}
+
+	dprMaxWidth := roundToInt(float64(po.MaxWidth) * po.Dpr)
+	dprMaxHeight := roundToInt(float64(po.MaxHeight) * po.Dpr)
+
+	if (dprMaxWidth != 0 && srcWidth > dprMaxWidth) || (dprMaxHeight != 0 && srcHeight > dprMaxHeight) {
+		return false
+	}
+
+	if po.MaxBytes > 0 && len(data) > po.MaxBytes {
+		return false
+	}
+
+	if po.StripMetadata && (img.HasField("exif-data") || img.HasField("xmp-data") || img.HasField("iptc-data")) {
+		return false
+	}
+
+	return po.Crop.Width == 0 && po.Crop.Height == 0 &&
+		po.AspectRatio.Width == 0 &&
+		!po.Trim.Enabled &&
+		po.Rotate == 0 && !po.Flip && !po.Flop &&
+		!po.Grayscale && po.Sepia == 0 && !po.Invert && !po.Flatten &&
+		po.Pixelate == 0 && po.Blur == 0 && po.Sharpen == 0 &&
+		po.Brightness == 0 && po.Contrast == 1 && po.Saturation == 1 &&
+		!po.Watermark.Enabled &&
+		po.Border.Width == 0 && po.Padding == (paddingOptions{}) && po.CornerRadius == 0 &&
+		!po.ExtractFrame
+}
+
 func calcJpegShink(scale float64, imgtype imageType) int {
 	shrink := int(1.0 / scale)
 
@@ -119,8 +286,8 @@ func calcJpegShink(scale float64, imgtype imageType) int {
 
 func calcCrop(width, height, cropWidth, cropHeight int, gravity *gravityOptions) (left, top int) {
 	if gravity.Type == gravityFocusPoint {
-		pointX := int(float64(width) * gravity.X)
-		pointY := int(float64(height) * gravity.Y)
+		pointX := roundToInt(float64(width) * gravity.X)
+		pointY := roundToInt(float64(height) * gravity.Y)
 
 		left = maxInt(0, minInt(pointX-cropWidth/2, width-cropWidth))
 		top = maxInt(0, minInt(pointY-cropHeight/2, height-cropHeight))
@@ -128,7 +295,8 @@ func calcCrop(width, height, cropWidth, cropHeight int, gravity *gravityOptions)
 		return
 	}
 
-	offX, offY := int(gravity.X), int(gravity.Y)
+	// Offsets may be fractional after scaling, so they're rounded like the sizes
+	offX, offY := roundToInt(gravity.X), roundToInt(gravity.Y)
 
 	left = (width-cropWidth+1)/2 + offX
 	top = (height-cropHeight+1)/2 + offY
@@ -155,7 +323,7 @@ func calcCrop(width, height, cropWidth, cropHeight int, gravity *gravityOptions)
 	return
 }
 
-func cropImage(img *vipsImage, cropWidth, cropHeight int, gravity *gravityOptions) error {
+func cropImage(ctx context.Context, img *vipsImage, cropWidth, cropHeight int, gravity *gravityOptions) error {
 	if cropWidth == 0 && cropHeight == 0 {
 		return nil
 	}
@@ -182,9 +350,11 @@ func cropImage(img *vipsImage, cropWidth, cropHeight int, gravity *gravityOption
 		if err := img.CopyMemory(); err != nil {
 			return err
 		}
-		if err := img.SmartCrop(cropWidth, cropHeight); err != nil {
+		left, top, err := img.SmartCrop(cropWidth, cropHeight, gravity.Strategy)
+		if err != nil {
 			return err
 		}
+		setCropBox(ctx, left, top, cropWidth, cropHeight)
 		// Applying additional modifications after smart crop causes SIGSEGV on Alpine
 		// so we have to copy memory after it
 		return img.CopyMemory()
@@ -194,6 +364,21 @@ func cropImage(img *vipsImage, cropWidth, cropHeight int, gravity *gravityOption
 	return img.Crop(left, top, cropWidth, cropHeight)
 }
 
+// aspectRatioSize returns the size of the area with the requested aspect ratio
+// that fits into the width x height area or contains it when padding is used
+func aspectRatioSize(width, height int, ar aspectRatioOptions) (int, int) {
+	ratio := ar.Width / ar.Height
+
+	arWidth := maxInt(roundToInt(float64(height)*ratio), 1)
+	arHeight := maxInt(roundToInt(float64(width)/ratio), 1)
+
+	if (arWidth < width) != ar.Pad {
+		return arWidth, height
+	}
+
+	return width, arHeight
+}
+
 func scaleSize(size int, scale float64) int {
 	if size == 0 {
 		return 0
@@ -202,10 +387,29 @@ func scaleSize(size int, scale float64) int {
 	return roundToInt(float64(size) * scale)
 }
 
-func transformImage(ctx context.Context, img *vipsImage, data []byte, po *processingOptions, imgtype imageType) error {
+// reloadImage loads the image with scale-on-load from the data or the stream
+// it was loaded from. The stream can be reloaded only while it's not decoded
+func reloadImage(img *vipsImage, data []byte, stream *imageStream, imgtype imageType, shrink int, scale float64, page int) error {
+	if stream != nil {
+		return img.LoadStream(stream, imgtype, shrink, scale)
+	}
+
+	return img.Load(data, imgtype, shrink, scale, page, 1)
+}
+
+func transformImage(ctx context.Context, img *vipsImage, data []byte, stream *imageStream, po *processingOptions, imgtype imageType) error {
 	var err error
 
-	srcWidth, srcHeight, angle, flip := extractMeta(img)
+	srcWidth, srcHeight, angle, flip := extractMeta(img, imgtype)
+
+	// Requested rotation is split into the right-angle part that is applied
+	// right after EXIF orientation and the rest that is applied after cropping
+	rightAngleRotate := po.Rotate - po.Rotate%90
+	freeRotate := po.Rotate % 90
+
+	if rightAngleRotate == 90 || rightAngleRotate == 270 {
+		srcWidth, srcHeight = srcHeight, srcWidth
+	}
 
 	cropWidth, cropHeight := po.Crop.Width, po.Crop.Height
 
@@ -223,43 +427,83 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 		heightToScale = minInt(cropHeight, srcHeight)
 	}
 
-	scale := calcScale(widthToScale, heightToScale, po, imgtype)
+	if po.AspectRatio.Width > 0 {
+		widthToScale, heightToScale = aspectRatioSize(widthToScale, heightToScale, po.AspectRatio)
+
+		// Without padding, the area is cropped to the aspect ratio
+		if !po.AspectRatio.Pad {
+			cropWidth, cropHeight = widthToScale, heightToScale
+		}
+	}
+
+	wscale, hscale := calcScale(widthToScale, heightToScale, po, imgtype)
+
+	// The size of the area padded to the aspect ratio after scaling
+	var padWidth, padHeight int
+	if po.AspectRatio.Width > 0 && po.AspectRatio.Pad {
+		padWidth, padHeight = scaleSize(widthToScale, wscale), scaleSize(heightToScale, hscale)
+	}
 
-	cropWidth = scaleSize(cropWidth, scale)
-	cropHeight = scaleSize(cropHeight, scale)
-	cropGravity.X = cropGravity.X * scale
-	cropGravity.Y = cropGravity.Y * scale
+	cropWidth = scaleSize(cropWidth, wscale)
+	cropHeight = scaleSize(cropHeight, hscale)
+	cropGravity.X = cropGravity.X * wscale
+	cropGravity.Y = cropGravity.Y * hscale
 
-	if scale != 1 && data != nil && canScaleOnLoad(imgtype, scale) {
-		if imgtype == imageTypeWEBP || imgtype == imageTypeSVG {
+	// We can scale on load only proportionally, so we use the smaller scale
+	// and do the rest with resize
+	scale := math.Min(wscale, hscale)
+
+	// vips_thumbnail doesn't know about EXIF flip, so we don't use it for flipped or rotated images
+	useThumbnail := data != nil && angle == vipsAngleD0 && !flip && canUseThumbnail(po, imgtype, wscale, hscale)
+
+	stopResizeServerTiming := startServerTimingStage(ctx, "resize")
+
+	if useThumbnail {
+		if err = img.Thumbnail(data, scaleSize(srcWidth, wscale), scaleSize(srcHeight, hscale), conf.UseLinearColorspace); err != nil {
+			return err
+		}
+
+		// The image is resized and converted to sRGB already
+		wscale, hscale = 1, 1
+	} else if scale != 1 && (data != nil || stream != nil) && canScaleOnLoad(imgtype, scale) && (!po.NoAntialias || imgtype.IsVector()) {
+		if imgtype == imageTypeWEBP || imgtype.IsVector() {
 			// Do some scale-on-load
-			if err := img.Load(data, imgtype, 1, scale, 1); err != nil {
+			if err := reloadImage(img, data, stream, imgtype, 1, scale, po.Page); err != nil {
 				return err
 			}
 		} else if imgtype == imageTypeJPEG {
 			// Do some shrink-on-load
 			if shrink := calcJpegShink(scale, imgtype); shrink != 1 {
-				if err := img.Load(data, imgtype, shrink, 1.0, 1); err != nil {
+				if err := reloadImage(img, data, stream, imgtype, shrink, 1.0, 0); err != nil {
 					return err
 				}
 			}
 		}
 
 		// Update scale after scale-on-load
-		newWidth, newHeight, _, _ := extractMeta(img)
+		newWidth, newHeight, _, _ := extractMeta(img, imgtype)
+		if rightAngleRotate == 90 || rightAngleRotate == 270 {
+			newWidth, newHeight = newHeight, newWidth
+		}
 
 		widthToScale = scaleSize(widthToScale, float64(newWidth)/float64(srcWidth))
 		heightToScale = scaleSize(heightToScale, float64(newHeight)/float64(srcHeight))
 
-		scale = calcScale(widthToScale, heightToScale, po, imgtype)
+		wscale, hscale = calcScale(widthToScale, heightToScale, po, imgtype)
 	}
 
 	if err = img.Rad2Float(); err != nil {
 		return err
 	}
 
-	iccImported := false
-	convertToLinear := conf.UseLinearColorspace && (scale != 1 || po.Dpr != 1)
+	// 16-bit images are narrowed before colour management and resizing
+	// since premultiplication expects 8-bit alpha
+	if err = img.To8Bit(); err != nil {
+		return err
+	}
+
+	iccImported := useThumbnail
+	convertToLinear := !useThumbnail && conf.UseLinearColorspace && (wscale != 1 || hscale != 1 || po.Dpr != 1)
 
 	if convertToLinear || !img.IsSRGB() {
 		if err = img.ImportColourProfile(true); err != nil {
@@ -280,15 +524,17 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 
 	hasAlpha := img.HasAlpha()
 
-	if scale != 1 {
-		if err = img.Resize(scale, hasAlpha); err != nil {
+	if wscale != 1 || hscale != 1 {
+		if err = img.Resize(wscale, hscale, hasAlpha, getResizeKernel(po)); err != nil {
 			return err
 		}
 	}
 
+	stopResizeServerTiming()
+
 	checkTimeout(ctx)
 
-	if angle != vipsAngleD0 || flip {
+	if angle != vipsAngleD0 || flip || rightAngleRotate != 0 || po.Flip || po.Flop {
 		if err = img.CopyMemory(); err != nil {
 			return err
 		}
@@ -300,28 +546,97 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 		}
 
 		if flip {
-			if err = img.Flip(); err != nil {
+			if err = img.Flip(vipsDirectionHorizontal); err != nil {
+				return err
+			}
+		}
+
+		// Requested rotation and flips are applied to the already oriented image
+		if rightAngleRotate != 0 {
+			if err = img.Rotate(vipsAngleFromDegrees(rightAngleRotate)); err != nil {
+				return err
+			}
+		}
+
+		if po.Flop {
+			if err = img.Flip(vipsDirectionHorizontal); err != nil {
 				return err
 			}
 		}
+
+		if po.Flip {
+			if err = img.Flip(vipsDirectionVertical); err != nil {
+				return err
+			}
+		}
+
+		// The image is oriented already, so viewers shouldn't orient it once again
+		if angle != vipsAngleD0 || flip {
+			img.RemoveOrientation()
+		}
 	}
 
 	checkTimeout(ctx)
 
 	dprWidth := roundToInt(float64(po.Width) * po.Dpr)
 	dprHeight := roundToInt(float64(po.Height) * po.Dpr)
+	dprMaxWidth := roundToInt(float64(po.MaxWidth) * po.Dpr)
+	dprMaxHeight := roundToInt(float64(po.MaxHeight) * po.Dpr)
+
+	// The image covers the requested area with min resizing type, so it shouldn't be cropped to it
+	resultWidth, resultHeight := dprWidth, dprHeight
+	if po.Resize == resizeMin {
+		resultWidth, resultHeight = 0, 0
+	}
+
+	// The overflow of the side that is calculated from the aspect ratio is cropped
+	if dprMaxWidth > 0 && resultWidth == 0 {
+		resultWidth = dprMaxWidth
+	}
+	if dprMaxHeight > 0 && resultHeight == 0 {
+		resultHeight = dprMaxHeight
+	}
+
+	stopCropServerTiming := startServerTimingStage(ctx, "crop")
+
+	if padWidth > 0 {
+		// The padding should be added between cropping and cropping to the result size,
+		// so they can't be combined
+		if err = cropImage(ctx, img, cropWidth, cropHeight, &cropGravity); err != nil {
+			return err
+		}
+
+		if po.TransparentBackground {
+			if err = img.EnsureAlpha(); err != nil {
+				return err
+			}
+		}
+
+		padWidth, padHeight = maxInt(padWidth, img.Width()), maxInt(padHeight, img.Height())
+
+		// Padded area can be much bigger than the image when the aspect ratio is extreme
+		if err = checkResultDimensions(padWidth, padHeight); err != nil {
+			return err
+		}
+
+		if err = img.Embed(po.Gravity.Type, padWidth, padHeight, 0, 0, po.Background); err != nil {
+			return err
+		}
 
-	if cropGravity.Type == po.Gravity.Type && cropGravity.Type != gravityFocusPoint {
+		if err = cropImage(ctx, img, resultWidth, resultHeight, &po.Gravity); err != nil {
+			return err
+		}
+	} else if cropGravity.Type == po.Gravity.Type && cropGravity.Type != gravityFocusPoint {
 		if cropWidth == 0 {
-			cropWidth = dprWidth
-		} else if dprWidth > 0 {
-			cropWidth = minInt(cropWidth, dprWidth)
+			cropWidth = resultWidth
+		} else if resultWidth > 0 {
+			cropWidth = minInt(cropWidth, resultWidth)
 		}
 
 		if cropHeight == 0 {
-			cropHeight = dprHeight
-		} else if dprHeight > 0 {
-			cropHeight = minInt(cropHeight, dprHeight)
+			cropHeight = resultHeight
+		} else if resultHeight > 0 {
+			cropHeight = minInt(cropHeight, resultHeight)
 		}
 
 		sumGravity := gravityOptions{
@@ -330,20 +645,45 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 			Y:    cropGravity.Y + po.Gravity.Y,
 		}
 
-		if err = cropImage(img, cropWidth, cropHeight, &sumGravity); err != nil {
+		if err = cropImage(ctx, img, cropWidth, cropHeight, &sumGravity); err != nil {
 			return err
 		}
 	} else {
-		if err = cropImage(img, cropWidth, cropHeight, &cropGravity); err != nil {
+		if err = cropImage(ctx, img, cropWidth, cropHeight, &cropGravity); err != nil {
 			return err
 		}
-		if err = cropImage(img, dprWidth, dprHeight, &po.Gravity); err != nil {
+		if err = cropImage(ctx, img, resultWidth, resultHeight, &po.Gravity); err != nil {
 			return err
 		}
 	}
 
+	stopCropServerTiming()
+
 	checkTimeout(ctx)
 
+	if po.Pixelate > 0 {
+		pixels := roundToInt(float64(po.Pixelate) * po.Dpr)
+		pixels = minInt(pixels, minInt(img.Width(), img.Height()))
+
+		if pixels > 1 {
+			if err = img.Pixelate(pixels); err != nil {
+				return err
+			}
+		}
+	}
+
+	if freeRotate != 0 {
+		if po.TransparentBackground {
+			if err = img.EnsureAlpha(); err != nil {
+				return err
+			}
+		}
+
+		if err = img.RotateArbitrary(float64(freeRotate), po.Background, po.NoAntialias); err != nil {
+			return err
+		}
+	}
+
 	if !iccImported {
 		if err = img.ImportColourProfile(false); err != nil {
 			return err
@@ -354,12 +694,18 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 		return err
 	}
 
-	if hasAlpha && (po.Flatten || po.Format == imageTypeJPEG) {
+	if hasAlpha && (po.Flatten || !po.Format.SupportsAlpha()) {
 		if err = img.Flatten(po.Background); err != nil {
 			return err
 		}
 	}
 
+	if po.Brightness != 0 || po.Contrast != 1 || po.Saturation != 1 {
+		if err = img.Adjust(po.Brightness, po.Contrast, po.Saturation); err != nil {
+			return err
+		}
+	}
+
 	if po.Blur > 0 {
 		if err = img.Blur(po.Blur); err != nil {
 			return err
@@ -372,8 +718,44 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 		}
 	}
 
-	if po.Extend && (po.Width > img.Width() || po.Height > img.Height()) {
-		if err = img.Embed(gravityCenter, po.Width, po.Height, 0, 0, po.Background); err != nil {
+	// The image is smaller than requested when it can't be enlarged,
+	// so we pad it with the background to the requested size.
+	// fill-down always fills the requested area
+	if (po.Extend || po.Resize == resizeFillDown) && (dprWidth > img.Width() || dprHeight > img.Height()) {
+		extendWidth := maxInt(dprWidth, img.Width())
+		extendHeight := maxInt(dprHeight, img.Height())
+
+		// Embed fills the area with transparency when the image has alpha
+		if po.TransparentBackground {
+			if err = img.EnsureAlpha(); err != nil {
+				return err
+			}
+		}
+
+		if err = img.Embed(gravityCenter, extendWidth, extendHeight, 0, 0, po.Background); err != nil {
+			return err
+		}
+	}
+
+	if po.Grayscale {
+		// vips_colourspace keeps alpha as is, so only colour channels are desaturated.
+		// Final conversion to sRGB keeps the image grey while allowing any output format
+		if err = img.Grayscale(); err != nil {
+			return err
+		}
+	}
+
+	// Sepia goes after grayscale, so combining them produces the classic tone
+	if po.Sepia > 0 {
+		if err = img.Sepia(po.Sepia); err != nil {
+			return err
+		}
+	}
+
+	if po.Invert {
+		// The image is 8-bit here, so vips_invert calculates 255 - value.
+		// Alpha is left untouched
+		if err = img.Invert(); err != nil {
 			return err
 		}
 	}
@@ -381,12 +763,73 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 	checkTimeout(ctx)
 
 	if po.Watermark.Enabled {
-		if err = img.ApplyWatermark(&po.Watermark); err != nil {
+		if err = img.ApplyWatermark(&po.Watermark, po.Dpr); err != nil {
 			return err
 		}
 	}
 
-	return img.RgbColourspace()
+	// Padding is added in the resulting pixels, so it's not affected by resizing and cropping
+	if po.Padding != (paddingOptions{}) {
+		if po.TransparentBackground {
+			if err = img.EnsureAlpha(); err != nil {
+				return err
+			}
+		}
+
+		left := roundToInt(float64(po.Padding.Left) * po.Dpr)
+		top := roundToInt(float64(po.Padding.Top) * po.Dpr)
+		width := img.Width() + left + roundToInt(float64(po.Padding.Right)*po.Dpr)
+		height := img.Height() + top + roundToInt(float64(po.Padding.Bottom)*po.Dpr)
+
+		// Padding can make the image much bigger than the requested size
+		if err = checkResultDimensions(width, height); err != nil {
+			return err
+		}
+
+		if err = img.Embed(gravityNorthWest, width, height, left, top, po.Background); err != nil {
+			return err
+		}
+	}
+
+	if po.Border.Width > 0 {
+		if err = img.Border(roundToInt(float64(po.Border.Width)*po.Dpr), po.Border.Color); err != nil {
+			return err
+		}
+	}
+
+	if po.CornerRadius > 0 {
+		radius := roundToInt(float64(po.CornerRadius) * po.Dpr)
+		radius = minInt(radius, minInt(img.Width(), img.Height())/2)
+
+		if radius > 0 {
+			if err = img.RoundCorners(radius); err != nil {
+				return err
+			}
+
+			if po.Flatten {
+				if err = img.Flatten(po.Background); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// The resulting size depends on the source image size, so it can be checked only here.
+	// Most of libvips operations are lazy, so the resulting pixels are not allocated yet
+	if err = checkResultDimensions(img.Width(), img.Height()); err != nil {
+		return err
+	}
+
+	if err = img.RgbColourspace(); err != nil {
+		return err
+	}
+
+	if vipsConf.EmbedSRGBProfile != 0 {
+		// Replace the source profile since the image is in sRGB now
+		return img.EmbedSRGBProfile()
+	}
+
+	return nil
 }
 
 func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *processingOptions, imgtype imageType) error {
@@ -397,7 +840,14 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 		return err
 	}
 
-	framesCount := minInt(img.Height()/frameHeight, conf.MaxAnimationFrames)
+	framesCount := img.Height() / frameHeight
+
+	if framesCount > conf.MaxAnimationFrames {
+		if conf.RejectExceededAnimationFrames {
+			return errSourceTooManyFrames
+		}
+		framesCount = conf.MaxAnimationFrames
+	}
 
 	// Double check dimensions because animated image has many frames
 	if err := checkDimensions(imgWidth, frameHeight*framesCount); err != nil {
@@ -409,14 +859,14 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 		scale := 1.0
 
 		// Don't do scale on load if we need to crop
-		if po.Crop.Width == 0 && po.Crop.Height == 0 {
-			scale = calcScale(imgWidth, frameHeight, po, imgtype)
+		if po.Crop.Width == 0 && po.Crop.Height == 0 && po.AspectRatio.Width == 0 {
+			scale = math.Min(calcScale(imgWidth, frameHeight, po, imgtype))
 		}
 
 		if nPages > framesCount || canScaleOnLoad(imgtype, scale) {
 			logNotice("Animated scale on load")
 			// Do some scale-on-load and load only the needed frames
-			if err := img.Load(data, imgtype, 1, scale, framesCount); err != nil {
+			if err := img.Load(data, imgtype, 1, scale, 0, framesCount); err != nil {
 				return err
 			}
 		}
@@ -439,6 +889,17 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 		return err
 	}
 
+	// libvips 8.9+ stores delays of every frame separately
+	var frameDelays []int
+	if img.HasField("delay") {
+		if frameDelays, err = img.GetIntSlice("delay"); err != nil {
+			return err
+		}
+		if len(frameDelays) > framesCount {
+			frameDelays = frameDelays[:framesCount]
+		}
+	}
+
 	frames := make([]*vipsImage, framesCount)
 	defer func() {
 		for _, frame := range frames {
@@ -451,19 +912,16 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 	for i := 0; i < framesCount; i++ {
 		ind := i
 		errg.Go(func() error {
+			// Frame should be stored before any error can happen
+			// so the deferred cleanup frees it
 			frame := new(vipsImage)
+			frames[ind] = frame
 
 			if err := img.Extract(frame, 0, ind*frameHeight, imgWidth, frameHeight); err != nil {
 				return err
 			}
 
-			if err := transformImage(ctx, frame, nil, po, imgtype); err != nil {
-				return err
-			}
-
-			frames[ind] = frame
-
-			return nil
+			return transformImage(ctx, frame, nil, nil, po, imgtype)
 		})
 	}
 
@@ -482,9 +940,50 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 	img.SetInt("gif-loop", loop)
 	img.SetInt("n-pages", framesCount)
 
+	if len(frameDelays) > 0 {
+		img.SetIntSlice("delay", frameDelays)
+	}
+
 	return nil
 }
 
+// checkLoadedDimensions checks the dimensions of a single frame of the loaded image.
+// All frames of animated images are checked in transformAnimated
+func checkLoadedDimensions(img *vipsImage) error {
+	height := img.Height()
+
+	if img.HasField("page-height") {
+		if frameHeight, err := img.GetInt("page-height"); err == nil && frameHeight > 0 {
+			height = minInt(height, frameHeight)
+		}
+	}
+
+	return checkDimensions(img.Width(), height)
+}
+
+// formatQuality returns the default quality of the format.
+// When the format-specific quality is not set, IMGPROXY_QUALITY is used
+func formatQuality(format imageType) int {
+	var q int
+
+	switch format {
+	case imageTypeJPEG:
+		q = conf.JpegQuality
+	case imageTypeWEBP:
+		q = conf.WebpQuality
+	case imageTypeAVIF:
+		q = conf.AvifQuality
+	case imageTypeHEIC:
+		q = conf.HeicQuality
+	}
+
+	if q > 0 {
+		return q
+	}
+
+	return conf.Quality
+}
+
 func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -504,31 +1003,57 @@ func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 	data := getImageData(ctx).Bytes()
 	imgtype := getImageType(ctx)
 
+	if len(data) == 0 {
+		return nil, func() {}, errSourceImageEmpty
+	}
+
+	if !vipsTypeSupportLoad[imgtype] {
+		return nil, func() {}, newSourceImageTypeError(data)
+	}
+
 	if po.Format == imageTypeUnknown {
-		if po.PreferWebP && vipsTypeSupportSave[imageTypeWEBP] {
+		if po.PreferAvif && vipsTypeSupportSave[imageTypeAVIF] {
+			po.Format = imageTypeAVIF
+		} else if po.PreferWebP && vipsTypeSupportSave[imageTypeWEBP] {
 			po.Format = imageTypeWEBP
-		} else if vipsTypeSupportSave[imgtype] && imgtype != imageTypeHEIC {
+		} else if vipsTypeSupportSave[imgtype] && imgtype != imageTypeHEIC && imgtype != imageTypeTIFF {
 			po.Format = imgtype
 		} else {
 			po.Format = imageTypeJPEG
 		}
+	} else if po.EnforceAvif && vipsTypeSupportSave[imageTypeAVIF] {
+		po.Format = imageTypeAVIF
 	} else if po.EnforceWebP && vipsTypeSupportSave[imageTypeWEBP] {
 		po.Format = imageTypeWEBP
 	}
 
+	// Rounded corners require alpha channel unless they're filled with the background
+	if (po.TransparentBackground || (po.CornerRadius > 0 && !po.Flatten)) && !po.Format.SupportsAlpha() {
+		if po.PreferWebP && vipsTypeSupportSave[imageTypeWEBP] {
+			po.Format = imageTypeWEBP
+		} else {
+			po.Format = imageTypePNG
+		}
+	}
+
+	// Quality that is not set with the option depends on the resulting format
+	if po.Quality == 0 {
+		po.Quality = formatQuality(po.Format)
+	}
+
 	if !vipsSupportSmartcrop {
 		if po.Gravity.Type == gravitySmart {
-			logWarning(msgSmartCropNotSupported)
+			logRequestWarning(getRequestID(ctx), msgSmartCropNotSupported)
 			po.Gravity.Type = gravityCenter
 		}
 		if po.Crop.Gravity.Type == gravitySmart {
-			logWarning(msgSmartCropNotSupported)
+			logRequestWarning(getRequestID(ctx), msgSmartCropNotSupported)
 			po.Crop.Gravity.Type = gravityCenter
 		}
 	}
 
 	if po.Resize == resizeCrop {
-		logWarning("`crop` resizing type is deprecated and will be removed in future versions. Use `crop` processing option instead")
+		logRequestWarning(getRequestID(ctx), "`crop` resizing type is deprecated and will be removed in future versions. Use `crop` processing option instead")
 
 		po.Crop.Width, po.Crop.Height = po.Width, po.Height
 
@@ -536,26 +1061,103 @@ func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 		po.Width, po.Height = 0, 0
 	}
 
-	animationSupport := conf.MaxAnimationFrames > 1 && vipsSupportAnimation(imgtype) && vipsSupportAnimation(po.Format)
+	if po.Scale > 0 {
+		// Scale factor replaces the resulting size
+		po.Width, po.Height = 0, 0
+	}
+
+	applyMaxSize(po)
+
+	extractFrame := po.ExtractFrame && vipsSupportAnimation(imgtype)
+	animationSupport := !extractFrame && conf.MaxAnimationFrames > 1 && vipsSupportAnimation(imgtype) && vipsSupportAnimation(po.Format)
 
 	pages := 1
-	if animationSupport {
+	if animationSupport || extractFrame {
 		pages = -1
 	}
 
+	stream := getImageStream(ctx)
+
+	// Animated images are loaded frame by frame, so they can't be decoded from the stream
+	if stream != nil && pages != 1 {
+		if err := stream.Buffer(); err != nil {
+			return nil, func() {}, err
+		}
+
+		data = getImageData(ctx).Bytes()
+		stream = nil
+	}
+
+	// The streamed image isn't downloaded yet, so it can be loaded only from the stream
+	if stream != nil {
+		data = nil
+	}
+
 	img := new(vipsImage)
 	defer img.Clear()
 
-	if err := img.Load(data, imgtype, 1, 1.0, pages); err != nil {
+	stopLoadTimer := startPrometheusProcessingStage("load")
+	stopLoadServerTiming := startServerTimingStage(ctx, "load")
+
+	if stream != nil {
+		if err := img.LoadStream(stream, imgtype, 1, 1.0); err != nil {
+			return nil, func() {}, err
+		}
+	} else if err := img.Load(data, imgtype, 1, 1.0, po.Page, pages); err != nil {
+		return nil, func() {}, err
+	}
+
+	stopLoadServerTiming()
+	stopLoadTimer()
+
+	checkTimeout(ctx)
+
+	// Libvips loads only the image header at this point, so we can reject images
+	// that would take too much memory before decoding them. This also covers images
+	// which dimensions can't be checked while downloading, like SVG
+	if err := checkLoadedDimensions(img); err != nil {
 		return nil, func() {}, err
 	}
 
+	// Libvips loads only the image header at this point,
+	// so we can check it without decoding the image.
+	// Streamed image isn't downloaded yet, so it can't be passed through
+	if data != nil && canPassthrough(img, data, po, imgtype) {
+		return data, func() {}, nil
+	}
+
+	stopTransformTimer := startPrometheusProcessingStage("transform")
+
+	if extractFrame && img.IsAnimated() {
+		if err := img.ExtractFrame(po.Frame); err != nil {
+			return nil, func() {}, err
+		}
+
+		// Source data contains all the frames, so we can't use it for scale-on-load
+		data = nil
+	}
+
 	if animationSupport && img.IsAnimated() {
 		if err := transformAnimated(ctx, img, data, po, imgtype); err != nil {
 			return nil, func() {}, err
 		}
 	} else {
-		if err := transformImage(ctx, img, data, po, imgtype); err != nil {
+		if po.Trim.Enabled {
+			trimColor := rgbColor{255, 255, 255}
+			if po.Trim.HasColor {
+				trimColor = po.Trim.Color
+			}
+
+			if err := img.Trim(po.Trim.Threshold, trimColor, po.Trim.HasColor); err != nil {
+				return nil, func() {}, err
+			}
+
+			// Source data doesn't match the trimmed image, so we can't use it for scale-on-load
+			data = nil
+			stream = nil
+		}
+
+		if err := transformImage(ctx, img, data, stream, po, imgtype); err != nil {
 			return nil, func() {}, err
 		}
 	}
@@ -569,5 +1171,156 @@ func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 		checkTimeout(ctx)
 	}
 
-	return img.Save(po.Format, po.Quality)
+	stopTransformTimer()
+
+	defer startPrometheusProcessingStage("save")()
+	defer startServerTimingStage(ctx, "encode")()
+
+	setImageTimeout(ctx, img)
+
+	var (
+		result []byte
+		cancel context.CancelFunc
+		err    error
+	)
+
+	if po.Format == imageTypeICO {
+		result, cancel, err = saveImageToIco(ctx, po, img)
+	} else if po.MaxBytes > 0 && po.Format.SupportsQuality() {
+		result, cancel, err = saveImageToFitBytes(ctx, po, img)
+	} else {
+		result, cancel, err = img.Save(po, po.Quality)
+	}
+
+	if err != nil {
+		// libvips aborts saving when the timeout is reached, so we report it as timeout
+		checkTimeout(ctx)
+	}
+
+	return result, cancel, err
+}
+
+// setImageTimeout makes libvips abort the image evaluation when the request deadline is reached.
+// CopyMemory creates a new image, so the timeout should be set again after it
+func setImageTimeout(ctx context.Context, img *vipsImage) {
+	if deadline, ok := ctx.Deadline(); ok {
+		img.SetTimeout(time.Until(deadline))
+	}
+}
+
+// saveImageToFitBytes looks for the highest quality that makes the result fit
+// po.MaxBytes. If even the lowest quality doesn't fit, its result is returned anyway
+func saveImageToFitBytes(ctx context.Context, po *processingOptions, img *vipsImage) ([]byte, context.CancelFunc, error) {
+	// Image is saved several times, so we don't want to run the whole pipeline each time
+	if err := img.CopyMemory(); err != nil {
+		return nil, func() {}, err
+	}
+
+	setImageTimeout(ctx, img)
+
+	result, cancel, err := img.Save(po, po.Quality)
+	if err != nil || len(result) <= po.MaxBytes {
+		return result, cancel, err
+	}
+	cancel()
+
+	minQuality := minInt(minMaxBytesQuality, po.Quality)
+	lo, hi := minQuality, po.Quality-1
+
+	var (
+		best       []byte
+		bestCancel context.CancelFunc
+	)
+
+	for lo <= hi {
+		quality := (lo + hi) / 2
+
+		result, cancel, err = img.Save(po, quality)
+		if err != nil {
+			if bestCancel != nil {
+				bestCancel()
+			}
+			return nil, cancel, err
+		}
+
+		if len(result) <= po.MaxBytes {
+			if bestCancel != nil {
+				bestCancel()
+			}
+			best, bestCancel = result, cancel
+			lo = quality + 1
+		} else {
+			cancel()
+			hi = quality - 1
+		}
+	}
+
+	if best != nil {
+		return best, bestCancel, nil
+	}
+
+	return img.Save(po, minQuality)
+}
+
+// saveImageToIco saves the image resized to each of po.IcoSizes as PNG
+// and packs the results into ICO. The size is the size of the bigger side.
+// When no sizes are requested, the image is packed as is if it fits ICO limits
+func saveImageToIco(ctx context.Context, po *processingOptions, img *vipsImage) ([]byte, context.CancelFunc, error) {
+	// Image is saved several times, so we don't want to run the whole pipeline each time
+	if err := img.CopyMemory(); err != nil {
+		return nil, func() {}, err
+	}
+
+	setImageTimeout(ctx, img)
+
+	imgSize := maxInt(img.Width(), img.Height())
+
+	sizes := po.IcoSizes
+	if len(sizes) == 0 {
+		sizes = []int{minInt(imgSize, icoMaxSize)}
+	}
+
+	pngPo := *po
+	pngPo.Format = imageTypePNG
+
+	entries := make([]icoEntry, 0, len(sizes))
+	cancels := make([]context.CancelFunc, 0, len(sizes))
+
+	// Packing copies the saved images, so we can free them after it
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	for _, size := range sizes {
+		sub := new(vipsImage)
+
+		err := img.Copy(sub)
+
+		if err == nil && size != imgSize {
+			scale := float64(size) / float64(imgSize)
+			err = sub.Resize(scale, scale, sub.HasAlpha(), getResizeKernel(po))
+		}
+
+		var data []byte
+
+		if err == nil {
+			var cancel context.CancelFunc
+			data, cancel, err = sub.Save(&pngPo, po.Quality)
+			cancels = append(cancels, cancel)
+		}
+
+		if err != nil {
+			sub.Clear()
+			return nil, func() {}, err
+		}
+
+		entries = append(entries, icoEntry{Width: sub.Width(), Height: sub.Height(), Data: data})
+		sub.Clear()
+
+		checkTimeout(ctx)
+	}
+
+	return icoPack(entries), func() {}, nil
 }
@@ -0,0 +1,1828 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProcessTestSuite struct{ MainTestSuite }
+
+func (s *ProcessTestSuite) TestCalcScaleZeroHeight() {
+	po := &processingOptions{Resize: resizeFill, Width: 300, Dpr: 1}
+
+	wscale, hscale := calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 0.25, wscale)
+	assert.Equal(s.T(), 200, scaleSize(800, hscale))
+}
+
+func (s *ProcessTestSuite) TestCalcScaleZeroWidth() {
+	po := &processingOptions{Resize: resizeFit, Height: 200, Dpr: 1}
+
+	wscale, hscale := calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 0.25, hscale)
+	assert.Equal(s.T(), 300, scaleSize(1200, wscale))
+}
+
+func (s *ProcessTestSuite) TestCalcScaleZeroDimensionNoEnlarge() {
+	po := &processingOptions{Resize: resizeFit, Width: 2400, Dpr: 1}
+
+	wscale, hscale := calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 1.0, wscale)
+	assert.Equal(s.T(), 1.0, hscale)
+}
+
+func (s *ProcessTestSuite) TestCalcScaleForce() {
+	po := &processingOptions{Resize: resizeForce, Width: 300, Height: 400, Dpr: 1}
+
+	wscale, hscale := calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 300, scaleSize(1200, wscale))
+	assert.Equal(s.T(), 400, scaleSize(800, hscale))
+}
+
+func (s *ProcessTestSuite) TestCalcScaleMin() {
+	po := &processingOptions{Resize: resizeMin, Width: 300, Height: 400, Dpr: 1}
+
+	wscale, hscale := calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 600, scaleSize(1200, wscale))
+	assert.Equal(s.T(), 400, scaleSize(800, hscale))
+}
+
+func (s *ProcessTestSuite) TestCalcScaleFillDown() {
+	po := &processingOptions{Resize: resizeFillDown, Width: 300, Height: 400, Enlarge: true, Dpr: 1}
+
+	wscale, hscale := calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 600, scaleSize(1200, wscale))
+	assert.Equal(s.T(), 400, scaleSize(800, hscale))
+
+	// Small images are never enlarged
+	wscale, hscale = calcScale(120, 80, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 1.0, wscale)
+	assert.Equal(s.T(), 1.0, hscale)
+}
+
+func (s *ProcessTestSuite) TestProcessFillDown() {
+	src := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for x := 0; x < 20; x++ {
+		for y := 0; y < 10; y++ {
+			src.Set(x, y, color.RGBA{0, 0, 255, 255})
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Resize = resizeFillDown
+	po.Width, po.Height = 40, 40
+	po.Enlarge = true
+	po.Background = rgbColor{255, 0, 0}
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), image.Rect(0, 0, 40, 40), img.Bounds())
+
+	// The source is not enlarged and is centered on the background
+	r, g, b, _ := img.At(20, 20).RGBA()
+	assert.Equal(s.T(), []uint32{0, 0, 255}, []uint32{r >> 8, g >> 8, b >> 8})
+
+	r, g, b, _ = img.At(2, 2).RGBA()
+	assert.Equal(s.T(), []uint32{255, 0, 0}, []uint32{r >> 8, g >> 8, b >> 8})
+}
+
+func (s *ProcessTestSuite) TestAspectRatioSize() {
+	crop := aspectRatioOptions{Width: 16, Height: 9}
+	pad := aspectRatioOptions{Width: 16, Height: 9, Pad: true}
+
+	w, h := aspectRatioSize(1600, 1600, crop)
+	assert.Equal(s.T(), [2]int{1600, 900}, [2]int{w, h})
+
+	w, h = aspectRatioSize(3200, 900, crop)
+	assert.Equal(s.T(), [2]int{1600, 900}, [2]int{w, h})
+
+	w, h = aspectRatioSize(1600, 1600, pad)
+	assert.Equal(s.T(), [2]int{2844, 1600}, [2]int{w, h})
+
+	w, h = aspectRatioSize(3200, 900, pad)
+	assert.Equal(s.T(), [2]int{3200, 1800}, [2]int{w, h})
+}
+
+func (s *ProcessTestSuite) TestCalcScaleForceZeroHeight() {
+	po := &processingOptions{Resize: resizeForce, Width: 300, Dpr: 1}
+
+	wscale, hscale := calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 0.25, wscale)
+	assert.Equal(s.T(), 0.25, hscale)
+}
+
+func (s *ProcessTestSuite) TestCalcScaleFactor() {
+	po := &processingOptions{Scale: 0.5, Width: 100, Height: 100, Dpr: 1}
+
+	wscale, hscale := calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 0.5, wscale)
+	assert.Equal(s.T(), 0.5, hscale)
+}
+
+func (s *ProcessTestSuite) TestCalcScaleFactorNoEnlarge() {
+	po := &processingOptions{Scale: 2, Dpr: 1}
+
+	wscale, hscale := calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 1.0, wscale)
+	assert.Equal(s.T(), 1.0, hscale)
+
+	po.Enlarge = true
+
+	wscale, hscale = calcScale(1200, 800, po, imageTypeJPEG)
+
+	assert.Equal(s.T(), 2.0, wscale)
+	assert.Equal(s.T(), 2.0, hscale)
+}
+
+func (s *ProcessTestSuite) TestCalcCropExplicitArea() {
+	left, top := calcCrop(500, 400, 100, 200, &gravityOptions{Type: gravityNorthWest, X: 10, Y: 20})
+
+	assert.Equal(s.T(), 10, left)
+	assert.Equal(s.T(), 20, top)
+}
+
+func (s *ProcessTestSuite) TestCalcCropExplicitAreaOutOfBounds() {
+	left, top := calcCrop(500, 400, 100, 200, &gravityOptions{Type: gravityNorthWest, X: 450, Y: 300})
+
+	assert.Equal(s.T(), 400, left)
+	assert.Equal(s.T(), 200, top)
+}
+
+func (s *ProcessTestSuite) TestCalcCropRoundsOffsets() {
+	// Fractional offsets are rounded like the sizes
+	left, top := calcCrop(500, 400, 100, 200, &gravityOptions{Type: gravityNorthWest, X: 10.6, Y: 20.4})
+
+	assert.Equal(s.T(), 11, left)
+	assert.Equal(s.T(), 20, top)
+}
+
+func (s *ProcessTestSuite) TestProcessDprRounding() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewGray(image.Rect(0, 0, 1000, 1000))))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Resize = resizeFill
+	po.Width, po.Height = 333, 111
+	po.Dpr = 1.1
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	// 333 * 1.1 = 366.3 and 111 * 1.1 = 122.1
+	assert.Equal(s.T(), image.Rect(0, 0, 366, 122), img.Bounds())
+}
+
+func (s *ProcessTestSuite) TestFormatQuality() {
+	conf.Quality = 80
+	conf.WebpQuality = 75
+	conf.AvifQuality = 50
+
+	assert.Equal(s.T(), 80, formatQuality(imageTypeJPEG))
+	assert.Equal(s.T(), 75, formatQuality(imageTypeWEBP))
+	assert.Equal(s.T(), 50, formatQuality(imageTypeAVIF))
+	assert.Equal(s.T(), 80, formatQuality(imageTypePNG))
+}
+
+func (s *ProcessTestSuite) TestCanUseThumbnail() {
+	defer func(v bool) { vipsSupportThumbnail = v }(vipsSupportThumbnail)
+	vipsSupportThumbnail = true
+
+	po := &processingOptions{Resize: resizeFit}
+
+	assert.True(s.T(), canUseThumbnail(po, imageTypeJPEG, 0.5, 0.5))
+	assert.True(s.T(), canUseThumbnail(po, imageTypePNG, 1, 0.5))
+	assert.False(s.T(), canUseThumbnail(po, imageTypeGIF, 0.5, 0.5))
+	assert.False(s.T(), canUseThumbnail(po, imageTypeJPEG, 1, 1))
+	assert.False(s.T(), canUseThumbnail(po, imageTypeJPEG, 2, 0.5))
+
+	for _, po := range []*processingOptions{
+		{Resize: resizeForce},
+		{Resize: resizeFit, Crop: cropOptions{Width: 10}},
+		{Resize: resizeFit, Rotate: 90},
+	} {
+		assert.False(s.T(), canUseThumbnail(po, imageTypeJPEG, 0.5, 0.5))
+	}
+
+	conf.DisableShrinkOnLoad = true
+
+	assert.False(s.T(), canUseThumbnail(po, imageTypeJPEG, 0.5, 0.5))
+}
+
+func (s *ProcessTestSuite) TestProcessThumbnail() {
+	// Left half is red, right half is blue
+	src := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 50; y++ {
+			if x < 50 {
+				src.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				src.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	// Both the fast path and the regular pipeline should give the same result
+	for _, disableThumbnail := range []bool{false, true} {
+		conf.DisableShrinkOnLoad = disableThumbnail
+
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypePNG
+		po.Width, po.Height = 20, 20
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data.Bytes()))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		require.Nil(s.T(), err)
+
+		img, err := png.Decode(bytes.NewReader(result))
+		cancel()
+		require.Nil(s.T(), err)
+
+		assert.Equal(s.T(), image.Rect(0, 0, 20, 10), img.Bounds())
+
+		r, _, b, _ := img.At(2, 5).RGBA()
+		assert.True(s.T(), r>>8 > 240 && b>>8 < 15, "Red became %d,%d", r>>8, b>>8)
+
+		r, _, b, _ = img.At(17, 5).RGBA()
+		assert.True(s.T(), r>>8 < 15 && b>>8 > 240, "Blue became %d,%d", r>>8, b>>8)
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessCMYK() {
+	// 16x8 Adobe CMYK JPEG without embedded profile: the left half is white, the right half is cyan
+	data, err := ioutil.ReadFile("testdata/cmyk.jpg")
+	require.Nil(s.T(), err)
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeJPEG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data))
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	r, g, b, _ := img.At(3, 4).RGBA()
+
+	assert.True(s.T(), r>>8 > 240 && g>>8 > 240 && b>>8 > 240, "White became %d,%d,%d", r>>8, g>>8, b>>8)
+
+	r, g, b, _ = img.At(12, 4).RGBA()
+
+	assert.True(s.T(), r>>8 < 60 && g>>8 > 120 && g>>8 < 200 && b>>8 > 200, "Cyan became %d,%d,%d", r>>8, g>>8, b>>8)
+}
+
+func (s *ProcessTestSuite) TestProcessAnimatedGifToWebP() {
+	if !vipsSupportAnimation(imageTypeWEBP) {
+		s.T().Skip("libvips doesn't support animated WebP")
+	}
+
+	conf.MaxAnimationFrames = 10
+
+	buf := testAnimatedGif(s.T(), 3)
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypeWEBP
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeGIF)
+	ctx = context.WithValue(ctx, imageDataCtxKey, buf)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	// Every frame of animated WebP is stored in its own ANMF chunk
+	assert.Equal(s.T(), 3, bytes.Count(result, []byte("ANMF")))
+}
+
+func (s *ProcessTestSuite) TestProcessAnimationFramesLimit() {
+	if !vipsTypeSupportSave[imageTypeGIF] {
+		s.T().Skip("libvips doesn't support GIF saving")
+	}
+
+	conf.MaxAnimationFrames = 2
+
+	for _, reject := range []bool{false, true} {
+		conf.RejectExceededAnimationFrames = reject
+
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypeGIF
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeGIF)
+		ctx = context.WithValue(ctx, imageDataCtxKey, testAnimatedGif(s.T(), 3))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		cancel()
+
+		if reject {
+			assert.Equal(s.T(), errSourceTooManyFrames, err)
+			continue
+		}
+
+		require.Nil(s.T(), err)
+
+		img, err := gif.DecodeAll(bytes.NewReader(result))
+		require.Nil(s.T(), err)
+
+		assert.Len(s.T(), img.Image, 2)
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessFrame() {
+	// Frame N of the test GIF has a single white pixel at (N, N)
+	for frame, expected := range map[int]int{0: 0, 1: 1, 10: 2} {
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypePNG
+		po.Frame = frame
+		po.ExtractFrame = true
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeGIF)
+		ctx = context.WithValue(ctx, imageDataCtxKey, testAnimatedGif(s.T(), 3))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		require.Nil(s.T(), err)
+
+		img, err := png.Decode(bytes.NewReader(result))
+		cancel()
+		require.Nil(s.T(), err)
+
+		assert.Equal(s.T(), 8, img.Bounds().Dy())
+
+		for i := 0; i < 3; i++ {
+			r, _, _, _ := img.At(i, i).RGBA()
+			assert.Equal(s.T(), i == expected, r>>8 > 128, "frame: %d, pixel: %d", frame, i)
+		}
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessFirstFrameAnimationEnabled() {
+	if !vipsTypeSupportSave[imageTypeGIF] {
+		s.T().Skip("libvips doesn't support GIF saving")
+	}
+
+	conf.MaxAnimationFrames = 10
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypeGIF
+	require.Nil(s.T(), applyFrameOption(po, []string{"0"}))
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeGIF)
+	ctx = context.WithValue(ctx, imageDataCtxKey, testAnimatedGif(s.T(), 3))
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	anim, err := gif.DecodeAll(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	// Only the first frame is returned instead of the whole animation
+	require.Len(s.T(), anim.Image, 1)
+	assert.Equal(s.T(), 8, anim.Image[0].Bounds().Dy())
+
+	r, _, _, _ := anim.Image[0].At(0, 0).RGBA()
+	assert.True(s.T(), r>>8 > 128)
+
+	r, _, _, _ = anim.Image[0].At(1, 1).RGBA()
+	assert.False(s.T(), r>>8 > 128)
+}
+
+func (s *ProcessTestSuite) TestProcessTimeout() {
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	ctx, cancel := startTimer(context.Background(), time.Nanosecond)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, imageTypeCtxKey, imageTypeGIF)
+	ctx = context.WithValue(ctx, imageDataCtxKey, testAnimatedGif(s.T(), 1))
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	<-ctx.Done()
+
+	defer func() {
+		ierr, ok := recover().(*imgproxyError)
+		require.True(s.T(), ok)
+		assert.Equal(s.T(), 503, ierr.StatusCode)
+	}()
+
+	processImage(ctx)
+}
+
+func (s *ProcessTestSuite) TestProcessSaveTimeout() {
+	noise := image.NewGray(image.Rect(0, 0, 1000, 1000))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, noise))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypeJPEG
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	require.Nil(s.T(), img.Load(data.Bytes(), imageTypePNG, 1, 1.0, 0, 1))
+
+	// The image is decoded and blurred only while it's saved, so it's libvips
+	// that should stop the processing when the deadline is reached
+	require.Nil(s.T(), img.Blur(100))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	setImageTimeout(ctx, img)
+
+	start := time.Now()
+
+	_, saveCancel, err := img.Save(po, po.Quality)
+	defer saveCancel()
+
+	require.Error(s.T(), err)
+	assert.True(s.T(), time.Since(start) < time.Second, "saving took %v", time.Since(start))
+}
+
+func (s *ProcessTestSuite) TestProcessPassthrough() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+
+	for _, width := range []int{0, 10, 5} {
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypePNG
+		po.Width = width
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data.Bytes()))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		require.Nil(s.T(), err)
+
+		// Resizing is required only for width 5
+		assert.Equal(s.T(), width != 5, bytes.Equal(data.Bytes(), result), "Width %d", width)
+
+		cancel()
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessNoPassthroughWithSaveOptions() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+
+	setups := map[string]func(po *processingOptions){
+		"quality": func(po *processingOptions) {
+			require.Nil(s.T(), applyQualityOption(po, []string{"30"}))
+		},
+		"png_options": func(po *processingOptions) {
+			require.Nil(s.T(), applyPngOptionsOption(po, []string{"9"}))
+		},
+		"progressive": func(po *processingOptions) {
+			require.Nil(s.T(), applyProgressiveOption(po, []string{"1"}))
+		},
+		"embed_srgb": func(po *processingOptions) {
+			conf.EmbedSRGBProfile = true
+		},
+	}
+
+	for name, setup := range setups {
+		conf.EmbedSRGBProfile = false
+
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypePNG
+		setup(po)
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data.Bytes()))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		require.Nil(s.T(), err, name)
+
+		assert.False(s.T(), bytes.Equal(data.Bytes(), result), name)
+
+		cancel()
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessResizeMin() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 100, 50))))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Resize = resizeMin
+	po.Width, po.Height = 20, 20
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	// The image covers 20x20 area and isn't cropped
+	assert.Equal(s.T(), image.Rect(0, 0, 40, 20), img.Bounds())
+}
+
+func (s *ProcessTestSuite) TestProcessIco() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 100, 50))))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypeICO
+	po.IcoSizes = []int{16, 32}
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	// Number of images and dimensions of each of them
+	assert.Equal(s.T(), byte(2), result[4])
+	assert.Equal(s.T(), []byte{16, 8}, result[6:8])
+	assert.Equal(s.T(), []byte{32, 16}, result[22:24])
+}
+
+func (s *ProcessTestSuite) TestProcessOrientationGravity() {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+
+	// Landscape image with red left half and portrait image with red top half
+	landscape := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	portrait := image.NewRGBA(image.Rect(0, 0, 20, 40))
+
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			c := blue
+			if x < 20 {
+				c = red
+			}
+
+			landscape.Set(x, y, c)
+			portrait.Set(y, x, c)
+		}
+	}
+
+	// Horizontal and vertical directions of the gravities
+	gravities := []struct {
+		Type gravityType
+		H, V int
+	}{
+		{gravityCenter, 0, 0},
+		{gravityNorth, 0, -1},
+		{gravitySouth, 0, 1},
+		{gravityEast, 1, 0},
+		{gravityWest, -1, 0},
+		{gravityNorthEast, 1, -1},
+		{gravityNorthWest, -1, -1},
+		{gravitySouthEast, 1, 1},
+		{gravitySouthWest, -1, 1},
+	}
+
+	colorAt := func(img image.Image, x, y int) color.Color {
+		r, _, b, _ := img.At(x, y).RGBA()
+		if r>>8 > 200 && b>>8 < 60 {
+			return red
+		}
+		if b>>8 > 200 && r>>8 < 60 {
+			return blue
+		}
+		return color.Black
+	}
+
+	expected := func(dir, side int) color.Color {
+		// Side of the crop is red when the crop is moved to the red half
+		// or the crop is centered and the side is the red one
+		if dir < 0 || (dir == 0 && side < 0) {
+			return red
+		}
+		return blue
+	}
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, g := range gravities {
+			for _, isLandscape := range []bool{true, false} {
+				oriented := image.Image(portrait)
+				if isLandscape {
+					oriented = landscape
+				}
+
+				po, err := defaultProcessingOptions(&processingHeaders{})
+				require.Nil(s.T(), err)
+
+				po.Format = imageTypePNG
+				po.Resize = resizeFill
+				po.Width, po.Height = 20, 20
+				po.Gravity = gravityOptions{Type: g.Type}
+
+				ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeJPEG)
+				ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(testOrientedJpeg(s.T(), oriented, orientation)))
+				ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+				result, cancel, err := processImage(ctx)
+				require.Nil(s.T(), err)
+
+				img, err := png.Decode(bytes.NewReader(result))
+				cancel()
+				require.Nil(s.T(), err)
+
+				require.Equal(s.T(), image.Rect(0, 0, 20, 20), img.Bounds())
+
+				msg := fmt.Sprintf("Orientation: %d, gravity: %s, landscape: %t", orientation, g.Type, isLandscape)
+
+				if isLandscape {
+					assert.Equal(s.T(), expected(g.H, -1), colorAt(img, 3, 10), msg)
+					assert.Equal(s.T(), expected(g.H, 1), colorAt(img, 16, 10), msg)
+				} else {
+					assert.Equal(s.T(), expected(g.V, -1), colorAt(img, 10, 3), msg)
+					assert.Equal(s.T(), expected(g.V, 1), colorAt(img, 10, 16), msg)
+				}
+			}
+		}
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessFlipAfterOrientation() {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+
+	// Oriented image with red top left quarter
+	oriented := image.NewRGBA(image.Rect(0, 0, 40, 20))
+
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			c := blue
+			if x < 20 && y < 10 {
+				c = red
+			}
+
+			oriented.Set(x, y, c)
+		}
+	}
+
+	// Expected position of the red quarter: x and y of its center
+	requested := []struct {
+		Flip, Flop bool
+		X, Y       int
+	}{
+		{false, false, 10, 5},
+		{true, false, 10, 15},
+		{false, true, 30, 5},
+		{true, true, 30, 15},
+	}
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, r := range requested {
+			po, err := defaultProcessingOptions(&processingHeaders{})
+			require.Nil(s.T(), err)
+
+			po.Format = imageTypePNG
+			po.Flip = r.Flip
+			po.Flop = r.Flop
+
+			ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeJPEG)
+			ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(testOrientedJpeg(s.T(), oriented, orientation)))
+			ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+			result, cancel, err := processImage(ctx)
+			require.Nil(s.T(), err)
+
+			img, err := png.Decode(bytes.NewReader(result))
+			cancel()
+			require.Nil(s.T(), err)
+
+			require.Equal(s.T(), image.Rect(0, 0, 40, 20), img.Bounds())
+
+			msg := fmt.Sprintf("Orientation: %d, flip: %t, flop: %t", orientation, r.Flip, r.Flop)
+
+			// Requested flips are applied on top of EXIF orientation, so the red
+			// quarter is moved relative to the oriented image
+			for _, p := range [][2]int{{10, 5}, {30, 5}, {10, 15}, {30, 15}} {
+				cr, _, cb, _ := img.At(p[0], p[1]).RGBA()
+				isRed := cr>>8 > 200 && cb>>8 < 60
+
+				assert.Equal(s.T(), p[0] == r.X && p[1] == r.Y, isRed, "%s, pixel %d:%d", msg, p[0], p[1])
+			}
+		}
+	}
+}
+
+func (s *ProcessTestSuite) TestOrientationTransform() {
+	for orientation, exp := range map[int]struct {
+		angle int
+		flip  bool
+	}{
+		1:  {vipsAngleD0, false},
+		2:  {vipsAngleD0, true},
+		3:  {vipsAngleD180, false},
+		4:  {vipsAngleD180, true},
+		5:  {vipsAngleD90, true},
+		6:  {vipsAngleD90, false},
+		7:  {vipsAngleD270, true},
+		8:  {vipsAngleD270, false},
+		0:  {vipsAngleD0, false},
+		9:  {vipsAngleD0, false},
+		-1: {vipsAngleD0, false},
+	} {
+		angle, flip := orientationTransform(orientation)
+
+		assert.Equal(s.T(), exp.angle, angle, "orientation: %d", orientation)
+		assert.Equal(s.T(), exp.flip, flip, "orientation: %d", orientation)
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessNonStandardOrientation() {
+	for _, orientation := range []int{0, 9} {
+		data := testOrientedJpeg(s.T(), image.NewRGBA(image.Rect(0, 0, 40, 20)), orientation)
+
+		img := new(vipsImage)
+		require.Nil(s.T(), img.Load(data, imageTypeJPEG, 1, 1.0, 0, 1))
+
+		// Non-standard values are treated as no transformation
+		assert.Equal(s.T(), 1, img.Orientation(), "orientation: %d", orientation)
+
+		width, height, angle, flip := extractMeta(img, imageTypeJPEG)
+		img.Clear()
+
+		assert.Equal(s.T(), 40, width, "orientation: %d", orientation)
+		assert.Equal(s.T(), 20, height, "orientation: %d", orientation)
+		assert.Equal(s.T(), vipsAngleD0, angle, "orientation: %d", orientation)
+		assert.False(s.T(), flip, "orientation: %d", orientation)
+
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypeJPEG
+		po.Width = 20
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeJPEG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		require.Nil(s.T(), err, "orientation: %d", orientation)
+
+		resultImg, err := jpeg.Decode(bytes.NewReader(result))
+		cancel()
+		require.Nil(s.T(), err)
+
+		assert.Equal(s.T(), image.Rect(0, 0, 20, 10), resultImg.Bounds(), "orientation: %d", orientation)
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessRemovesAppliedOrientation() {
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypeJPEG
+	po.StripMetadata = false
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeJPEG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(testOrientedJpeg(s.T(), image.NewRGBA(image.Rect(0, 0, 40, 20)), 6)))
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	require.Nil(s.T(), img.Load(result, imageTypeJPEG, 1, 1.0, 0, 1))
+
+	assert.Equal(s.T(), 40, img.Width())
+	assert.Equal(s.T(), 20, img.Height())
+	assert.Equal(s.T(), 1, img.Orientation())
+}
+
+func (s *ProcessTestSuite) TestProcessInvert() {
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for x := 0; x < 20; x++ {
+		for y := 0; y < 20; y++ {
+			src.Set(x, y, color.NRGBA{0, 0, 255, 100})
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	process := func(grayscale bool) color.NRGBA {
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypePNG
+		po.Invert = true
+		po.Grayscale = grayscale
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data.Bytes()))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		defer cancel()
+
+		require.Nil(s.T(), err)
+
+		img, err := png.Decode(bytes.NewReader(result))
+		require.Nil(s.T(), err)
+
+		return color.NRGBAModel.Convert(img.At(10, 10)).(color.NRGBA)
+	}
+
+	// Colour channels are inverted while alpha is kept
+	c := process(false)
+	assert.Equal(s.T(), color.NRGBA{255, 255, 0, 100}, c)
+
+	// Blue is dark, so inverted grayscale blue is light
+	c = process(true)
+	assert.Equal(s.T(), c.R, c.G)
+	assert.Equal(s.T(), c.R, c.B)
+	assert.True(s.T(), c.R > 160)
+	assert.Equal(s.T(), uint8(100), c.A)
+}
+
+func (s *ProcessTestSuite) TestProcessKernel() {
+	// 2x2 black and white checkerboard
+	src := image.NewGray(image.Rect(0, 0, 2, 2))
+	src.SetGray(0, 0, color.Gray{255})
+	src.SetGray(1, 1, color.Gray{255})
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	process := func(kernel resizeKernel) image.Image {
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypePNG
+		po.Width = 8
+		po.Height = 8
+		po.Enlarge = true
+		po.Kernel = kernel
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data.Bytes()))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		defer cancel()
+
+		require.Nil(s.T(), err)
+
+		img, err := png.Decode(bytes.NewReader(result))
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), image.Rect(0, 0, 8, 8), img.Bounds())
+
+		return img
+	}
+
+	isCrisp := func(img image.Image) bool {
+		for x := 0; x < 8; x++ {
+			for y := 0; y < 8; y++ {
+				expected := uint8(0)
+				if (x < 4) == (y < 4) {
+					expected = 255
+				}
+
+				if color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y != expected {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	assert.True(s.T(), isCrisp(process(resizeKernelNearest)))
+	assert.False(s.T(), isCrisp(process(resizeKernelLanczos3)))
+}
+
+func (s *ProcessTestSuite) TestProcessNoAntialias() {
+	// 2x2 black and white checkerboard
+	src := image.NewGray(image.Rect(0, 0, 2, 2))
+	src.SetGray(0, 0, color.Gray{255})
+	src.SetGray(1, 1, color.Gray{255})
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Width = 8
+	po.Height = 8
+	po.Enlarge = true
+	po.Kernel = resizeKernelLanczos3
+	po.NoAntialias = true
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), image.Rect(0, 0, 8, 8), img.Bounds())
+
+	// The kernel is ignored, and every source pixel becomes a sharp 4x4 block
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			expected := uint8(0)
+			if (x < 4) == (y < 4) {
+				expected = 255
+			}
+
+			assert.Equal(s.T(), expected, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y, "pixel: %d,%d", x, y)
+		}
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessNoAntialiasDownscale() {
+	// 8x8 black and white checkerboard of single pixels
+	src := image.NewGray(image.Rect(0, 0, 8, 8))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			if (x+y)%2 == 0 {
+				src.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Width = 4
+	po.Height = 4
+	po.NoAntialias = true
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), image.Rect(0, 0, 4, 4), img.Bounds())
+
+	// Pixels are picked rather than blended into gray
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			c := color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+			assert.True(s.T(), c == 0 || c == 255, "pixel: %d,%d, color: %d", x, y, c)
+		}
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessExtendConfig() {
+	conf.Extend = true
+	conf.Enlarge = false
+
+	src := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			src.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Width = 20
+	po.Height = 20
+	po.Background = rgbColor{0, 0, 255}
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	// The image isn't enlarged, but it's letterboxed with the background
+	assert.Equal(s.T(), image.Rect(0, 0, 20, 20), img.Bounds())
+
+	r, g, b, _ := img.At(10, 10).RGBA()
+	assert.Equal(s.T(), []uint32{255, 0, 0}, []uint32{r >> 8, g >> 8, b >> 8})
+
+	r, g, b, _ = img.At(0, 0).RGBA()
+	assert.Equal(s.T(), []uint32{0, 0, 255}, []uint32{r >> 8, g >> 8, b >> 8})
+}
+
+func (s *ProcessTestSuite) TestProcessMaxSize() {
+	// Red top half and blue bottom half
+	src := image.NewRGBA(image.Rect(0, 0, 100, 200))
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 200; y++ {
+			if y < 100 {
+				src.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				src.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	type testCase struct {
+		resize                    resizeType
+		width, height             int
+		maxWidth, maxHeight       int
+		dpr                       float64
+		gravity                   gravityType
+		resultWidth, resultHeight int
+		topRed                    bool
+	}
+
+	for _, tc := range []testCase{
+		// The height is calculated from the width, and the overflow is cropped with gravity
+		{resizeFit, 50, 0, 0, 40, 1, gravityNorth, 50, 40, true},
+		{resizeFit, 50, 0, 0, 40, 1, gravitySouth, 50, 40, false},
+		// Max sizes limit the requested sizes like fit does
+		{resizeFit, 80, 0, 50, 0, 1, gravityCenter, 50, 100, true},
+		{resizeFit, 50, 100, 0, 40, 1, gravityCenter, 20, 40, true},
+		{resizeFill, 50, 100, 0, 40, 1, gravityCenter, 50, 40, true},
+		// The image is fit into max sizes when no size is requested
+		{resizeFit, 0, 0, 30, 0, 1, gravityCenter, 30, 60, true},
+		{resizeFill, 0, 0, 30, 40, 1, gravityCenter, 20, 40, true},
+		// The image that fits the max sizes is not cropped
+		{resizeFit, 20, 0, 30, 40, 1, gravityCenter, 20, 40, true},
+		// Max sizes are multiplied by dpr
+		{resizeFit, 25, 0, 0, 20, 2, gravityCenter, 50, 40, true},
+	} {
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypePNG
+		po.Resize = tc.resize
+		po.Width, po.Height = tc.width, tc.height
+		po.MaxWidth, po.MaxHeight = tc.maxWidth, tc.maxHeight
+		po.Dpr = tc.dpr
+		po.Gravity.Type = tc.gravity
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data.Bytes()))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		require.Nil(s.T(), err)
+
+		img, err := png.Decode(bytes.NewReader(result))
+		require.Nil(s.T(), err)
+
+		cancel()
+
+		r, _, b, _ := img.At(img.Bounds().Dx()/2, 0).RGBA()
+
+		assert.Equal(s.T(), image.Rect(0, 0, tc.resultWidth, tc.resultHeight), img.Bounds(), "case: %+v", tc)
+		assert.Equal(s.T(), tc.topRed, r>>8 > 200 && b>>8 < 50, "case: %+v", tc)
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessSepia() {
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for x := 0; x < 20; x++ {
+		for y := 0; y < 20; y++ {
+			src.Set(x, y, color.NRGBA{100, 150, 200, 255})
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	process := func(strength float64, grayscale bool) color.NRGBA {
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypePNG
+		po.Sepia = strength
+		po.Grayscale = grayscale
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data.Bytes()))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		defer cancel()
+
+		require.Nil(s.T(), err)
+
+		img, err := png.Decode(bytes.NewReader(result))
+		require.Nil(s.T(), err)
+
+		return color.NRGBAModel.Convert(img.At(10, 10)).(color.NRGBA)
+	}
+
+	assertColor := func(expected [3]float64, c color.NRGBA) {
+		assert.InDelta(s.T(), expected[0], float64(c.R), 1.5)
+		assert.InDelta(s.T(), expected[1], float64(c.G), 1.5)
+		assert.InDelta(s.T(), expected[2], float64(c.B), 1.5)
+		assert.Equal(s.T(), uint8(255), c.A)
+	}
+
+	// 0.393*100 + 0.769*150 + 0.189*200 and so on
+	assertColor([3]float64{192.45, 171.4, 133.5}, process(1, false))
+
+	// Half strength is the average of the source and the full sepia
+	assertColor([3]float64{146.2, 160.7, 166.75}, process(0.5, false))
+
+	// Grayscale-then-sepia gives the warm tone
+	c := process(1, true)
+	assert.True(s.T(), c.R > c.G && c.G > c.B, "color: %v", c)
+}
+
+func (s *ProcessTestSuite) TestProcessTransparentBackground() {
+	src := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			src.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), jpeg.Encode(data, src, nil))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	require.Nil(s.T(), applyBackgroundOption(po, []string{"transparent"}))
+	po.Width, po.Height = 20, 20
+	po.Extend = true
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeJPEG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	// JPEG doesn't support alpha, so PNG is used
+	assert.Equal(s.T(), imageTypePNG, po.Format)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), image.Rect(0, 0, 20, 20), img.Bounds())
+
+	_, _, _, a := img.At(0, 0).RGBA()
+	assert.Equal(s.T(), uint32(0), a)
+
+	_, _, _, a = img.At(10, 10).RGBA()
+	assert.Equal(s.T(), uint32(0xffff), a)
+}
+
+func (s *ProcessTestSuite) TestProcessAspectRatio() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 100, 50))))
+
+	process := func(width int, pad bool) image.Rectangle {
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Format = imageTypePNG
+		po.Width = width
+		po.AspectRatio = aspectRatioOptions{Width: 1, Height: 1, Pad: pad}
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data.Bytes()))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		result, cancel, err := processImage(ctx)
+		defer cancel()
+
+		require.Nil(s.T(), err)
+
+		img, err := png.Decode(bytes.NewReader(result))
+		require.Nil(s.T(), err)
+
+		return img.Bounds()
+	}
+
+	assert.Equal(s.T(), image.Rect(0, 0, 50, 50), process(0, false))
+	assert.Equal(s.T(), image.Rect(0, 0, 100, 100), process(0, true))
+
+	// Aspect ratio is applied before resizing
+	assert.Equal(s.T(), image.Rect(0, 0, 20, 20), process(20, false))
+	assert.Equal(s.T(), image.Rect(0, 0, 20, 20), process(20, true))
+}
+
+func (s *ProcessTestSuite) TestProcessAspectRatioPadTooBig() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 100, 50))))
+
+	conf.MaxResolution = 100000
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.AspectRatio = aspectRatioOptions{Width: 1, Height: 50, Pad: true}
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	// The image is padded to 100x5000
+	_, cancel, err := processImage(ctx)
+	defer cancel()
+
+	assert.Equal(s.T(), errResultResolutionTooBig, err)
+}
+
+func (s *ProcessTestSuite) TestProcess16BitPng() {
+	src := image.NewNRGBA64(image.Rect(0, 0, 40, 40))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 40; y++ {
+			src.Set(x, y, color.NRGBA64{0xffff, 0x8080, 0, 0x8080})
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Width = 20
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	// The result is 8-bit
+	require.IsType(s.T(), &image.NRGBA{}, img)
+	assert.Equal(s.T(), image.Rect(0, 0, 20, 20), img.Bounds())
+
+	c := img.(*image.NRGBA).NRGBAAt(10, 10)
+	assert.InDelta(s.T(), 255, int(c.R), 2)
+	assert.InDelta(s.T(), 128, int(c.G), 2)
+	assert.InDelta(s.T(), 0, int(c.B), 2)
+	assert.InDelta(s.T(), 128, int(c.A), 2)
+}
+
+func (s *ProcessTestSuite) TestProcessResolutionTooBig() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewGray(image.Rect(0, 0, 100, 100))))
+
+	conf.MaxSrcResolution = 100 * 100 / 2
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	_, cancel, err := processImage(ctx)
+	defer cancel()
+
+	assert.Equal(s.T(), errSourceResolutionTooBig, err)
+}
+
+func (s *ProcessTestSuite) TestProcessEmptyData() {
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeJPEG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, new(bytes.Buffer))
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	assert.NotPanics(s.T(), func() {
+		_, cancel, err := processImage(ctx)
+		defer cancel()
+
+		assert.Equal(s.T(), errSourceImageEmpty, err)
+	})
+}
+
+func (s *ProcessTestSuite) TestProcessUnknownType() {
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeUnknown)
+	ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBufferString("lorem ipsum"))
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	assert.NotPanics(s.T(), func() {
+		_, cancel, err := processImage(ctx)
+		defer cancel()
+
+		require.Error(s.T(), err)
+		assert.True(s.T(), isSourceImageTypeError(err))
+		assert.Equal(s.T(), 422, err.(*imgproxyError).StatusCode)
+	})
+}
+
+func (s *ProcessTestSuite) TestProcessStreamedJpeg() {
+	if !vipsTypeSupportStream[imageTypeJPEG] {
+		s.T().Skip("Streaming JPEG is not supported")
+	}
+
+	noise := image.NewGray(image.Rect(0, 0, 400, 300))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), jpeg.Encode(data, noise, nil))
+
+	size := data.Len()
+	head := bytes.NewBuffer(data.Next(1024))
+
+	stream := newImageStream(head, ioutil.NopCloser(data))
+	defer stream.Close()
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Width = 100
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeJPEG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, head)
+	ctx = context.WithValue(ctx, imageStreamCtxKey, stream)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), image.Rect(0, 0, 100, 75), img.Bounds())
+	assert.Equal(s.T(), size, stream.Len())
+}
+
+func (s *ProcessTestSuite) TestProcessStreamReadError() {
+	if !vipsTypeSupportStream[imageTypeJPEG] {
+		s.T().Skip("Streaming JPEG is not supported")
+	}
+
+	noise := image.NewGray(image.Rect(0, 0, 400, 300))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), jpeg.Encode(data, noise, nil))
+
+	head := bytes.NewBuffer(data.Next(1024))
+
+	// The stream fails in the middle of the image
+	body := &limitReader{r: ioutil.NopCloser(data), left: data.Len() / 2}
+
+	stream := newImageStream(head, body)
+	defer stream.Close()
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeJPEG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, head)
+	ctx = context.WithValue(ctx, imageStreamCtxKey, stream)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	_, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errSourceFileTooBig, stream.err)
+}
+
+func (s *ProcessTestSuite) TestProcessMaxResolutionSingleDimension() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 100, 50))))
+
+	conf.MaxResolution = 1000000
+
+	for _, size := range []struct{ Width, Height int }{{2000, 0}, {0, 1000}} {
+		po, err := defaultProcessingOptions(&processingHeaders{})
+		require.Nil(s.T(), err)
+
+		po.Width, po.Height = size.Width, size.Height
+		po.Enlarge = true
+
+		ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+		ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data.Bytes()))
+		ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+		// The missing side is calculated from the source aspect ratio, so the result is 2000x1000
+		_, cancel, err := processImage(ctx)
+		cancel()
+
+		assert.Equal(s.T(), errResultResolutionTooBig, err, "size: %dx%d", size.Width, size.Height)
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessCorruptedPng() {
+	noise := image.NewGray(image.Rect(0, 0, 100, 100))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, noise))
+
+	// The header is intact, so the image is loaded, but its pixel data can't be decoded
+	corrupted := data.Bytes()
+	for i := len(corrupted) / 2; i < len(corrupted)/2+64; i++ {
+		corrupted[i] ^= 0xff
+	}
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Width = 50
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	_, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.IsType(s.T(), &imgproxyError{}, err)
+	assert.Equal(s.T(), 422, err.(*imgproxyError).StatusCode)
+}
+
+func (s *ProcessTestSuite) TestProcessBrokenPng() {
+	// PNG signature followed by garbage
+	data := bytes.NewBuffer([]byte("\x89PNG\r\n\x1a\nlorem ipsum dolor sit amet"))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Width = 50
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	_, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.IsType(s.T(), &imgproxyError{}, err)
+	assert.Equal(s.T(), 422, err.(*imgproxyError).StatusCode)
+	assert.Equal(s.T(), "Can't load png image", err.(*imgproxyError).PublicMessage)
+}
+
+func (s *ProcessTestSuite) TestProcessPadding() {
+	src := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	for x := 0; x < 20; x++ {
+		for y := 0; y < 20; y++ {
+			src.Set(x, y, color.RGBA{0, 0, 255, 255})
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Width = 10
+	po.Padding = paddingOptions{Top: 1, Right: 2, Bottom: 3, Left: 4}
+	po.Background = rgbColor{255, 0, 0}
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	// Padding is added to the resized image
+	assert.Equal(s.T(), image.Rect(0, 0, 16, 14), img.Bounds())
+
+	for _, tc := range []struct {
+		x, y int
+		red  bool
+	}{
+		{3, 5, true},
+		{4, 1, false},
+		{13, 10, false},
+		{14, 10, true},
+		{8, 0, true},
+		{8, 11, true},
+	} {
+		r, _, b, _ := img.At(tc.x, tc.y).RGBA()
+		assert.Equal(s.T(), tc.red, r>>8 > 200 && b>>8 < 50, "pixel %d:%d", tc.x, tc.y)
+	}
+}
+
+func (s *ProcessTestSuite) TestProcessPaddingTooBig() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 20, 20))))
+
+	conf.MaxDimension = 100
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Padding = paddingOptions{Top: 0, Right: 100, Bottom: 0, Left: 0}
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	_, cancel, err := processImage(ctx)
+	defer cancel()
+
+	assert.Equal(s.T(), errResultDimensionsTooBig, err)
+}
+
+func (s *ProcessTestSuite) TestProcessWatermarkDpr() {
+	wmData := new(bytes.Buffer)
+	wmSrc := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			wmSrc.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	require.Nil(s.T(), png.Encode(wmData, wmSrc))
+
+	conf.WatermarkData = base64.StdEncoding.EncodeToString(wmData.Bytes())
+	require.Nil(s.T(), vipsPrepareWatermark())
+
+	defer func() {
+		watermark.Clear()
+		watermark = nil
+	}()
+
+	src := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 40; y++ {
+			src.Set(x, y, color.RGBA{0, 0, 255, 255})
+		}
+	}
+
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, src))
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Width = 20
+	po.Dpr = 2
+	po.Watermark = watermarkOptions{Enabled: true, Opacity: 1, Gravity: gravityNorthWest, OffsetX: 2, OffsetY: 2}
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, data)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	defer cancel()
+
+	require.Nil(s.T(), err)
+
+	img, err := png.Decode(bytes.NewReader(result))
+	require.Nil(s.T(), err)
+
+	// Both the watermark size and the offsets are doubled: the watermark covers 4..11
+	for _, tc := range []struct {
+		x, y int
+		red  bool
+	}{
+		{3, 3, false},
+		{4, 4, true},
+		{11, 11, true},
+		{12, 12, false},
+	} {
+		r, _, b, _ := img.At(tc.x, tc.y).RGBA()
+		assert.Equal(s.T(), tc.red, r>>8 > 200 && b>>8 < 50, "pixel %d:%d", tc.x, tc.y)
+	}
+}
+
+// testOrientedJpeg returns a JPEG with the EXIF orientation that looks
+// like the oriented image when the orientation is applied
+func testOrientedJpeg(t *testing.T, oriented image.Image, orientation int) []byte {
+	w, h := oriented.Bounds().Dx(), oriented.Bounds().Dy()
+
+	srcW, srcH := w, h
+	if orientation >= 5 && orientation <= 8 {
+		srcW, srcH = h, w
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			var srcX, srcY int
+
+			switch orientation {
+			case 2:
+				srcX, srcY = w-1-x, y
+			case 3:
+				srcX, srcY = w-1-x, h-1-y
+			case 4:
+				srcX, srcY = x, h-1-y
+			case 5:
+				srcX, srcY = y, x
+			case 6:
+				srcX, srcY = y, w-1-x
+			case 7:
+				srcX, srcY = h-1-y, w-1-x
+			case 8:
+				srcX, srcY = h-1-y, x
+			default:
+				srcX, srcY = x, y
+			}
+
+			src.Set(srcX, srcY, oriented.At(x, y))
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(t, jpeg.Encode(buf, src, &jpeg.Options{Quality: 95}))
+
+	// APP1 segment with EXIF containing only the orientation tag
+	exif := []byte{
+		0xFF, 0xE1, 0, 34,
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0,
+		0, 0, 0, 0,
+	}
+
+	data := buf.Bytes()
+
+	// EXIF segment should go right after SOI marker
+	return append(append(append([]byte{}, data[:2]...), exif...), data[2:]...)
+}
+
+// testAnimatedGif returns a black 8x8 GIF with a white pixel at (N, N) in the Nth frame
+func testAnimatedGif(t *testing.T, frames int) *bytes.Buffer {
+	palette := color.Palette{color.Black, color.White}
+
+	anim := gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 8), palette)
+		frame.SetColorIndex(i, i, 1)
+
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(t, gif.EncodeAll(buf, &anim))
+
+	return buf
+}
+
+func testPng(t *testing.T, width, height int) *bytes.Buffer {
+	src := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			src.Set(x, y, color.NRGBA{255, 0, 0, uint8(x * 255 / width)})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(t, png.Encode(buf, src))
+
+	return buf
+}
+
+func TestProcess(t *testing.T) {
+	suite.Run(t, new(ProcessTestSuite))
+}
@@ -28,7 +28,7 @@ func initProcessingHandler() {
 
 	vary := make([]string, 0)
 
-	if conf.EnableWebpDetection || conf.EnforceWebp {
+	if conf.EnableWebpDetection || conf.EnforceWebp || conf.EnableAvifDetection || conf.EnforceAvif {
 		vary = append(vary, "Accept")
 	}
 
@@ -43,17 +43,31 @@ func initProcessingHandler() {
 	headerVaryValue = strings.Join(vary, ", ")
 }
 
-func respondWithImage(ctx context.Context, reqID string, r *http.Request, rw http.ResponseWriter, data []byte) {
-	po := getProcessingOptions(ctx)
-
+// setCacheHeaders sets headers that should be sent with both 200 and 304 responses
+func setCacheHeaders(rw http.ResponseWriter) {
 	rw.Header().Set("Expires", time.Now().Add(time.Second*time.Duration(conf.TTL)).Format(http.TimeFormat))
 	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", conf.TTL))
-	rw.Header().Set("Content-Type", po.Format.Mime())
-	rw.Header().Set("Content-Disposition", po.Format.ContentDisposition(getImageURL(ctx)))
 
 	if len(headerVaryValue) > 0 {
 		rw.Header().Set("Vary", headerVaryValue)
 	}
+}
+
+func respondWithImage(ctx context.Context, reqID string, r *http.Request, rw http.ResponseWriter, statusCode int, data []byte) {
+	po := getProcessingOptions(ctx)
+
+	setCacheHeaders(rw)
+	rw.Header().Set("Content-Type", po.Format.Mime())
+
+	filename := po.Filename
+	if len(filename) == 0 {
+		filename = filenameFromURL(getImageURL(ctx))
+	}
+
+	rw.Header().Set("Content-Disposition", po.Format.ContentDisposition(filename))
+
+	setServerTimingHeader(ctx, rw)
+	setCropBoxHeader(ctx, rw)
 
 	if conf.GZipCompression > 0 && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 		buf := responseGzipBufPool.Get(0)
@@ -68,19 +82,31 @@ func respondWithImage(ctx context.Context, reqID string, r *http.Request, rw htt
 		rw.Header().Set("Content-Encoding", "gzip")
 		rw.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
 
-		rw.WriteHeader(200)
+		rw.WriteHeader(statusCode)
 		rw.Write(buf.Bytes())
 	} else {
 		rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
-		rw.WriteHeader(200)
+		rw.WriteHeader(statusCode)
 		rw.Write(data)
 	}
 
-	logResponse(reqID, 200, fmt.Sprintf("Processed in %s: %s; %+v", getTimerSince(ctx), getImageURL(ctx), po))
+	duration := getTimerSince(ctx)
+
+	logResponseWithFields(
+		reqID, statusCode,
+		fmt.Sprintf("Processed in %s: %s; %+v", duration, getImageURL(ctx), po),
+		logFields{
+			"request_url":        r.URL.RequestURI(),
+			"image_url":          getImageURL(ctx),
+			"processing_options": fmt.Sprintf("%+v", po),
+			"output_size":        len(data),
+			"duration":           duration.Seconds(),
+		},
+	)
 }
 
 func handleProcessing(reqID string, rw http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+	ctx := withRequestID(context.Background(), reqID)
 
 	if newRelicEnabled {
 		var newRelicCancel context.CancelFunc
@@ -90,21 +116,47 @@ func handleProcessing(reqID string, rw http.ResponseWriter, r *http.Request) {
 
 	if prometheusEnabled {
 		prometheusRequestsTotal.Inc()
+		prometheusRequestsInProgress.Inc()
+		defer prometheusRequestsInProgress.Dec()
 		defer startPrometheusDuration(prometheusRequestDuration)()
 	}
 
+	if prometheusEnabled {
+		prometheusRequestsInQueue.Inc()
+	}
+
 	processingSem <- struct{}{}
 	defer func() { <-processingSem }()
 
+	if prometheusEnabled {
+		prometheusRequestsInQueue.Dec()
+	}
+
 	ctx, timeoutCancel := startTimer(ctx, time.Duration(conf.WriteTimeout)*time.Second)
 	defer timeoutCancel()
 
+	ctx = startServerTiming(ctx)
+	ctx = startCropBox(ctx)
+
 	ctx, err := parsePath(ctx, r)
 	if err != nil {
 		panic(err)
 	}
 
-	ctx, downloadcancel, err := downloadImage(ctx)
+	statusCode := 200
+	fallbackUsed := false
+
+	var downloadcancel context.CancelFunc
+
+	if conf.StreamSource {
+		ctx = context.WithValue(ctx, streamSourceCtxKey, true)
+	}
+
+	if r.Method == http.MethodPost {
+		ctx, downloadcancel, err = readRequestBody(ctx, r)
+	} else {
+		ctx, downloadcancel, err = downloadImage(ctx)
+	}
 	defer downloadcancel()
 	if err != nil {
 		if newRelicEnabled {
@@ -113,16 +165,30 @@ func handleProcessing(reqID string, rw http.ResponseWriter, r *http.Request) {
 		if prometheusEnabled {
 			incrementPrometheusErrorsTotal("download")
 		}
-		panic(err)
+
+		fbData, fbType, fbStatusCode := fallbackImageFor(err)
+		if fbData == nil {
+			panic(err)
+		}
+
+		logRequestWarning(reqID, "Can't download source image, fallback image is used: %s", err)
+
+		ctx = withFallbackImage(ctx, fbData, fbType)
+		statusCode = fbStatusCode
+		fallbackUsed = true
+	} else if prometheusEnabled && getImageStream(ctx) == nil {
+		prometheusSourceBytesTotal.Add(float64(getImageData(ctx).Len()))
 	}
 
 	checkTimeout(ctx)
 
-	if conf.ETagEnabled {
+	// ETag of the fallback image doesn't describe the requested source image
+	if conf.ETagEnabled && !fallbackUsed {
 		eTag := calcETag(ctx)
 		rw.Header().Set("ETag", eTag)
 
-		if eTag == r.Header.Get("If-None-Match") {
+		if eTagMatches(r.Header.Get("If-None-Match"), eTag) {
+			setCacheHeaders(rw)
 			logResponse(reqID, 304, "Not modified")
 			rw.WriteHeader(304)
 			return
@@ -133,6 +199,18 @@ func handleProcessing(reqID string, rw http.ResponseWriter, r *http.Request) {
 
 	imageData, processcancel, err := processImage(ctx)
 	defer processcancel()
+
+	if stream := getImageStream(ctx); stream != nil {
+		// Errors of reading the stream are hidden by libvips errors
+		if err != nil && stream.err != nil {
+			err = stream.err
+		}
+
+		if prometheusEnabled {
+			prometheusSourceBytesTotal.Add(float64(stream.Len()))
+		}
+	}
+
 	if err != nil {
 		if newRelicEnabled {
 			sendErrorToNewRelic(ctx, err)
@@ -140,10 +218,30 @@ func handleProcessing(reqID string, rw http.ResponseWriter, r *http.Request) {
 		if prometheusEnabled {
 			incrementPrometheusErrorsTotal("processing")
 		}
-		panic(err)
+
+		fbData, fbType, fbStatusCode := fallbackImageFor(err)
+		if fbData == nil || fallbackUsed {
+			panic(err)
+		}
+
+		logRequestWarning(reqID, "Can't process source image, fallback image is used: %s", err)
+
+		ctx = withFallbackImage(ctx, fbData, fbType)
+		statusCode = fbStatusCode
+		rw.Header().Del("ETag")
+
+		imageData, processcancel, err = processImage(ctx)
+		defer processcancel()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if prometheusEnabled {
+		prometheusResultBytesTotal.Add(float64(len(imageData)))
 	}
 
 	checkTimeout(ctx)
 
-	respondWithImage(ctx, reqID, r, rw, imageData)
+	respondWithImage(ctx, reqID, r, rw, statusCode, imageData)
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProcessingHandlerTestSuite struct{ MainTestSuite }
+
+func (s *ProcessingHandlerTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	conf.AllowInsecure = true
+	initProcessingHandler()
+}
+
+func (s *ProcessingHandlerTestSuite) TearDownTest() {
+	s.MainTestSuite.TearDownTest()
+
+	fallbackImageData = nil
+	fallbackImageType = imageTypeUnknown
+
+	unsupportedFallbackImageData = nil
+	unsupportedFallbackImageType = imageTypeUnknown
+}
+
+func (s *ProcessingHandlerTestSuite) brokenSourcePath() string {
+	// Data URI with invalid image data
+	url := base64.RawURLEncoding.EncodeToString([]byte("data:image/png;base64,AAAA"))
+	return "/unsafe/rs:fit:4:4/" + url + ".png"
+}
+
+func (s *ProcessingHandlerTestSuite) TestFallbackImage() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+
+	fallbackImageData = data.Bytes()
+	fallbackImageType = imageTypePNG
+	conf.FallbackImageHTTPCode = 404
+
+	rw := httptest.NewRecorder()
+	handleProcessing("test", rw, httptest.NewRequest(http.MethodGet, s.brokenSourcePath(), nil))
+
+	assert.Equal(s.T(), 404, rw.Code)
+	assert.Equal(s.T(), "image/png", rw.Header().Get("Content-Type"))
+
+	img, err := png.Decode(rw.Body)
+	require.Nil(s.T(), err)
+
+	// The fallback image is processed with the requested options
+	assert.Equal(s.T(), image.Rect(0, 0, 4, 4), img.Bounds())
+}
+
+func (s *ProcessingHandlerTestSuite) TestUnsupportedFallbackImage() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+
+	fallbackImageData = []byte("not used")
+	fallbackImageType = imageTypePNG
+	conf.FallbackImageHTTPCode = 404
+
+	unsupportedFallbackImageData = data.Bytes()
+	unsupportedFallbackImageType = imageTypePNG
+	conf.UnsupportedFallbackImageHTTPCode = 415
+
+	url := base64.RawURLEncoding.EncodeToString([]byte("data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("lorem ipsum"))))
+
+	rw := httptest.NewRecorder()
+	handleProcessing("test", rw, httptest.NewRequest(http.MethodGet, "/unsafe/rs:fit:4:4/"+url+".png", nil))
+
+	assert.Equal(s.T(), 415, rw.Code)
+
+	img, err := png.Decode(rw.Body)
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), image.Rect(0, 0, 4, 4), img.Bounds())
+}
+
+func (s *ProcessingHandlerTestSuite) TestUnsupportedFallbackImageNotUsed() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+
+	unsupportedFallbackImageData = data.Bytes()
+	unsupportedFallbackImageType = imageTypePNG
+
+	// The source image is broken but its type is supported
+	assert.Panics(s.T(), func() {
+		handleProcessing("test", httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, s.brokenSourcePath(), nil))
+	})
+}
+
+func (s *ProcessingHandlerTestSuite) TestNoFallbackImage() {
+	assert.Panics(s.T(), func() {
+		handleProcessing("test", httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, s.brokenSourcePath(), nil))
+	})
+}
+
+func (s *ProcessingHandlerTestSuite) TestPostSource() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+
+	req := httptest.NewRequest(http.MethodPost, "/unsafe/rs:fit:4:4/upload.png", data)
+	req.Header.Set("Content-Type", "image/png")
+
+	rw := httptest.NewRecorder()
+	handleProcessing("test", rw, req)
+
+	assert.Equal(s.T(), 200, rw.Code)
+	assert.Equal(s.T(), "image/png", rw.Header().Get("Content-Type"))
+
+	img, err := png.Decode(rw.Body)
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), image.Rect(0, 0, 4, 4), img.Bounds())
+}
+
+func (s *ProcessingHandlerTestSuite) TestPostSourceTooBig() {
+	data := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(data, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+
+	conf.MaxSrcFileSize = data.Len() - 1
+
+	req := httptest.NewRequest(http.MethodPost, "/unsafe/rs:fit:4:4/upload.png", data)
+
+	assert.PanicsWithValue(s.T(), errSourceFileTooBig, func() {
+		handleProcessing("test", httptest.NewRecorder(), req)
+	})
+}
+
+func TestProcessingHandler(t *testing.T) {
+	suite.Run(t, new(ProcessingHandlerTestSuite))
+}
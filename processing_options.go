@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -12,7 +13,12 @@ import (
 	"strings"
 )
 
-type urlOptions map[string][]string
+type urlOption struct {
+	Name string
+	Args []string
+}
+
+type urlOptions []urlOption
 
 type processingHeaders struct {
 	Accept        string
@@ -52,6 +58,39 @@ var gravityTypes = map[string]gravityType{
 	"fp":   gravityFocusPoint,
 }
 
+var (
+	verticalGravities   = map[string]string{"no": "no", "so": "so", "ce": ""}
+	horizontalGravities = map[string]string{"we": "we", "ea": "ea", "ce": ""}
+)
+
+type tiffCompression int
+
+const (
+	tiffCompressionNone tiffCompression = iota
+	tiffCompressionLZW
+	tiffCompressionDeflate
+	tiffCompressionJPEG
+)
+
+var tiffCompressions = map[string]tiffCompression{
+	"none":    tiffCompressionNone,
+	"lzw":     tiffCompressionLZW,
+	"deflate": tiffCompressionDeflate,
+	"jpeg":    tiffCompressionJPEG,
+}
+
+type smartCropStrategy int
+
+const (
+	smartCropAttention smartCropStrategy = iota
+	smartCropEntropy
+)
+
+var smartCropStrategies = map[string]smartCropStrategy{
+	"attention": smartCropAttention,
+	"entropy":   smartCropEntropy,
+}
+
 type resizeType int
 
 const (
@@ -59,18 +98,57 @@ const (
 	resizeFill
 	resizeCrop
 	resizeAuto
+	resizeForce
+	resizeMin
+	resizeFillDown
 )
 
 var resizeTypes = map[string]resizeType{
-	"fit":  resizeFit,
-	"fill": resizeFill,
-	"crop": resizeCrop,
-	"auto": resizeAuto,
+	"fit":       resizeFit,
+	"fill":      resizeFill,
+	"crop":      resizeCrop,
+	"auto":      resizeAuto,
+	"force":     resizeForce,
+	"min":       resizeMin,
+	"fill-down": resizeFillDown,
+}
+
+type resizeKernel int
+
+const (
+	resizeKernelLanczos3 resizeKernel = iota
+	resizeKernelCubic
+	resizeKernelLinear
+	resizeKernelNearest
+)
+
+var resizeKernels = map[string]resizeKernel{
+	"lanczos3": resizeKernelLanczos3,
+	"cubic":    resizeKernelCubic,
+	"linear":   resizeKernelLinear,
+	"nearest":  resizeKernelNearest,
+}
+
+type jpegSubsample int
+
+const (
+	jpegSubsample420 jpegSubsample = iota
+	jpegSubsample444
+)
+
+var jpegSubsamples = map[string]jpegSubsample{
+	"4:2:0": jpegSubsample420,
+	"420":   jpegSubsample420,
+	"4:4:4": jpegSubsample444,
+	"444":   jpegSubsample444,
 }
 
 type rgbColor struct{ R, G, B uint8 }
 
-var hexColorRegex = regexp.MustCompile("^([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$")
+var (
+	hexColorRegex = regexp.MustCompile("^([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$")
+	rgbColorRegex = regexp.MustCompile(`^rgb\(\s*(\d{1,3})\s*,\s*(\d{1,3})\s*,\s*(\d{1,3})\s*\)$`)
+)
 
 const (
 	hexColorLongFormat  = "%02x%02x%02x"
@@ -78,8 +156,9 @@ const (
 )
 
 type gravityOptions struct {
-	Type gravityType
-	X, Y float64
+	Type     gravityType
+	X, Y     float64
+	Strategy smartCropStrategy
 }
 
 type cropOptions struct {
@@ -88,6 +167,39 @@ type cropOptions struct {
 	Gravity gravityOptions
 }
 
+type aspectRatioOptions struct {
+	Width  float64
+	Height float64
+	Pad    bool
+}
+
+type trimOptions struct {
+	Enabled   bool
+	Threshold float64
+	Color     rgbColor
+	HasColor  bool
+}
+
+type pngOptions struct {
+	Compression        int
+	Interlaced         bool
+	Quantize           bool
+	QuantizationColors int
+	QuantizationDither float64
+}
+
+type borderOptions struct {
+	Width int
+	Color rgbColor
+}
+
+type paddingOptions struct {
+	Top    int
+	Right  int
+	Bottom int
+	Left   int
+}
+
 type watermarkOptions struct {
 	Enabled   bool
 	Opacity   float64
@@ -100,26 +212,68 @@ type watermarkOptions struct {
 
 type processingOptions struct {
 	Resize     resizeType
+	Kernel     resizeKernel
 	Width      int
 	Height     int
+	MaxWidth   int
+	MaxHeight  int
 	Dpr        float64
+	Scale      float64
 	Gravity    gravityOptions
 	Enlarge    bool
 	Extend     bool
 	Crop       cropOptions
+	Trim       trimOptions
+	Rotate     int
+	Flip       bool
+	Flop       bool
+	Grayscale  bool
+	Sepia      float64
+	Invert     bool
 	Format     imageType
 	Quality    int
+	MaxBytes   int
 	Flatten    bool
 	Background rgbColor
 	Blur       float32
 	Sharpen    float32
+	Pixelate   int
+	Brightness int
+	Contrast   float64
+	Saturation float64
+
+	AspectRatio           aspectRatioOptions
+	TransparentBackground bool
+	NoAntialias           bool
+
+	StripMetadata bool
+	Progressive   bool
+	Subsample     jpegSubsample
+	PngOptions    pngOptions
+
+	TiffCompression tiffCompression
+	IcoSizes        []int
+
+	// SaveOptionsSet is true when quality or any of the save options is set explicitly
+	SaveOptionsSet bool
+
+	Border       borderOptions
+	Padding      paddingOptions
+	CornerRadius int
+
+	Frame        int
+	ExtractFrame bool
+	Page         int
 
 	CacheBuster string
+	Filename    string
 
 	Watermark watermarkOptions
 
 	PreferWebP  bool
 	EnforceWebP bool
+	PreferAvif  bool
+	EnforceAvif bool
 
 	UsedPresets []string
 }
@@ -128,7 +282,10 @@ const (
 	imageURLCtxKey          = ctxKey("imageUrl")
 	processingOptionsCtxKey = ctxKey("processingOptions")
 	urlTokenPlain           = "plain"
-	maxClientHintDPR        = 8
+	urlTokenUpload          = "upload"
+	maxSharpenSigma         = 10
+	maxAspectRatio          = 100
+	minMaxBytesQuality      = 10
 
 	msgForbidden  = "Forbidden"
 	msgInvalidURL = "Invalid URL"
@@ -139,6 +296,8 @@ var (
 	errInvalidURLEncoding                 = errors.New("Invalid url encoding")
 	errResultingImageFormatIsNotSupported = errors.New("Resulting image format is not supported")
 	errInvalidPath                        = newError(404, "Invalid path", msgInvalidURL)
+	errResultDimensionsTooBig             = newError(422, "Resulting image dimensions are too big", "Invalid processing options")
+	errResultResolutionTooBig             = newError(422, "Resulting image resolution is too big", "Invalid processing options")
 )
 
 func (gt gravityType) String() string {
@@ -191,6 +350,29 @@ func colorFromHex(hexcolor string) (rgbColor, error) {
 	return c, nil
 }
 
+// colorFromString parses color in hex (`fff` or `ffffff`) or `rgb(r,g,b)` format
+func colorFromString(str string) (rgbColor, error) {
+	if m := rgbColorRegex.FindStringSubmatch(str); m != nil {
+		c := make([]uint8, 3)
+
+		for i := range c {
+			v, err := strconv.Atoi(m[i+1])
+			if err != nil || v > 255 {
+				return rgbColor{}, fmt.Errorf("Invalid color: %s. Channel values should be between 0 and 255", str)
+			}
+			c[i] = uint8(v)
+		}
+
+		return rgbColor{c[0], c[1], c[2]}, nil
+	}
+
+	if c, err := colorFromHex(str); err == nil {
+		return c, nil
+	}
+
+	return rgbColor{}, fmt.Errorf("Invalid color: %s. Expected hex color (fff or ffffff) or rgb(r,g,b)", str)
+}
+
 func decodeBase64URL(parts []string) (string, string, error) {
 	var format string
 
@@ -221,17 +403,16 @@ func decodeBase64URL(parts []string) (string, string, error) {
 func decodePlainURL(parts []string) (string, string, error) {
 	var format string
 
-	urlParts := strings.Split(strings.Join(parts, "/"), "@")
+	plainURL := strings.Join(parts, "/")
 
-	if len(urlParts) > 2 {
-		return "", "", errInvalidURLEncoding
-	}
-
-	if len(urlParts) == 2 && len(urlParts[1]) > 0 {
-		format = urlParts[1]
+	// Source URL may contain "@" too, so the part after the last "@"
+	// is treated as a format only when it's a known format
+	if ind := strings.LastIndex(plainURL, "@"); ind >= 0 && isKnownExtension(plainURL[ind+1:]) {
+		format = plainURL[ind+1:]
+		plainURL = plainURL[:ind]
 	}
 
-	if unescaped, err := url.PathUnescape(urlParts[0]); err == nil {
+	if unescaped, err := url.PathUnescape(plainURL); err == nil {
 		fullURL := fmt.Sprintf("%s%s", conf.BaseURL, unescaped)
 		if _, err := url.ParseRequestURI(fullURL); err == nil {
 			return fullURL, format, nil
@@ -241,6 +422,37 @@ func decodePlainURL(parts []string) (string, string, error) {
 	return "", "", errInvalidImageURL
 }
 
+// decodeUploadURL parses the upload token of the POST request path. Uploaded images don't
+// have the source URL, so the token itself is used as the image URL
+func decodeUploadURL(token string) (string, string, error) {
+	var format string
+
+	if ind := strings.IndexByte(token, '.'); ind >= 0 {
+		token, format = token[:ind], token[ind+1:]
+	}
+
+	if token != urlTokenUpload {
+		return "", "", errInvalidImageURL
+	}
+
+	return urlTokenUpload, format, nil
+}
+
+func isKnownExtension(extension string) bool {
+	_, ok := imageTypes[strings.ToLower(extension)]
+	return ok
+}
+
+// applyExtensionFormat sets the resulting format by the URL extension.
+// The format option takes precedence over the extension, and unknown extensions are ignored
+func applyExtensionFormat(po *processingOptions, extension string) error {
+	if len(extension) == 0 || po.Format != imageTypeUnknown || !isKnownExtension(extension) {
+		return nil
+	}
+
+	return applyFormatOption(po, []string{strings.ToLower(extension)})
+}
+
 func decodeURL(parts []string) (string, string, error) {
 	if len(parts) == 0 {
 		return "", "", errInvalidURLEncoding
@@ -250,6 +462,10 @@ func decodeURL(parts []string) (string, string, error) {
 		return decodePlainURL(parts[1:])
 	}
 
+	if len(parts) == 1 && (parts[0] == urlTokenUpload || strings.HasPrefix(parts[0], urlTokenUpload+".")) {
+		return decodeUploadURL(parts[0])
+	}
+
 	return decodeBase64URL(parts)
 }
 
@@ -271,7 +487,36 @@ func isGravityOffcetValid(gravity gravityType, offset float64) bool {
 	return offset >= 0 && (gravity != gravityFocusPoint || offset <= 1)
 }
 
+// combineGravities combines vertical (`no`, `so`, `ce`) and horizontal (`we`, `ea`, `ce`)
+// gravity components that can be set in any order
+func combineGravities(first, second string) (gravityType, bool) {
+	v, vok := verticalGravities[first]
+	h, hok := horizontalGravities[second]
+
+	if !vok || !hok {
+		v, vok = verticalGravities[second]
+		h, hok = horizontalGravities[first]
+	}
+
+	if !vok || !hok {
+		return gravityUnknown, false
+	}
+
+	if len(v) == 0 && len(h) == 0 {
+		return gravityCenter, true
+	}
+
+	return gravityTypes[v+h], true
+}
+
 func parseGravity(g *gravityOptions, args []string) error {
+	// Gravity can be set with two components, e.g. `no:we`
+	if len(args) > 1 {
+		if t, ok := combineGravities(args[0], args[1]); ok {
+			args = append([]string{t.String()}, args[2:]...)
+		}
+	}
+
 	nArgs := len(args)
 
 	if nArgs > 3 {
@@ -284,12 +529,29 @@ func parseGravity(g *gravityOptions, args []string) error {
 		return fmt.Errorf("Invalid gravity: %s", args[0])
 	}
 
-	if g.Type == gravitySmart && nArgs > 1 {
-		return fmt.Errorf("Invalid gravity arguments: %v", args)
-	} else if g.Type == gravityFocusPoint && nArgs != 3 {
+	if g.Type == gravitySmart {
+		if nArgs > 2 {
+			return fmt.Errorf("Invalid gravity arguments: %v", args)
+		}
+
+		if nArgs > 1 {
+			if s, ok := smartCropStrategies[args[1]]; ok {
+				g.Strategy = s
+			} else {
+				return fmt.Errorf("Invalid smart crop strategy: %s", args[1])
+			}
+		}
+
+		return nil
+	} else if g.Type == gravityFocusPoint && nArgs == 2 {
 		return fmt.Errorf("Invalid gravity arguments: %v", args)
 	}
 
+	if g.Type == gravityFocusPoint && nArgs == 1 {
+		// Focus point without coordinates acts like the center gravity
+		g.X, g.Y = 0.5, 0.5
+	}
+
 	if nArgs > 1 {
 		if x, err := strconv.ParseFloat(args[1], 64); err == nil && isGravityOffcetValid(g.Type, x) {
 			g.X = x
@@ -325,6 +587,22 @@ func applyHeightOption(po *processingOptions, args []string) error {
 	return parseDimension(&po.Height, "height", args[0])
 }
 
+func applyMaxWidthOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid max width arguments: %v", args)
+	}
+
+	return parseDimension(&po.MaxWidth, "max width", args[0])
+}
+
+func applyMaxHeightOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid max height arguments: %v", args)
+	}
+
+	return parseDimension(&po.MaxHeight, "max height", args[0])
+}
+
 func applyEnlargeOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
 		return fmt.Errorf("Invalid enlarge arguments: %v", args)
@@ -417,7 +695,7 @@ func applyDprOption(po *processingOptions, args []string) error {
 	}
 
 	if d, err := strconv.ParseFloat(args[0], 64); err == nil && d > 0 {
-		po.Dpr = d
+		po.Dpr = math.Min(d, conf.MaxDpr)
 	} else {
 		return fmt.Errorf("Invalid dpr: %s", args[0])
 	}
@@ -425,12 +703,60 @@ func applyDprOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyScaleOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid scale arguments: %v", args)
+	}
+
+	if s, err := strconv.ParseFloat(args[0], 64); err == nil && s > 0 {
+		po.Scale = s
+	} else {
+		return fmt.Errorf("Invalid scale: %s", args[0])
+	}
+
+	return nil
+}
+
 func applyGravityOption(po *processingOptions, args []string) error {
 	return parseGravity(&po.Gravity, args)
 }
 
+func applyAspectRatioOption(po *processingOptions, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf("Invalid aspect ratio arguments: %v", args)
+	}
+
+	if w, err := strconv.ParseFloat(args[0], 64); err == nil && w >= 0 {
+		po.AspectRatio.Width = w
+	} else {
+		return fmt.Errorf("Invalid aspect ratio width: %s", args[0])
+	}
+
+	if h, err := strconv.ParseFloat(args[1], 64); err == nil && h >= 0 {
+		po.AspectRatio.Height = h
+	} else {
+		return fmt.Errorf("Invalid aspect ratio height: %s", args[1])
+	}
+
+	// Zero disables aspect ratio
+	if (po.AspectRatio.Width == 0) != (po.AspectRatio.Height == 0) {
+		return fmt.Errorf("Invalid aspect ratio arguments: %v", args)
+	}
+
+	// Extreme aspect ratios produce huge padded areas, so they're limited
+	if po.AspectRatio.Width > po.AspectRatio.Height*maxAspectRatio {
+		po.AspectRatio.Width = po.AspectRatio.Height * maxAspectRatio
+	} else if po.AspectRatio.Height > po.AspectRatio.Width*maxAspectRatio {
+		po.AspectRatio.Height = po.AspectRatio.Width * maxAspectRatio
+	}
+
+	po.AspectRatio.Pad = len(args) > 2 && args[2] != "0"
+
+	return nil
+}
+
 func applyCropOption(po *processingOptions, args []string) error {
-	if len(args) > 5 {
+	if len(args) > 6 {
 		return fmt.Errorf("Invalid crop arguments: %v", args)
 	}
 
@@ -451,6 +777,86 @@ func applyCropOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyTrimOption(po *processingOptions, args []string) error {
+	nArgs := len(args)
+
+	if nArgs > 2 {
+		return fmt.Errorf("Invalid trim arguments: %v", args)
+	}
+
+	if t, err := strconv.ParseFloat(args[0], 64); err == nil && t >= 0 {
+		po.Trim.Enabled = true
+		po.Trim.Threshold = t
+	} else {
+		return fmt.Errorf("Invalid trim threshold: %s", args[0])
+	}
+
+	if nArgs > 1 && len(args[1]) > 0 {
+		if c, err := colorFromString(args[1]); err == nil {
+			po.Trim.Color = c
+			po.Trim.HasColor = true
+		} else {
+			return fmt.Errorf("Invalid trim color: %s", args[1])
+		}
+	}
+
+	return nil
+}
+
+func applyRotateOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid rotate arguments: %v", args)
+	}
+
+	if r, err := strconv.Atoi(args[0]); err == nil {
+		po.Rotate = (r%360 + 360) % 360
+	} else {
+		return fmt.Errorf("Invalid rotation angle: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyFlipOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid flip arguments: %v", args)
+	}
+
+	po.Flip = args[0] != "0"
+
+	return nil
+}
+
+func applyFlopOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid flop arguments: %v", args)
+	}
+
+	po.Flop = args[0] != "0"
+
+	return nil
+}
+
+func applyGrayscaleOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid grayscale arguments: %v", args)
+	}
+
+	po.Grayscale = args[0] != "0"
+
+	return nil
+}
+
+func applyInvertOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid invert arguments: %v", args)
+	}
+
+	po.Invert = args[0] != "0"
+
+	return nil
+}
+
 func applyQualityOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
 		return fmt.Errorf("Invalid quality arguments: %v", args)
@@ -458,6 +864,7 @@ func applyQualityOption(po *processingOptions, args []string) error {
 
 	if q, err := strconv.Atoi(args[0]); err == nil && q > 0 && q <= 100 {
 		po.Quality = q
+		po.SaveOptionsSet = true
 	} else {
 		return fmt.Errorf("Invalid quality: %s", args[0])
 	}
@@ -465,12 +872,193 @@ func applyQualityOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyMaxBytesOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid max bytes arguments: %v", args)
+	}
+
+	if max, err := strconv.Atoi(args[0]); err == nil && max >= 0 {
+		po.MaxBytes = max
+	} else {
+		return fmt.Errorf("Invalid max bytes: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyStripMetadataOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid strip metadata arguments: %v", args)
+	}
+
+	po.StripMetadata = args[0] != "0"
+
+	return nil
+}
+
+func applyProgressiveOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid progressive arguments: %v", args)
+	}
+
+	po.Progressive = args[0] != "0"
+	po.SaveOptionsSet = true
+
+	return nil
+}
+
+func applyKernelOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid kernel arguments: %v", args)
+	}
+
+	if k, ok := resizeKernels[args[0]]; ok {
+		po.Kernel = k
+	} else {
+		return fmt.Errorf("Invalid kernel: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyAntialiasOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid antialias arguments: %v", args)
+	}
+
+	po.NoAntialias = args[0] == "0"
+
+	return nil
+}
+
+func applySubsampleOption(po *processingOptions, args []string) error {
+	// Subsample modes like 4:4:4 are split by the arguments separator, so we join them back
+	mode := strings.Join(args, ":")
+
+	if s, ok := jpegSubsamples[mode]; ok {
+		po.Subsample = s
+		po.SaveOptionsSet = true
+	} else {
+		return fmt.Errorf("Invalid subsample mode: %s", mode)
+	}
+
+	return nil
+}
+
+func applyPngOptionsOption(po *processingOptions, args []string) error {
+	if len(args) > 5 {
+		return fmt.Errorf("Invalid png options arguments: %v", args)
+	}
+
+	if len(args[0]) > 0 {
+		if c, err := strconv.Atoi(args[0]); err == nil && c >= 0 && c <= 9 {
+			po.PngOptions.Compression = c
+		} else {
+			return fmt.Errorf("Invalid png compression: %s", args[0])
+		}
+	}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		po.PngOptions.Interlaced = args[1] != "0"
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		po.PngOptions.Quantize = args[2] != "0"
+	}
+
+	if len(args) > 3 && len(args[3]) > 0 {
+		if c, err := strconv.Atoi(args[3]); err == nil && c >= 2 && c <= 256 {
+			po.PngOptions.QuantizationColors = c
+		} else {
+			return fmt.Errorf("Invalid png quantization colors: %s", args[3])
+		}
+	}
+
+	if len(args) > 4 && len(args[4]) > 0 {
+		if d, err := strconv.ParseFloat(args[4], 64); err == nil && d >= 0 && d <= 1 {
+			po.PngOptions.QuantizationDither = d
+		} else {
+			return fmt.Errorf("Invalid png quantization dither: %s", args[4])
+		}
+	}
+
+	po.SaveOptionsSet = true
+
+	return nil
+}
+
+func applyTiffCompressionOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid tiff compression arguments: %v", args)
+	}
+
+	if c, ok := tiffCompressions[args[0]]; ok {
+		po.TiffCompression = c
+		po.SaveOptionsSet = true
+	} else {
+		return fmt.Errorf("Invalid tiff compression: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyIcoSizesOption(po *processingOptions, args []string) error {
+	sizes := make([]int, 0, len(args))
+
+	for _, arg := range args {
+		if s, err := strconv.Atoi(arg); err == nil && s > 0 && s <= icoMaxSize {
+			sizes = append(sizes, s)
+		} else {
+			return fmt.Errorf("Invalid ico size: %s", arg)
+		}
+	}
+
+	po.IcoSizes = sizes
+	po.SaveOptionsSet = true
+
+	return nil
+}
+
+func applyFrameOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid frame arguments: %v", args)
+	}
+
+	if f, err := strconv.Atoi(args[0]); err == nil && f >= 0 {
+		po.Frame = f
+		po.ExtractFrame = true
+	} else {
+		return fmt.Errorf("Invalid frame: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyPageOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid page arguments: %v", args)
+	}
+
+	if p, err := strconv.Atoi(args[0]); err == nil && p >= 0 {
+		po.Page = p
+	} else {
+		return fmt.Errorf("Invalid page: %s", args[0])
+	}
+
+	return nil
+}
+
 func applyBackgroundOption(po *processingOptions, args []string) error {
 	switch len(args) {
 	case 1:
+		po.TransparentBackground = false
+
 		if len(args[0]) == 0 {
 			po.Flatten = false
-		} else if c, err := colorFromHex(args[0]); err == nil {
+		} else if args[0] == "transparent" {
+			po.Flatten = false
+			po.TransparentBackground = true
+		} else if c, err := colorFromString(args[0]); err == nil {
 			po.Flatten = true
 			po.Background = c
 		} else {
@@ -479,6 +1067,7 @@ func applyBackgroundOption(po *processingOptions, args []string) error {
 
 	case 3:
 		po.Flatten = true
+		po.TransparentBackground = false
 
 		if r, err := strconv.ParseUint(args[0], 10, 8); err == nil && r <= 255 {
 			po.Background.R = uint8(r)
@@ -525,7 +1114,7 @@ func applySharpenOption(po *processingOptions, args []string) error {
 	}
 
 	if s, err := strconv.ParseFloat(args[0], 32); err == nil && s >= 0 {
-		po.Sharpen = float32(s)
+		po.Sharpen = float32(math.Min(s, maxSharpenSigma))
 	} else {
 		return fmt.Errorf("Invalid sharpen: %s", args[0])
 	}
@@ -615,7 +1204,177 @@ func applyFormatOption(po *processingOptions, args []string) error {
 	}
 
 	if !vipsTypeSupportSave[po.Format] {
-		return errResultingImageFormatIsNotSupported
+		f, err := formatFallback(po.Format)
+		if err != nil {
+			return err
+		}
+
+		po.Format = f
+	}
+
+	return nil
+}
+
+// formatFallback follows IMGPROXY_FORMAT_FALLBACKS chain until it finds
+// a format that can be saved by libvips
+func formatFallback(format imageType) (imageType, error) {
+	if conf.StrictFormat {
+		return imageTypeUnknown, errResultingImageFormatIsNotSupported
+	}
+
+	f := format
+
+	// Chain can't be longer than the number of fallbacks, so we don't loop forever
+	for i := 0; i < len(conf.FormatFallbacks); i++ {
+		next, ok := conf.FormatFallbacks[f]
+		if !ok {
+			break
+		}
+
+		if vipsTypeSupportSave[next] {
+			logWarning("Saving %s is not supported by libvips, falling back to %s", format, next)
+			return next, nil
+		}
+
+		f = next
+	}
+
+	return imageTypeUnknown, errResultingImageFormatIsNotSupported
+}
+
+func applyPixelateOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid pixelate arguments: %v", args)
+	}
+
+	if p, err := strconv.Atoi(args[0]); err == nil && p >= 1 {
+		po.Pixelate = p
+	} else {
+		return fmt.Errorf("Invalid pixelate: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyBrightnessOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid brightness arguments: %v", args)
+	}
+
+	if b, err := strconv.Atoi(args[0]); err == nil && b >= -255 && b <= 255 {
+		po.Brightness = b
+	} else {
+		return fmt.Errorf("Invalid brightness: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyContrastOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid contrast arguments: %v", args)
+	}
+
+	if c, err := strconv.ParseFloat(args[0], 64); err == nil && c >= 0 {
+		po.Contrast = c
+	} else {
+		return fmt.Errorf("Invalid contrast: %s", args[0])
+	}
+
+	return nil
+}
+
+func applySepiaOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid sepia arguments: %v", args)
+	}
+
+	if s, err := strconv.ParseFloat(args[0], 64); err == nil && s >= 0 && s <= 1 {
+		po.Sepia = s
+	} else {
+		return fmt.Errorf("Invalid sepia: %s", args[0])
+	}
+
+	return nil
+}
+
+func applySaturationOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid saturation arguments: %v", args)
+	}
+
+	if s, err := strconv.ParseFloat(args[0], 64); err == nil && s >= 0 {
+		po.Saturation = s
+	} else {
+		return fmt.Errorf("Invalid saturation: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyBorderOption(po *processingOptions, args []string) error {
+	nArgs := len(args)
+
+	if nArgs > 2 {
+		return fmt.Errorf("Invalid border arguments: %v", args)
+	}
+
+	if w, err := strconv.Atoi(args[0]); err == nil && w >= 0 {
+		po.Border.Width = w
+	} else {
+		return fmt.Errorf("Invalid border width: %s", args[0])
+	}
+
+	if nArgs > 1 && len(args[1]) > 0 {
+		if c, err := colorFromString(args[1]); err == nil {
+			po.Border.Color = c
+		} else {
+			return fmt.Errorf("Invalid border color: %s", args[1])
+		}
+	}
+
+	return nil
+}
+
+// applyPaddingOption parses CSS-like padding: all, vertical:horizontal, or top:right:bottom:left
+func applyPaddingOption(po *processingOptions, args []string) error {
+	nArgs := len(args)
+
+	if nArgs != 1 && nArgs != 2 && nArgs != 4 {
+		return fmt.Errorf("Invalid padding arguments: %v", args)
+	}
+
+	values := make([]int, nArgs)
+
+	for i, arg := range args {
+		if v, err := strconv.Atoi(arg); err == nil && v >= 0 {
+			values[i] = v
+		} else {
+			return fmt.Errorf("Invalid padding: %s", arg)
+		}
+	}
+
+	switch nArgs {
+	case 1:
+		po.Padding = paddingOptions{values[0], values[0], values[0], values[0]}
+	case 2:
+		po.Padding = paddingOptions{values[0], values[1], values[0], values[1]}
+	case 4:
+		po.Padding = paddingOptions{values[0], values[1], values[2], values[3]}
+	}
+
+	return nil
+}
+
+func applyCornerRadiusOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid corner radius arguments: %v", args)
+	}
+
+	if r, err := strconv.Atoi(args[0]); err == nil && r >= 0 {
+		po.CornerRadius = r
+	} else {
+		return fmt.Errorf("Invalid corner radius: %s", args[0])
 	}
 
 	return nil
@@ -631,6 +1390,21 @@ func applyCacheBusterOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyFilenameOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid filename arguments: %v", args)
+	}
+
+	filename, err := url.PathUnescape(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid filename: %s", args[0])
+	}
+
+	po.Filename = filename
+
+	return nil
+}
+
 func applyProcessingOption(po *processingOptions, name string, args []string) error {
 	switch name {
 	case "format", "f", "ext":
@@ -657,10 +1431,26 @@ func applyProcessingOption(po *processingOptions, name string, args []string) er
 		if err := applyHeightOption(po, args); err != nil {
 			return err
 		}
+	case "maxwidth", "mw":
+		if err := applyMaxWidthOption(po, args); err != nil {
+			return err
+		}
+	case "maxheight", "mh":
+		if err := applyMaxHeightOption(po, args); err != nil {
+			return err
+		}
 	case "enlarge", "el":
 		if err := applyEnlargeOption(po, args); err != nil {
 			return err
 		}
+	case "kernel", "k":
+		if err := applyKernelOption(po, args); err != nil {
+			return err
+		}
+	case "antialias", "aa":
+		if err := applyAntialiasOption(po, args); err != nil {
+			return err
+		}
 	case "extend", "ex":
 		if err := applyExtendOption(po, args); err != nil {
 			return err
@@ -669,6 +1459,10 @@ func applyProcessingOption(po *processingOptions, name string, args []string) er
 		if err := applyDprOption(po, args); err != nil {
 			return err
 		}
+	case "scale":
+		if err := applyScaleOption(po, args); err != nil {
+			return err
+		}
 	case "gravity", "g":
 		if err := applyGravityOption(po, args); err != nil {
 			return err
@@ -677,10 +1471,70 @@ func applyProcessingOption(po *processingOptions, name string, args []string) er
 		if err := applyCropOption(po, args); err != nil {
 			return err
 		}
+	case "aspect_ratio", "ar":
+		if err := applyAspectRatioOption(po, args); err != nil {
+			return err
+		}
+	case "trim", "t":
+		if err := applyTrimOption(po, args); err != nil {
+			return err
+		}
+	case "rotate", "rot":
+		if err := applyRotateOption(po, args); err != nil {
+			return err
+		}
+	case "flip":
+		if err := applyFlipOption(po, args); err != nil {
+			return err
+		}
+	case "flop":
+		if err := applyFlopOption(po, args); err != nil {
+			return err
+		}
+	case "grayscale":
+		if err := applyGrayscaleOption(po, args); err != nil {
+			return err
+		}
+	case "sepia":
+		if err := applySepiaOption(po, args); err != nil {
+			return err
+		}
+	case "invert":
+		if err := applyInvertOption(po, args); err != nil {
+			return err
+		}
 	case "quality", "q":
 		if err := applyQualityOption(po, args); err != nil {
 			return err
 		}
+	case "strip_metadata", "strip":
+		if err := applyStripMetadataOption(po, args); err != nil {
+			return err
+		}
+	case "progressive", "interlace":
+		if err := applyProgressiveOption(po, args); err != nil {
+			return err
+		}
+	case "subsample", "ss":
+		if err := applySubsampleOption(po, args); err != nil {
+			return err
+		}
+	case "png_options", "pngo":
+		if err := applyPngOptionsOption(po, args); err != nil {
+			return err
+		}
+	case "tiff_compression", "tc":
+		if err := applyTiffCompressionOption(po, args); err != nil {
+			return err
+		}
+	case "ico_sizes", "icos":
+		if err := applyIcoSizesOption(po, args); err != nil {
+			return err
+		}
+	case "maxbytes", "mb":
+		if err := applyMaxBytesOption(po, args); err != nil {
+			return err
+		}
 	case "background", "bg":
 		if err := applyBackgroundOption(po, args); err != nil {
 			return err
@@ -693,6 +1547,42 @@ func applyProcessingOption(po *processingOptions, name string, args []string) er
 		if err := applySharpenOption(po, args); err != nil {
 			return err
 		}
+	case "pixelate", "pix":
+		if err := applyPixelateOption(po, args); err != nil {
+			return err
+		}
+	case "brightness", "br":
+		if err := applyBrightnessOption(po, args); err != nil {
+			return err
+		}
+	case "contrast", "co":
+		if err := applyContrastOption(po, args); err != nil {
+			return err
+		}
+	case "saturation", "sa":
+		if err := applySaturationOption(po, args); err != nil {
+			return err
+		}
+	case "border", "bd":
+		if err := applyBorderOption(po, args); err != nil {
+			return err
+		}
+	case "padding", "pad":
+		if err := applyPaddingOption(po, args); err != nil {
+			return err
+		}
+	case "corner_radius", "cr":
+		if err := applyCornerRadiusOption(po, args); err != nil {
+			return err
+		}
+	case "frame", "fr":
+		if err := applyFrameOption(po, args); err != nil {
+			return err
+		}
+	case "page", "pg":
+		if err := applyPageOption(po, args); err != nil {
+			return err
+		}
 	case "watermark", "wm":
 		if err := applyWatermarkOption(po, args); err != nil {
 			return err
@@ -705,6 +1595,10 @@ func applyProcessingOption(po *processingOptions, name string, args []string) er
 		if err := applyCacheBusterOption(po, args); err != nil {
 			return err
 		}
+	case "filename", "fn":
+		if err := applyFilenameOption(po, args); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("Unknown processing option: %s", name)
 	}
@@ -713,8 +1607,8 @@ func applyProcessingOption(po *processingOptions, name string, args []string) er
 }
 
 func applyProcessingOptions(po *processingOptions, options urlOptions) error {
-	for name, args := range options {
-		if err := applyProcessingOption(po, name, args); err != nil {
+	for _, opt := range options {
+		if err := applyProcessingOption(po, opt.Name, opt.Args); err != nil {
 			return err
 		}
 	}
@@ -723,7 +1617,7 @@ func applyProcessingOptions(po *processingOptions, options urlOptions) error {
 }
 
 func parseURLOptions(opts []string) (urlOptions, []string) {
-	parsed := make(urlOptions)
+	parsed := make(urlOptions, 0, len(opts))
 	urlStart := len(opts) + 1
 
 	for i, opt := range opts {
@@ -734,7 +1628,7 @@ func parseURLOptions(opts []string) (urlOptions, []string) {
 			break
 		}
 
-		parsed[args[0]] = args[1:]
+		parsed = append(parsed, urlOption{Name: args[0], Args: args[1:]})
 	}
 
 	var rest []string
@@ -752,19 +1646,33 @@ func defaultProcessingOptions(headers *processingHeaders) (*processingOptions, e
 	var err error
 
 	po := processingOptions{
-		Resize:      resizeFit,
-		Width:       0,
-		Height:      0,
-		Gravity:     gravityOptions{Type: gravityCenter},
-		Enlarge:     false,
-		Quality:     conf.Quality,
-		Format:      imageTypeUnknown,
-		Background:  rgbColor{255, 255, 255},
-		Blur:        0,
-		Sharpen:     0,
-		Dpr:         1,
-		Watermark:   watermarkOptions{Opacity: 1, Replicate: false, Gravity: gravityCenter},
-		UsedPresets: make([]string, 0, len(conf.Presets)),
+		Resize:        resizeFit,
+		Width:         0,
+		Height:        0,
+		Gravity:       gravityOptions{Type: gravityCenter},
+		Enlarge:       conf.Enlarge,
+		Extend:        conf.Extend,
+		StripMetadata: conf.StripMetadata,
+		Progressive:   conf.JpegProgressive,
+		Subsample:     jpegSubsamples[conf.JpegSubsample],
+		Kernel:        resizeKernels[conf.ResizeKernel],
+		Format:        imageTypeUnknown,
+		Background:    rgbColor{255, 255, 255},
+		Blur:          0,
+		Sharpen:       0,
+		Contrast:      1,
+		Saturation:    1,
+		Dpr:           1,
+		Watermark:     watermarkOptions{Opacity: 1, Replicate: false, Gravity: gravityCenter},
+		UsedPresets:   make([]string, 0, len(conf.Presets)),
+		PngOptions: pngOptions{
+			Compression:        conf.PngCompression,
+			Interlaced:         conf.PngInterlaced,
+			Quantize:           conf.PngQuantize,
+			QuantizationColors: conf.PngQuantizationColors,
+			QuantizationDither: conf.PngQuantizationDither,
+		},
+		TiffCompression: tiffCompressions[conf.TiffCompression],
 	}
 
 	if strings.Contains(headers.Accept, "image/webp") {
@@ -772,6 +1680,11 @@ func defaultProcessingOptions(headers *processingHeaders) (*processingOptions, e
 		po.EnforceWebP = conf.EnforceWebp
 	}
 
+	if strings.Contains(headers.Accept, "image/avif") {
+		po.PreferAvif = conf.EnableAvifDetection || conf.EnforceAvif
+		po.EnforceAvif = conf.EnforceAvif
+	}
+
 	if conf.EnableClientHints && len(headers.ViewportWidth) > 0 {
 		if vw, err := strconv.Atoi(headers.ViewportWidth); err == nil {
 			po.Width = vw
@@ -783,10 +1696,16 @@ func defaultProcessingOptions(headers *processingHeaders) (*processingOptions, e
 		}
 	}
 	if conf.EnableClientHints && len(headers.DPR) > 0 {
-		if dpr, err := strconv.ParseFloat(headers.DPR, 64); err == nil && (dpr > 0 && dpr <= maxClientHintDPR) {
-			po.Dpr = dpr
+		if dpr, err := strconv.ParseFloat(headers.DPR, 64); err == nil && dpr > 0 {
+			po.Dpr = math.Min(dpr, conf.MaxDpr)
+		}
+	}
+	if len(conf.Background) > 0 {
+		if err = applyBackgroundOption(&po, []string{conf.Background}); err != nil {
+			return &po, err
 		}
 	}
+
 	if _, ok := conf.Presets["default"]; ok {
 		err = applyPresetOption(&po, []string{"default"})
 	}
@@ -811,10 +1730,8 @@ func parsePathAdvanced(parts []string, headers *processingHeaders) (string, *pro
 		return "", po, err
 	}
 
-	if len(extension) > 0 {
-		if err := applyFormatOption(po, []string{extension}); err != nil {
-			return "", po, err
-		}
+	if err := applyExtensionFormat(po, extension); err != nil {
+		return "", po, err
 	}
 
 	return url, po, nil
@@ -838,10 +1755,8 @@ func parsePathPresets(parts []string, headers *processingHeaders) (string, *proc
 		return "", po, err
 	}
 
-	if len(extension) > 0 {
-		if err := applyFormatOption(po, []string{extension}); err != nil {
-			return "", po, err
-		}
+	if err := applyExtensionFormat(po, extension); err != nil {
+		return "", po, err
 	}
 
 	return url, po, nil
@@ -882,20 +1797,26 @@ func parsePathBasic(parts []string, headers *processingHeaders) (string, *proces
 		return "", po, err
 	}
 
-	if len(extension) > 0 {
-		if err := applyFormatOption(po, []string{extension}); err != nil {
-			return "", po, err
-		}
+	if err := applyExtensionFormat(po, extension); err != nil {
+		return "", po, err
 	}
 
 	return url, po, nil
 }
 
+// requestPath returns the escaped request path, so escaped option arguments
+// are signed and parsed the same way they're sent
+func requestPath(r *http.Request) string {
+	return r.URL.EscapedPath()
+}
+
 func parsePath(ctx context.Context, r *http.Request) (context.Context, error) {
-	path := r.URL.RawPath
-	if len(path) == 0 {
-		path = r.URL.Path
-	}
+	return parseRequestPath(ctx, r, requestPath(r))
+}
+
+// parseRequestPath parses the processing path that may differ from the request path
+// when the route has its own prefix
+func parseRequestPath(ctx context.Context, r *http.Request, path string) (context.Context, error) {
 	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
 
 	if len(parts) < 3 {
@@ -931,12 +1852,49 @@ func parsePath(ctx context.Context, r *http.Request) (context.Context, error) {
 		return ctx, newError(404, err.Error(), msgInvalidURL)
 	}
 
+	// POST requests should have the upload token instead of the source URL, and GET requests
+	// can't have it. The token is signed with the rest of the path, so signed GET URLs
+	// can't be replayed as POST requests with an arbitrary image
+	if (r.Method == http.MethodPost) != (imageURL == urlTokenUpload) {
+		return ctx, errInvalidPath
+	}
+
+	// Requested size can be checked before downloading the source image.
+	// The resulting size is checked once again while processing
+	sizePo := *po
+	applyMaxSize(&sizePo)
+
+	dprWidth := roundToInt(float64(sizePo.Width) * po.Dpr)
+	dprHeight := roundToInt(float64(sizePo.Height) * po.Dpr)
+
+	if err = checkResultDimensions(dprWidth, dprHeight); err != nil {
+		return ctx, err
+	}
+
 	ctx = context.WithValue(ctx, imageURLCtxKey, imageURL)
 	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
 
+	if len(conf.SourceForwardHeaders) > 0 {
+		ctx = context.WithValue(ctx, forwardedHeadersCtxKey, forwardedHeaders(r))
+	}
+
 	return ctx, nil
 }
 
+// checkResultDimensions checks the resulting image size against IMGPROXY_MAX_DIMENSION
+// and IMGPROXY_MAX_RESOLUTION. Unknown sides are passed as zeros
+func checkResultDimensions(width, height int) error {
+	if conf.MaxDimension > 0 && (width > conf.MaxDimension || height > conf.MaxDimension) {
+		return errResultDimensionsTooBig
+	}
+
+	if conf.MaxResolution > 0 && width*height > conf.MaxResolution {
+		return errResultResolutionTooBig
+	}
+
+	return nil
+}
+
 func getImageURL(ctx context.Context) string {
 	return ctx.Value(imageURLCtxKey).(string)
 }
@@ -81,178 +81,1012 @@ func (s *ProcessingOptionsTestSuite) TestParsePlainURLWithoutExtension() {
 	assert.Equal(s.T(), imageURL, getImageURL(ctx))
 	assert.Equal(s.T(), imageTypeUnknown, getProcessingOptions(ctx).Format)
 }
+func (s *ProcessingOptionsTestSuite) TestParsePlainURLUnknownExtension() {
+	imageURL := "http://images.dev/lorem/ipsum@lorem"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s", imageURL))
+
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), imageURL, getImageURL(ctx))
+	assert.Equal(s.T(), imageTypeUnknown, getProcessingOptions(ctx).Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParseBase64URLUnknownExtension() {
+	imageURL := "http://images.dev/lorem/ipsum.jpg"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/%s.lorem", base64.RawURLEncoding.EncodeToString([]byte(imageURL))))
+
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), imageURL, getImageURL(ctx))
+	assert.Equal(s.T(), imageTypeUnknown, getProcessingOptions(ctx).Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParseFormatOptionOverridesExtension() {
+	imageURL := "http://images.dev/lorem/ipsum.jpg"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/format:webp/%s.PNG", base64.RawURLEncoding.EncodeToString([]byte(imageURL))))
+
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), imageTypeWEBP, getProcessingOptions(ctx).Format)
+
+	req = s.getRequest(fmt.Sprintf("http://example.com/unsafe/plain/%s@PNG", imageURL))
+
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePlainURLEscaped() {
 	imageURL := "http://images.dev/lorem/ipsum.jpg?param=value"
 	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", url.PathEscape(imageURL)))
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
-	assert.Equal(s.T(), imageURL, getImageURL(ctx))
-	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+	assert.Equal(s.T(), imageURL, getImageURL(ctx))
+	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePlainURLWithAt() {
+	imageURL := "http://images.dev/lorem/ipsum@2x.jpg"
+
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", imageURL))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), imageURL, getImageURL(ctx))
+	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+
+	req = s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s", imageURL))
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), imageURL, getImageURL(ctx))
+	assert.Equal(s.T(), imageTypeUnknown, getProcessingOptions(ctx).Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePlainURLWithBase() {
+	conf.BaseURL = "http://images.dev/"
+
+	imageURL := "lorem/ipsum.jpg"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", imageURL))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), fmt.Sprintf("%s%s", conf.BaseURL, imageURL), getImageURL(ctx))
+	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePlainURLEscapedWithBase() {
+	conf.BaseURL = "http://images.dev/"
+
+	imageURL := "lorem/ipsum.jpg?param=value"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", url.PathEscape(imageURL)))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), fmt.Sprintf("%s%s", conf.BaseURL, imageURL), getImageURL(ctx))
+	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePlainURLInvalid() {
+	imageURL := "lorem/ipsum.jpg?param=value"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", imageURL))
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errInvalidImageURL.Error(), err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePlainURLEscapedInvalid() {
+	imageURL := "lorem/ipsum.jpg?param=value"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", url.PathEscape(imageURL)))
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errInvalidImageURL.Error(), err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParseUploadURL() {
+	req, _ := http.NewRequest("POST", "http://example.com/unsafe/size:100:100/upload.png", nil)
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), urlTokenUpload, getImageURL(ctx))
+	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParseUploadURLWithGet() {
+	req := s.getRequest("http://example.com/unsafe/size:100:100/upload.png")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errInvalidPath.Error(), err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParseSourceURLWithPost() {
+	req, _ := http.NewRequest("POST", "http://example.com/unsafe/size:100:100/plain/http://images.dev/lorem/ipsum.jpg", nil)
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errInvalidPath.Error(), err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathBasic() {
+	req := s.getRequest("http://example.com/unsafe/fill/100/200/noea/1/plain/http://images.dev/lorem/ipsum.jpg@png")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), resizeFill, po.Resize)
+	assert.Equal(s.T(), 100, po.Width)
+	assert.Equal(s.T(), 200, po.Height)
+	assert.Equal(s.T(), gravityNorthEast, po.Gravity.Type)
+	assert.True(s.T(), po.Enlarge)
+	assert.Equal(s.T(), imageTypePNG, po.Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFormat() {
+	req := s.getRequest("http://example.com/unsafe/format:webp/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), imageTypeWEBP, po.Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFormatFallback() {
+	avifSupported, heicSupported := vipsTypeSupportSave[imageTypeAVIF], vipsTypeSupportSave[imageTypeHEIC]
+	defer func() {
+		vipsTypeSupportSave[imageTypeAVIF] = avifSupported
+		vipsTypeSupportSave[imageTypeHEIC] = heicSupported
+	}()
+
+	vipsTypeSupportSave[imageTypeAVIF] = false
+	vipsTypeSupportSave[imageTypeHEIC] = false
+
+	conf.FormatFallbacks = map[imageType]imageType{
+		imageTypeAVIF: imageTypeHEIC,
+		imageTypeHEIC: imageTypePNG,
+	}
+
+	req := s.getRequest("http://example.com/unsafe/format:avif/plain/http://images.dev/lorem/ipsum.jpg")
+
+	ctx, err := parsePath(context.Background(), req)
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+
+	conf.StrictFormat = true
+
+	_, err = parsePath(context.Background(), req)
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedResizeForce() {
+	req := s.getRequest("http://example.com/unsafe/rt:force/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), resizeForce, po.Resize)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedResize() {
+	req := s.getRequest("http://example.com/unsafe/resize:fill:100:200:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), resizeFill, po.Resize)
+	assert.Equal(s.T(), 100, po.Width)
+	assert.Equal(s.T(), 200, po.Height)
+	assert.True(s.T(), po.Enlarge)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedResizingType() {
+	req := s.getRequest("http://example.com/unsafe/resizing_type:fill/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), resizeFill, po.Resize)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSize() {
+	req := s.getRequest("http://example.com/unsafe/size:100:200:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 100, po.Width)
+	assert.Equal(s.T(), 200, po.Height)
+	assert.True(s.T(), po.Enlarge)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWidth() {
+	req := s.getRequest("http://example.com/unsafe/width:100/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 100, po.Width)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedHeight() {
+	req := s.getRequest("http://example.com/unsafe/height:100/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 100, po.Height)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedEnlarge() {
+	req := s.getRequest("http://example.com/unsafe/enlarge:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Enlarge)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravity() {
+	req := s.getRequest("http://example.com/unsafe/gravity:soea/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravitySouthEast, po.Gravity.Type)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityComponents() {
+	expected := map[string]gravityType{
+		"no:we": gravityNorthWest,
+		"we:no": gravityNorthWest,
+		"so:ea": gravitySouthEast,
+		"ce:ea": gravityEast,
+		"no:ce": gravityNorth,
+		"ce:ce": gravityCenter,
+	}
+
+	for g, t := range expected {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/gravity:%s/plain/http://images.dev/lorem/ipsum.jpg", g))
+		ctx, err := parsePath(context.Background(), req)
+
+		require.Nil(s.T(), err, g)
+
+		po := getProcessingOptions(ctx)
+		assert.Equal(s.T(), t, po.Gravity.Type, g)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityComponentsOffsets() {
+	req := s.getRequest("http://example.com/unsafe/gravity:we:no:10:20/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravityNorthWest, po.Gravity.Type)
+	assert.Equal(s.T(), 10.0, po.Gravity.X)
+	assert.Equal(s.T(), 20.0, po.Gravity.Y)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityComponentsInvalid() {
+	for _, g := range []string{"no:so", "we:ea", "no:we:so"} {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/gravity:%s/plain/http://images.dev/lorem/ipsum.jpg", g))
+		_, err := parsePath(context.Background(), req)
+
+		assert.Error(s.T(), err, g)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravitySmart() {
+	req := s.getRequest("http://example.com/unsafe/gravity:sm/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravitySmart, po.Gravity.Type)
+	assert.Equal(s.T(), smartCropAttention, po.Gravity.Strategy)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravitySmartEntropy() {
+	req := s.getRequest("http://example.com/unsafe/gravity:sm:entropy/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravitySmart, po.Gravity.Type)
+	assert.Equal(s.T(), smartCropEntropy, po.Gravity.Strategy)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravitySmartInvalidStrategy() {
+	req := s.getRequest("http://example.com/unsafe/gravity:sm:foo/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid smart crop strategy: foo", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityFocuspoint() {
+	req := s.getRequest("http://example.com/unsafe/gravity:fp:0.5:0.75/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravityFocusPoint, po.Gravity.Type)
+	assert.Equal(s.T(), 0.5, po.Gravity.X)
+	assert.Equal(s.T(), 0.75, po.Gravity.Y)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityFocuspointNoCoords() {
+	req := s.getRequest("http://example.com/unsafe/gravity:fp/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravityFocusPoint, po.Gravity.Type)
+	assert.Equal(s.T(), 0.5, po.Gravity.X)
+	assert.Equal(s.T(), 0.5, po.Gravity.Y)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityFocuspointOneCoord() {
+	req := s.getRequest("http://example.com/unsafe/gravity:fp:0.5/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedCropGravityComponents() {
+	req := s.getRequest("http://example.com/unsafe/crop:100:200:no:we:10:20/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravityNorthWest, po.Crop.Gravity.Type)
+	assert.Equal(s.T(), 10.0, po.Crop.Gravity.X)
+	assert.Equal(s.T(), 20.0, po.Crop.Gravity.Y)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedAspectRatio() {
+	req := s.getRequest("http://example.com/unsafe/ar:16:9:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), aspectRatioOptions{Width: 16, Height: 9, Pad: true}, po.AspectRatio)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedAspectRatioClamped() {
+	req := s.getRequest("http://example.com/unsafe/ar:10000:1:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), aspectRatioOptions{Width: 100, Height: 1, Pad: true}, po.AspectRatio)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedAspectRatioInvalid() {
+	for _, ar := range []string{"16", "16:0", "a:9", "-16:9"} {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/ar:%s/plain/http://images.dev/lorem/ipsum.jpg", ar))
+		_, err := parsePath(context.Background(), req)
+
+		assert.Error(s.T(), err, ar)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedCrop() {
+	req := s.getRequest("http://example.com/unsafe/crop:100:200:nowe:10:20/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 100, po.Crop.Width)
+	assert.Equal(s.T(), 200, po.Crop.Height)
+	assert.Equal(s.T(), gravityNorthWest, po.Crop.Gravity.Type)
+	assert.Equal(s.T(), 10.0, po.Crop.Gravity.X)
+	assert.Equal(s.T(), 20.0, po.Crop.Gravity.Y)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedTrim() {
+	req := s.getRequest("http://example.com/unsafe/trim:10/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Trim.Enabled)
+	assert.Equal(s.T(), 10.0, po.Trim.Threshold)
+	assert.False(s.T(), po.Trim.HasColor)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedTrimColor() {
+	req := s.getRequest("http://example.com/unsafe/trim:10:ffddee/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Trim.Enabled)
+	assert.True(s.T(), po.Trim.HasColor)
+	assert.Equal(s.T(), rgbColor{0xff, 0xdd, 0xee}, po.Trim.Color)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedRotate() {
+	req := s.getRequest("http://example.com/unsafe/rotate:90/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 90, po.Rotate)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedRotateNormalized() {
+	req := s.getRequest("http://example.com/unsafe/rotate:-45/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 315, po.Rotate)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFlipFlop() {
+	req := s.getRequest("http://example.com/unsafe/flip:1/flop:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Flip)
+	assert.True(s.T(), po.Flop)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGrayscale() {
+	req := s.getRequest("http://example.com/unsafe/grayscale:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Grayscale)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSepia() {
+	req := s.getRequest("http://example.com/unsafe/sepia:0.5/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 0.5, po.Sepia)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSepiaInvalid() {
+	for _, options := range []string{"sepia:1.5", "sepia:-0.1", "sepia:a", "sepia:0.5:1"} {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/%s/plain/http://images.dev/lorem/ipsum.jpg", options))
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, options)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedInvert() {
+	req := s.getRequest("http://example.com/unsafe/invert:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Invert)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedScale() {
+	req := s.getRequest("http://example.com/unsafe/scale:0.5/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 0.5, po.Scale)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedScaleInvalid() {
+	req := s.getRequest("http://example.com/unsafe/scale:0/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid scale: 0", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedDprClamped() {
+	conf.MaxDpr = 3
+
+	req := s.getRequest("http://example.com/unsafe/dpr:5/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 3.0, po.Dpr)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPixelate() {
+	req := s.getRequest("http://example.com/unsafe/pixelate:8/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 8, po.Pixelate)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPixelateInvalid() {
+	req := s.getRequest("http://example.com/unsafe/pixelate:0/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid pixelate: 0", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedAdjustments() {
+	req := s.getRequest("http://example.com/unsafe/brightness:-20/contrast:1.2/saturation:0.5/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), -20, po.Brightness)
+	assert.Equal(s.T(), 1.2, po.Contrast)
+	assert.Equal(s.T(), 0.5, po.Saturation)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedAdjustmentsDefaults() {
+	req := s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 0, po.Brightness)
+	assert.Equal(s.T(), 1.0, po.Contrast)
+	assert.Equal(s.T(), 1.0, po.Saturation)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBrightnessOutOfRange() {
+	req := s.getRequest("http://example.com/unsafe/brightness:300/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid brightness: 300", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBorder() {
+	req := s.getRequest("http://example.com/unsafe/border:5:ff0000/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 5, po.Border.Width)
+	assert.Equal(s.T(), rgbColor{255, 0, 0}, po.Border.Color)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBorderInvalidColor() {
+	req := s.getRequest("http://example.com/unsafe/border:5:red/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid border color: red", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPadding() {
+	cases := map[string]paddingOptions{
+		"padding:10":         {10, 10, 10, 10},
+		"pad:10:20":          {10, 20, 10, 20},
+		"padding:1:2:3:4":    {1, 2, 3, 4},
+		"padding:0:0:0:0":    {0, 0, 0, 0},
+		"pad:10:20/pad:5:15": {5, 15, 5, 15},
+	}
+
+	for options, expected := range cases {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/%s/plain/http://images.dev/lorem/ipsum.jpg", options))
+		ctx, err := parsePath(context.Background(), req)
+
+		require.Nil(s.T(), err, options)
+		assert.Equal(s.T(), expected, getProcessingOptions(ctx).Padding, options)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPaddingInvalid() {
+	for _, options := range []string{"padding:1:2:3", "padding:-1", "padding:a:1"} {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/%s/plain/http://images.dev/lorem/ipsum.jpg", options))
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, options)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedCornerRadius() {
+	req := s.getRequest("http://example.com/unsafe/corner_radius:20/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 20, po.CornerRadius)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedQuality() {
+	req := s.getRequest("http://example.com/unsafe/quality:55/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 55, po.Quality)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedQualityOutOfRange() {
+	for _, q := range []string{"0", "101"} {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/q:%s/plain/http://images.dev/lorem/ipsum.jpg", q))
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err)
+		assert.Equal(s.T(), fmt.Sprintf("Invalid quality: %s", q), err.Error())
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedStripMetadata() {
+	req := s.getRequest("http://example.com/unsafe/strip_metadata:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.StripMetadata)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathStripMetadataConfig() {
+	conf.StripMetadata = true
+
+	req := s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.StripMetadata)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedProgressive() {
+	req := s.getRequest("http://example.com/unsafe/progressive:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Progressive)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathSaveOptionsSet() {
+	conf.Quality = 50
+
+	req := s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.False(s.T(), getProcessingOptions(ctx).SaveOptionsSet)
+
+	req = s.getRequest("http://example.com/unsafe/q:50/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.True(s.T(), getProcessingOptions(ctx).SaveOptionsSet)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathProgressiveConfig() {
+	conf.JpegProgressive = true
+
+	req := s.getRequest("http://example.com/unsafe/interlace:0/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.False(s.T(), po.Progressive)
+
+	req = s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po = getProcessingOptions(ctx)
+	assert.True(s.T(), po.Progressive)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedMaxSize() {
+	req := s.getRequest("http://example.com/unsafe/w:800/maxheight:1200/mw:1000/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 800, po.Width)
+	assert.Equal(s.T(), 1000, po.MaxWidth)
+	assert.Equal(s.T(), 1200, po.MaxHeight)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePlainURLWithBase() {
-	conf.BaseURL = "http://images.dev/"
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedKernel() {
+	for name, kernel := range resizeKernels {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/kernel:%s/plain/http://images.dev/lorem/ipsum.jpg", name))
+		ctx, err := parsePath(context.Background(), req)
 
-	imageURL := "lorem/ipsum.jpg"
-	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", imageURL))
+		require.Nil(s.T(), err, name)
+
+		po := getProcessingOptions(ctx)
+		assert.Equal(s.T(), kernel, po.Kernel, name)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedKernelInvalid() {
+	req := s.getRequest("http://example.com/unsafe/k:mitchell/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathKernelConfig() {
+	conf.ResizeKernel = "nearest"
+
+	req := s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
-	assert.Equal(s.T(), fmt.Sprintf("%s%s", conf.BaseURL, imageURL), getImageURL(ctx))
-	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
-}
+	assert.Equal(s.T(), resizeKernelNearest, getProcessingOptions(ctx).Kernel)
 
-func (s *ProcessingOptionsTestSuite) TestParsePlainURLEscapedWithBase() {
-	conf.BaseURL = "http://images.dev/"
+	req = s.getRequest("http://example.com/unsafe/k:cubic/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err = parsePath(context.Background(), req)
 
-	imageURL := "lorem/ipsum.jpg?param=value"
-	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", url.PathEscape(imageURL)))
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), resizeKernelCubic, getProcessingOptions(ctx).Kernel)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedAntialias() {
+	req := s.getRequest("http://example.com/unsafe/aa:0/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
-	assert.Equal(s.T(), fmt.Sprintf("%s%s", conf.BaseURL, imageURL), getImageURL(ctx))
-	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+	assert.True(s.T(), getProcessingOptions(ctx).NoAntialias)
+
+	req = s.getRequest("http://example.com/unsafe/antialias:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.False(s.T(), getProcessingOptions(ctx).NoAntialias)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePlainURLInvalid() {
-	imageURL := "lorem/ipsum.jpg?param=value"
-	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", imageURL))
-	_, err := parsePath(context.Background(), req)
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSubsample() {
+	for _, mode := range []string{"4:4:4", "444"} {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/subsample:%s/plain/http://images.dev/lorem/ipsum.jpg", mode))
+		ctx, err := parsePath(context.Background(), req)
 
-	require.Error(s.T(), err)
-	assert.Equal(s.T(), errInvalidImageURL.Error(), err.Error())
+		require.Nil(s.T(), err)
+
+		po := getProcessingOptions(ctx)
+		assert.Equal(s.T(), jpegSubsample444, po.Subsample)
+	}
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePlainURLEscapedInvalid() {
-	imageURL := "lorem/ipsum.jpg?param=value"
-	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", url.PathEscape(imageURL)))
+func (s *ProcessingOptionsTestSuite) TestParsePathSubsampleConfig() {
+	conf.JpegSubsample = "4:4:4"
+
+	req := s.getRequest("http://example.com/unsafe/ss:4:2:0/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), jpegSubsample420, po.Subsample)
+
+	req = s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po = getProcessingOptions(ctx)
+	assert.Equal(s.T(), jpegSubsample444, po.Subsample)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathSubsampleInvalid() {
+	req := s.getRequest("http://example.com/unsafe/subsample:4:1:1/plain/http://images.dev/lorem/ipsum.jpg")
 	_, err := parsePath(context.Background(), req)
 
 	require.Error(s.T(), err)
-	assert.Equal(s.T(), errInvalidImageURL.Error(), err.Error())
+	assert.Equal(s.T(), "Invalid subsample mode: 4:1:1", err.Error())
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathBasic() {
-	req := s.getRequest("http://example.com/unsafe/fill/100/200/noea/1/plain/http://images.dev/lorem/ipsum.jpg@png")
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPngOptions() {
+	req := s.getRequest("http://example.com/unsafe/png_options:9:1:1:64:0.5/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), resizeFill, po.Resize)
-	assert.Equal(s.T(), 100, po.Width)
-	assert.Equal(s.T(), 200, po.Height)
-	assert.Equal(s.T(), gravityNorthEast, po.Gravity.Type)
-	assert.True(s.T(), po.Enlarge)
-	assert.Equal(s.T(), imageTypePNG, po.Format)
+	assert.Equal(s.T(), 9, po.PngOptions.Compression)
+	assert.True(s.T(), po.PngOptions.Interlaced)
+	assert.True(s.T(), po.PngOptions.Quantize)
+	assert.Equal(s.T(), 64, po.PngOptions.QuantizationColors)
+	assert.Equal(s.T(), 0.5, po.PngOptions.QuantizationDither)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFormat() {
-	req := s.getRequest("http://example.com/unsafe/format:webp/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathPngOptionsPartial() {
+	conf.PngCompression = 3
+	conf.PngQuantizationColors = 128
+
+	req := s.getRequest("http://example.com/unsafe/pngo::::16/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), imageTypeWEBP, po.Format)
+	assert.Equal(s.T(), 3, po.PngOptions.Compression)
+	assert.False(s.T(), po.PngOptions.Quantize)
+	assert.Equal(s.T(), 16, po.PngOptions.QuantizationColors)
+	assert.Equal(s.T(), 1.0, po.PngOptions.QuantizationDither)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedResize() {
-	req := s.getRequest("http://example.com/unsafe/resize:fill:100:200:1/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathPngOptionsInvalid() {
+	req := s.getRequest("http://example.com/unsafe/png_options:10/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid png compression: 10", err.Error())
+
+	req = s.getRequest("http://example.com/unsafe/png_options::::1/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err = parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid png quantization colors: 1", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedResizingTypeMin() {
+	req := s.getRequest("http://example.com/unsafe/rt:min/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), resizeFill, po.Resize)
-	assert.Equal(s.T(), 100, po.Width)
-	assert.Equal(s.T(), 200, po.Height)
-	assert.True(s.T(), po.Enlarge)
+	assert.Equal(s.T(), resizeMin, po.Resize)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedResizingType() {
-	req := s.getRequest("http://example.com/unsafe/resizing_type:fill/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathEnlargeDefault() {
+	conf.Enlarge = true
+
+	req := s.getRequest("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), resizeFill, po.Resize)
+	assert.True(s.T(), po.Enlarge)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSize() {
-	req := s.getRequest("http://example.com/unsafe/size:100:200:1/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathExtendDefault() {
+	conf.Extend = true
+
+	req := s.getRequest("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
+	assert.True(s.T(), getProcessingOptions(ctx).Extend)
 
-	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), 100, po.Width)
-	assert.Equal(s.T(), 200, po.Height)
-	assert.True(s.T(), po.Enlarge)
+	req = s.getRequest("http://example.com/unsafe/w:100/ex:0/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.False(s.T(), getProcessingOptions(ctx).Extend)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWidth() {
-	req := s.getRequest("http://example.com/unsafe/width:100/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedTiffCompression() {
+	req := s.getRequest("http://example.com/unsafe/tc:deflate/plain/http://images.dev/lorem/ipsum.tiff")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), 100, po.Width)
+	assert.Equal(s.T(), tiffCompressionDeflate, po.TiffCompression)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedHeight() {
-	req := s.getRequest("http://example.com/unsafe/height:100/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedIcoSizes() {
+	req := s.getRequest("http://example.com/unsafe/icos:16:32:48/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), 100, po.Height)
+	assert.Equal(s.T(), []int{16, 32, 48}, po.IcoSizes)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedEnlarge() {
-	req := s.getRequest("http://example.com/unsafe/enlarge:1/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathIcoSizesInvalid() {
+	req := s.getRequest("http://example.com/unsafe/icos:16:512/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid ico size: 512", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFrame() {
+	req := s.getRequest("http://example.com/unsafe/frame:3/plain/http://images.dev/lorem/ipsum.gif")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.True(s.T(), po.Enlarge)
+	assert.Equal(s.T(), 3, po.Frame)
+	assert.True(s.T(), po.ExtractFrame)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravity() {
-	req := s.getRequest("http://example.com/unsafe/gravity:soea/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathFrameInvalid() {
+	req := s.getRequest("http://example.com/unsafe/fr:-1/plain/http://images.dev/lorem/ipsum.gif")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid frame: -1", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPage() {
+	req := s.getRequest("http://example.com/unsafe/pg:2/plain/http://images.dev/lorem/ipsum.pdf")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), gravitySouthEast, po.Gravity.Type)
+	assert.Equal(s.T(), 2, po.Page)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityFocuspoint() {
-	req := s.getRequest("http://example.com/unsafe/gravity:fp:0.5:0.75/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathFilename() {
+	req := s.getRequest("http://example.com/unsafe/fn:my%20image.png/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), gravityFocusPoint, po.Gravity.Type)
-	assert.Equal(s.T(), 0.5, po.Gravity.X)
-	assert.Equal(s.T(), 0.75, po.Gravity.Y)
+	assert.Equal(s.T(), "my image.png", po.Filename)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedQuality() {
-	req := s.getRequest("http://example.com/unsafe/quality:55/plain/http://images.dev/lorem/ipsum.jpg")
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedMaxBytes() {
+	req := s.getRequest("http://example.com/unsafe/maxbytes:100000/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), 55, po.Quality)
+	assert.Equal(s.T(), 100000, po.MaxBytes)
 }
 
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackground() {
@@ -291,6 +1125,52 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackgroundDisable() {
 	assert.False(s.T(), po.Flatten)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackgroundTransparent() {
+	req := s.getRequest("http://example.com/unsafe/background:fff/background:transparent/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.False(s.T(), po.Flatten)
+	assert.True(s.T(), po.TransparentBackground)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackgroundRGB() {
+	req := s.getRequest("http://example.com/unsafe/background:rgb(10,%2020,30)/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Flatten)
+	assert.Equal(s.T(), rgbColor{10, 20, 30}, po.Background)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackgroundInvalid() {
+	for _, bg := range []string{"fffff", "red", "rgb(256,0,0)", "rgb(1,2)"} {
+		req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/background:%s/plain/http://images.dev/lorem/ipsum.jpg", bg))
+		_, err := parsePath(context.Background(), req)
+
+		if assert.Error(s.T(), err, bg) {
+			assert.Contains(s.T(), err.Error(), "Invalid color", bg)
+		}
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathDefaultBackground() {
+	conf.Background = "rgb(1,2,3)"
+
+	req := s.getRequest("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Flatten)
+	assert.Equal(s.T(), rgbColor{1, 2, 3}, po.Background)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBlur() {
 	req := s.getRequest("http://example.com/unsafe/blur:0.2/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -301,6 +1181,14 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBlur() {
 	assert.Equal(s.T(), float32(0.2), po.Blur)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBlurNegative() {
+	req := s.getRequest("http://example.com/unsafe/blur:-1/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Invalid blur: -1", err.Error())
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSharpen() {
 	req := s.getRequest("http://example.com/unsafe/sharpen:0.2/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -310,6 +1198,16 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSharpen() {
 	po := getProcessingOptions(ctx)
 	assert.Equal(s.T(), float32(0.2), po.Sharpen)
 }
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSharpenClamped() {
+	req := s.getRequest("http://example.com/unsafe/sharpen:100/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), float32(maxSharpenSigma), po.Sharpen)
+}
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedDpr() {
 	req := s.getRequest("http://example.com/unsafe/dpr:2/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -335,12 +1233,12 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWatermark() {
 
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPreset() {
 	conf.Presets["test1"] = urlOptions{
-		"resizing_type": []string{"fill"},
+		{Name: "resizing_type", Args: []string{"fill"}},
 	}
 
 	conf.Presets["test2"] = urlOptions{
-		"blur":    []string{"0.2"},
-		"quality": []string{"50"},
+		{Name: "blur", Args: []string{"0.2"}},
+		{Name: "quality", Args: []string{"50"}},
 	}
 
 	req := s.getRequest("http://example.com/unsafe/preset:test1:test2/plain/http://images.dev/lorem/ipsum.jpg")
@@ -354,11 +1252,36 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPreset() {
 	assert.Equal(s.T(), 50, po.Quality)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPresetOverride() {
+	conf.Presets["thumbnail"] = urlOptions{
+		{Name: "resize", Args: []string{"fill", "100", "100", "0"}},
+		{Name: "quality", Args: []string{"70"}},
+	}
+
+	req := s.getRequest("http://example.com/unsafe/preset:thumbnail/quality:90/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), resizeFill, po.Resize)
+	assert.Equal(s.T(), 100, po.Width)
+	assert.Equal(s.T(), 90, po.Quality)
+
+	req = s.getRequest("http://example.com/unsafe/quality:90/preset:thumbnail/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po = getProcessingOptions(ctx)
+	assert.Equal(s.T(), 70, po.Quality)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathPresetDefault() {
 	conf.Presets["default"] = urlOptions{
-		"resizing_type": []string{"fill"},
-		"blur":          []string{"0.2"},
-		"quality":       []string{"50"},
+		{Name: "resizing_type", Args: []string{"fill"}},
+		{Name: "blur", Args: []string{"0.2"}},
+		{Name: "quality", Args: []string{"50"}},
 	}
 
 	req := s.getRequest("http://example.com/unsafe/quality:70/plain/http://images.dev/lorem/ipsum.jpg")
@@ -374,12 +1297,12 @@ func (s *ProcessingOptionsTestSuite) TestParsePathPresetDefault() {
 
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPresetLoopDetection() {
 	conf.Presets["test1"] = urlOptions{
-		"resizing_type": []string{"fill"},
+		{Name: "resizing_type", Args: []string{"fill"}},
 	}
 
 	conf.Presets["test2"] = urlOptions{
-		"blur":    []string{"0.2"},
-		"quality": []string{"50"},
+		{Name: "blur", Args: []string{"0.2"}},
+		{Name: "quality", Args: []string{"50"}},
 	}
 
 	req := s.getRequest("http://example.com/unsafe/preset:test1:test2:test1/plain/http://images.dev/lorem/ipsum.jpg")
@@ -429,6 +1352,34 @@ func (s *ProcessingOptionsTestSuite) TestParsePathWebpEnforce() {
 	assert.Equal(s.T(), true, po.EnforceWebP)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAvifDetection() {
+	conf.EnableAvifDetection = true
+
+	req := s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
+	req.Header.Set("Accept", "image/avif,image/webp")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), true, po.PreferAvif)
+	assert.Equal(s.T(), false, po.EnforceAvif)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAvifEnforce() {
+	conf.EnforceAvif = true
+
+	req := s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg@png")
+	req.Header.Set("Accept", "image/avif")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), true, po.PreferAvif)
+	assert.Equal(s.T(), true, po.EnforceAvif)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathWidthHeader() {
 	conf.EnableClientHints = true
 
@@ -516,6 +1467,20 @@ func (s *ProcessingOptionsTestSuite) TestParsePathDprHeader() {
 	assert.Equal(s.T(), 2.0, po.Dpr)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathDprHeaderClamped() {
+	conf.EnableClientHints = true
+	conf.MaxDpr = 3
+
+	req := s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg@png")
+	req.Header.Set("DPR", "5")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 3.0, po.Dpr)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathDprHeaderDisabled() {
 	req := s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg@png")
 	req.Header.Set("DPR", "2")
@@ -527,6 +1492,53 @@ func (s *ProcessingOptionsTestSuite) TestParsePathDprHeaderDisabled() {
 	assert.Equal(s.T(), 1.0, po.Dpr)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathMaxDimension() {
+	conf.MaxDimension = 1000
+
+	req := s.getRequest("http://example.com/unsafe/width:1000/dpr:2/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errResultDimensionsTooBig, err)
+
+	req = s.getRequest("http://example.com/unsafe/width:500/dpr:2/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathMaxDimensionWithMaxSize() {
+	conf.MaxDimension = 1000
+
+	// The image is fit into max sizes when no size is requested
+	req := s.getRequest("http://example.com/unsafe/mw:2000/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errResultDimensionsTooBig, err)
+
+	// Max size limits the requested size
+	req = s.getRequest("http://example.com/unsafe/w:2000/mw:1000/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathMaxResolution() {
+	conf.MaxResolution = 1000000
+
+	req := s.getRequest("http://example.com/unsafe/size:1000:1001/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errResultResolutionTooBig, err)
+
+	req = s.getRequest("http://example.com/unsafe/size:1000:1000/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathSigned() {
 	conf.Keys = []securityKey{securityKey("test-key")}
 	conf.Salts = []securityKey{securityKey("test-salt")}
@@ -548,15 +1560,27 @@ func (s *ProcessingOptionsTestSuite) TestParsePathSignedInvalid() {
 
 	require.Error(s.T(), err)
 	assert.Equal(s.T(), errInvalidSignature.Error(), err.Error())
+	assert.Equal(s.T(), 403, err.(*imgproxyError).StatusCode)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathSignedAllowInsecure() {
+	conf.Keys = []securityKey{securityKey("test-key")}
+	conf.Salts = []securityKey{securityKey("test-salt")}
+	conf.AllowInsecure = true
+
+	req := s.getRequest("http://example.com/unsafe/width:150/plain/http://images.dev/lorem/ipsum.jpg@png")
+	_, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
 }
 
 func (s *ProcessingOptionsTestSuite) TestParsePathOnlyPresets() {
 	conf.OnlyPresets = true
 	conf.Presets["test1"] = urlOptions{
-		"blur": []string{"0.2"},
+		{Name: "blur", Args: []string{"0.2"}},
 	}
 	conf.Presets["test2"] = urlOptions{
-		"quality": []string{"50"},
+		{Name: "quality", Args: []string{"50"}},
 	}
 
 	req := s.getRequest("http://example.com/unsafe/test1:test2/plain/http://images.dev/lorem/ipsum.jpg")
@@ -573,10 +1597,10 @@ func (s *ProcessingOptionsTestSuite) TestParsePathOnlyPresets() {
 func (s *ProcessingOptionsTestSuite) TestParseBase64URLOnlyPresets() {
 	conf.OnlyPresets = true
 	conf.Presets["test1"] = urlOptions{
-		"blur": []string{"0.2"},
+		{Name: "blur", Args: []string{"0.2"}},
 	}
 	conf.Presets["test2"] = urlOptions{
-		"quality": []string{"50"},
+		{Name: "quality", Args: []string{"50"}},
 	}
 
 	imageURL := "http://images.dev/lorem/ipsum.jpg?param=value"
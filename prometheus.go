@@ -11,17 +11,22 @@ import (
 var (
 	prometheusEnabled = false
 
-	prometheusRequestsTotal      prometheus.Counter
-	prometheusErrorsTotal        *prometheus.CounterVec
-	prometheusRequestDuration    prometheus.Histogram
-	prometheusDownloadDuration   prometheus.Histogram
-	prometheusProcessingDuration prometheus.Histogram
-	prometheusBufferSize         *prometheus.HistogramVec
-	prometheusBufferDefaultSize  *prometheus.GaugeVec
-	prometheusBufferMaxSize      *prometheus.GaugeVec
-	prometheusVipsMemory         prometheus.Gauge
-	prometheusVipsMaxMemory      prometheus.Gauge
-	prometheusVipsAllocs         prometheus.Gauge
+	prometheusRequestsTotal           prometheus.Counter
+	prometheusRequestsInProgress      prometheus.Gauge
+	prometheusRequestsInQueue         prometheus.Gauge
+	prometheusErrorsTotal             *prometheus.CounterVec
+	prometheusRequestDuration         prometheus.Histogram
+	prometheusDownloadDuration        prometheus.Histogram
+	prometheusProcessingDuration      prometheus.Histogram
+	prometheusProcessingStageDuration *prometheus.HistogramVec
+	prometheusSourceBytesTotal        prometheus.Counter
+	prometheusResultBytesTotal        prometheus.Counter
+	prometheusBufferSize              *prometheus.HistogramVec
+	prometheusBufferDefaultSize       *prometheus.GaugeVec
+	prometheusBufferMaxSize           *prometheus.GaugeVec
+	prometheusVipsMemory              prometheus.Gauge
+	prometheusVipsMaxMemory           prometheus.Gauge
+	prometheusVipsAllocs              prometheus.Gauge
 )
 
 func initPrometheus() {
@@ -34,6 +39,16 @@ func initPrometheus() {
 		Help: "A counter of the total number of HTTP requests imgproxy processed.",
 	})
 
+	prometheusRequestsInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "requests_in_progress",
+		Help: "A gauge of the number of HTTP requests imgproxy is processing right now.",
+	})
+
+	prometheusRequestsInQueue = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "requests_in_queue",
+		Help: "A gauge of the number of HTTP requests waiting for a free processing slot.",
+	})
+
 	prometheusErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "errors_total",
 		Help: "A counter of the occurred errors separated by type.",
@@ -54,6 +69,21 @@ func initPrometheus() {
 		Help: "A histogram of the image processing latency.",
 	})
 
+	prometheusProcessingStageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "processing_stage_duration_seconds",
+		Help: "A histogram of the image processing stages latency.",
+	}, []string{"stage"})
+
+	prometheusSourceBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "source_bytes_total",
+		Help: "A counter of the total size of the downloaded source images in bytes.",
+	})
+
+	prometheusResultBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "result_bytes_total",
+		Help: "A counter of the total size of the resulting images in bytes.",
+	})
+
 	prometheusBufferSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "buffer_size_bytes",
 		Help: "A histogram of the buffer size in bytes.",
@@ -86,10 +116,15 @@ func initPrometheus() {
 
 	prometheus.MustRegister(
 		prometheusRequestsTotal,
+		prometheusRequestsInProgress,
+		prometheusRequestsInQueue,
 		prometheusErrorsTotal,
 		prometheusRequestDuration,
 		prometheusDownloadDuration,
 		prometheusProcessingDuration,
+		prometheusProcessingStageDuration,
+		prometheusSourceBytesTotal,
+		prometheusResultBytesTotal,
 		prometheusBufferSize,
 		prometheusBufferDefaultSize,
 		prometheusBufferMaxSize,
@@ -100,7 +135,15 @@ func initPrometheus() {
 
 	prometheusEnabled = true
 
-	s := http.Server{Handler: promhttp.Handler()}
+	var handler http.Handler = promhttp.Handler()
+
+	if len(conf.PrometheusPath) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle(conf.PrometheusPath, handler)
+		handler = mux
+	}
+
+	s := http.Server{Handler: handler}
 
 	go func() {
 		l, err := listenReuseport("tcp", conf.PrometheusBind)
@@ -115,13 +158,21 @@ func initPrometheus() {
 	}()
 }
 
-func startPrometheusDuration(m prometheus.Histogram) func() {
+func startPrometheusDuration(m prometheus.Observer) func() {
 	t := time.Now()
 	return func() {
 		m.Observe(time.Since(t).Seconds())
 	}
 }
 
+func startPrometheusProcessingStage(stage string) func() {
+	if !prometheusEnabled {
+		return func() {}
+	}
+
+	return startPrometheusDuration(prometheusProcessingStageDuration.With(prometheus.Labels{"stage": stage}))
+}
+
 func incrementPrometheusErrorsTotal(t string) {
 	prometheusErrorsTotal.With(prometheus.Labels{"type": t}).Inc()
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+
+	_ "github.com/mat/besticon/ico"
+	_ "golang.org/x/image/bmp"
+)
+
+// rgbaData decodes images that libvips can't load by itself
+// and returns raw RGBA pixels of the decoded image
+func rgbaData(data []byte) (out []byte, width int, height int, err error) {
+	var img image.Image
+
+	img, _, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	// Ensure that image is in RGBA format
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, img.Bounds(), img, image.ZP, draw.Src)
+
+	width = rgba.Bounds().Dx()
+	height = rgba.Bounds().Dy()
+	out = rgba.Pix
+
+	return
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"regexp"
 	"strings"
@@ -14,6 +15,8 @@ const (
 
 var (
 	requestIDRe = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+	requestIDCtxKey = ctxKey("requestID")
 )
 
 type routeHandler func(string, http.ResponseWriter, *http.Request)
@@ -47,10 +50,23 @@ func (r *router) GET(prefix string, handler routeHandler) {
 	r.Add(http.MethodGet, prefix, handler)
 }
 
+func (r *router) POST(prefix string, handler routeHandler) {
+	r.Add(http.MethodPost, prefix, handler)
+}
+
 func (r *router) OPTIONS(prefix string, handler routeHandler) {
 	r.Add(http.MethodOptions, prefix, handler)
 }
 
+func withRequestID(ctx context.Context, reqID string) context.Context {
+	return context.WithValue(ctx, requestIDCtxKey, reqID)
+}
+
+func getRequestID(ctx context.Context) string {
+	reqID, _ := ctx.Value(requestIDCtxKey).(string)
+	return reqID
+}
+
 func (r *router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	reqID := req.Header.Get(xRequestIDHeader)
 
@@ -80,7 +96,7 @@ func (r *router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	logWarning("Route for %s is not defined", req.URL.Path)
+	logRequestWarning(reqID, "Route for %s is not defined", req.URL.Path)
 
 	rw.WriteHeader(404)
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	http "net/http"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -50,6 +54,22 @@ func (t s3Transport) RoundTrip(req *http.Request) (resp *http.Response, err erro
 	s3req, _ := t.svc.GetObjectRequest(input)
 
 	if err := s3req.Send(); err != nil {
+		// Pass S3 response status so the client gets the appropriate one
+		if s3err, ok := err.(awserr.RequestFailure); ok {
+			return &http.Response{
+				Status:        fmt.Sprintf("%d %s", s3err.StatusCode(), http.StatusText(s3err.StatusCode())),
+				StatusCode:    s3err.StatusCode(),
+				Proto:         "HTTP/1.0",
+				ProtoMajor:    1,
+				ProtoMinor:    0,
+				Header:        make(http.Header),
+				ContentLength: int64(len(s3err.Message())),
+				Body:          ioutil.NopCloser(strings.NewReader(s3err.Message())),
+				Close:         true,
+				Request:       req,
+			}, nil
+		}
+
 		return nil, err
 	}
 
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type S3TransportTestSuite struct {
+	MainTestSuite
+
+	server *httptest.Server
+	status int
+	client *http.Client
+}
+
+func (s *S3TransportTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if s.status != 200 {
+			rw.Header().Set("Content-Type", "application/xml")
+			rw.WriteHeader(s.status)
+			rw.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>Error</Code><Message>Test error</Message></Error>`))
+			return
+		}
+
+		rw.Write([]byte("image"))
+	}))
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	conf.S3Endpoint = s.server.URL
+	conf.S3Region = "us-east-1"
+
+	s.client = newTestTransportClient("s3", newS3Transport())
+}
+
+func (s *S3TransportTestSuite) TearDownTest() {
+	s.server.Close()
+
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *S3TransportTestSuite) TestGetObject() {
+	s.status = 200
+
+	res, err := s.client.Get("s3://bucket/images/test.png")
+	require.Nil(s.T(), err)
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), 200, res.StatusCode)
+	assert.Equal(s.T(), "image", string(body))
+}
+
+func (s *S3TransportTestSuite) TestErrorStatus() {
+	for _, status := range []int{403, 404} {
+		s.status = status
+
+		res, err := s.client.Get("s3://bucket/images/test.png")
+		require.Nil(s.T(), err)
+		res.Body.Close()
+
+		assert.Equal(s.T(), status, res.StatusCode)
+	}
+}
+
+func TestS3Transport(t *testing.T) {
+	suite.Run(t, new(S3TransportTestSuite))
+}
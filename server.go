@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"golang.org/x/net/netutil"
 )
 
 var (
-	imgproxyIsRunningMsg = []byte("imgproxy is running")
+	imgproxyIsRunningMsg  = []byte("imgproxy is running")
+	imgproxyIsNotReadyMsg = []byte("imgproxy is not ready")
 
 	errInvalidSecret = newError(403, "Invalid secret", "Forbidden")
 )
@@ -22,7 +25,12 @@ func buildRouter() *router {
 	r.PanicHandler = handlePanic
 
 	r.GET("/health", handleHealth)
+	r.GET("/info/", withCORS(withSecret(handleInfo)))
+	r.GET("/srcset", withCORS(withSecret(handleSrcset)))
 	r.GET("/", withCORS(withSecret(handleProcessing)))
+	if conf.PostSourceEnabled {
+		r.POST("/", withCORS(withSecret(handleProcessing)))
+	}
 	r.OPTIONS("/", withCORS(handleOptions))
 
 	return r
@@ -59,20 +67,32 @@ func startServer() *http.Server {
 	return s
 }
 
-func shutdownServer(s *http.Server) {
+// shutdownServer stops accepting new connections and waits for in-flight requests
+// to be finished. Returns false if some requests are still being processed after the timeout
+func shutdownServer(s *http.Server) bool {
 	logNotice("Shutting down the server...")
 
-	ctx, close := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, close := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeout)*time.Second)
 	defer close()
 
-	s.Shutdown(ctx)
+	if err := s.Shutdown(ctx); err != nil {
+		logWarning("Can't drain in-flight requests: %s", err)
+		return false
+	}
+
+	return true
 }
 
 func withCORS(h routeHandler) routeHandler {
+	methods := "GET, OPTIONS"
+	if conf.PostSourceEnabled {
+		methods = "GET, POST, OPTIONS"
+	}
+
 	return func(reqID string, rw http.ResponseWriter, r *http.Request) {
 		if len(conf.AllowOrigin) > 0 {
 			rw.Header().Set("Access-Control-Allow-Origin", conf.AllowOrigin)
-			rw.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			rw.Header().Set("Access-Control-Allow-Methods", methods)
 		}
 
 		h(reqID, rw, r)
@@ -107,7 +127,10 @@ func handlePanic(reqID string, rw http.ResponseWriter, r *http.Request, err erro
 		ierr = newUnexpectedError(err.Error(), 3)
 	}
 
-	logResponse(reqID, ierr.StatusCode, ierr.Message)
+	logResponseWithFields(reqID, ierr.StatusCode, ierr.Message, logFields{
+		"request_url": r.URL.RequestURI(),
+		"error":       ierr.Message,
+	})
 
 	rw.WriteHeader(ierr.StatusCode)
 
@@ -118,12 +141,54 @@ func handlePanic(reqID string, rw http.ResponseWriter, r *http.Request, err erro
 	}
 }
 
+type healthStatus struct {
+	Status       string            `json:"status"`
+	Capabilities *vipsCapabilities `json:"capabilities,omitempty"`
+}
+
 func handleHealth(reqID string, rw http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		handleHealthJSON(reqID, rw)
+		return
+	}
+
+	if !isVipsInitialized() {
+		logResponse(reqID, 503, string(imgproxyIsNotReadyMsg))
+		rw.WriteHeader(503)
+		rw.Write(imgproxyIsNotReadyMsg)
+		return
+	}
+
 	logResponse(reqID, 200, string(imgproxyIsRunningMsg))
 	rw.WriteHeader(200)
 	rw.Write(imgproxyIsRunningMsg)
 }
 
+// handleHealthJSON responds with the health status and libvips capabilities.
+// It helps to diagnose unsupported formats and features without reading libvips build config
+func handleHealthJSON(reqID string, rw http.ResponseWriter) {
+	status := 200
+	health := healthStatus{Status: "not ready"}
+
+	if isVipsInitialized() {
+		caps := getVipsCapabilities()
+		health = healthStatus{Status: "ok", Capabilities: &caps}
+	} else {
+		status = 503
+	}
+
+	data, err := json.Marshal(health)
+	if err != nil {
+		panic(err)
+	}
+
+	logResponse(reqID, status, "Respond with health status: "+health.Status)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(data)
+}
+
 func handleOptions(reqID string, rw http.ResponseWriter, r *http.Request) {
 	logResponse(reqID, 200, "Respond with options")
 	rw.WriteHeader(200)
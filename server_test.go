@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ServerTestSuite struct{ MainTestSuite }
+
+func (s *ServerTestSuite) TestHealth() {
+	rw := httptest.NewRecorder()
+	handleHealth("test", rw, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	assert.Equal(s.T(), 200, rw.Code)
+	assert.Equal(s.T(), imgproxyIsRunningMsg, rw.Body.Bytes())
+}
+
+func (s *ServerTestSuite) TestHealthJSON() {
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Accept", "application/json")
+
+	rw := httptest.NewRecorder()
+	handleHealth("test", rw, req)
+
+	assert.Equal(s.T(), 200, rw.Code)
+	assert.Equal(s.T(), "application/json", rw.Header().Get("Content-Type"))
+
+	var health healthStatus
+	require.Nil(s.T(), json.Unmarshal(rw.Body.Bytes(), &health))
+
+	assert.Equal(s.T(), "ok", health.Status)
+	require.NotNil(s.T(), health.Capabilities)
+	assert.Contains(s.T(), health.Capabilities.Load, "png")
+	assert.Contains(s.T(), health.Capabilities.Save, "png")
+	assert.Equal(s.T(), vipsSupportSmartcrop, health.Capabilities.Smartcrop)
+}
+
+func (s *ServerTestSuite) TestHealthVipsNotInitialized() {
+	setVipsInitialized(false)
+	defer setVipsInitialized(true)
+
+	rw := httptest.NewRecorder()
+	handleHealth("test", rw, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	assert.Equal(s.T(), 503, rw.Code)
+}
+
+func (s *ServerTestSuite) TestShutdownDrainsRequests() {
+	started := make(chan struct{})
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+			rw.Write([]byte("done"))
+		}),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(s.T(), err)
+
+	go srv.Serve(l)
+
+	type response struct {
+		body []byte
+		err  error
+	}
+
+	respCh := make(chan response, 1)
+
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			respCh <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		respCh <- response{body, err}
+	}()
+
+	<-started
+
+	assert.True(s.T(), shutdownServer(srv))
+
+	resp := <-respCh
+	require.Nil(s.T(), resp.err)
+	assert.Equal(s.T(), []byte("done"), resp.body)
+}
+
+func (s *ServerTestSuite) serveWithRequestID(reqID string) (string, string) {
+	var handledID string
+
+	r := newRouter()
+	r.GET("/", func(id string, rw http.ResponseWriter, req *http.Request) {
+		handledID = id
+		rw.WriteHeader(200)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if len(reqID) > 0 {
+		req.Header.Set("X-Request-ID", reqID)
+	}
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	return handledID, rw.Header().Get("X-Request-ID")
+}
+
+func (s *ServerTestSuite) TestRequestIDPassed() {
+	handledID, respID := s.serveWithRequestID("upstream-id_1")
+
+	assert.Equal(s.T(), "upstream-id_1", handledID)
+	assert.Equal(s.T(), "upstream-id_1", respID)
+}
+
+func (s *ServerTestSuite) TestRequestIDGenerated() {
+	for _, reqID := range []string{"", "invalid id"} {
+		handledID, respID := s.serveWithRequestID(reqID)
+
+		assert.NotEmpty(s.T(), handledID)
+		assert.NotEqual(s.T(), reqID, handledID)
+		assert.Equal(s.T(), handledID, respID)
+	}
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, new(ServerTestSuite))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var serverTimingCtxKey = ctxKey("serverTiming")
+
+type serverTiming struct {
+	mutex     sync.Mutex
+	stages    []string
+	durations map[string]time.Duration
+}
+
+func startServerTiming(ctx context.Context) context.Context {
+	if !conf.ServerTimingEnabled {
+		return ctx
+	}
+
+	return context.WithValue(ctx, serverTimingCtxKey, &serverTiming{
+		durations: make(map[string]time.Duration),
+	})
+}
+
+func getServerTiming(ctx context.Context) *serverTiming {
+	st, _ := ctx.Value(serverTimingCtxKey).(*serverTiming)
+	return st
+}
+
+// startServerTimingStage starts measuring the processing stage duration.
+// Stages may be run several times (e.g. for every animation frame), so their durations are summed up
+func startServerTimingStage(ctx context.Context, stage string) func() {
+	st := getServerTiming(ctx)
+	if st == nil {
+		return func() {}
+	}
+
+	t := time.Now()
+	return func() {
+		st.add(stage, time.Since(t))
+	}
+}
+
+func (st *serverTiming) add(stage string, d time.Duration) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if _, ok := st.durations[stage]; !ok {
+		st.stages = append(st.stages, stage)
+	}
+
+	st.durations[stage] += d
+}
+
+func (st *serverTiming) String() string {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	metrics := make([]string, len(st.stages))
+
+	for i, stage := range st.stages {
+		metrics[i] = fmt.Sprintf("%s;dur=%.3f", stage, float64(st.durations[stage])/float64(time.Millisecond))
+	}
+
+	return strings.Join(metrics, ", ")
+}
+
+func setServerTimingHeader(ctx context.Context, rw http.ResponseWriter) {
+	if st := getServerTiming(ctx); st != nil {
+		if value := st.String(); len(value) > 0 {
+			rw.Header().Set("Server-Timing", value)
+		}
+	}
+}
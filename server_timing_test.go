@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ServerTimingTestSuite struct{ MainTestSuite }
+
+func (s *ServerTimingTestSuite) TestDisabled() {
+	ctx := startServerTiming(context.Background())
+	startServerTimingStage(ctx, "load")()
+
+	rw := httptest.NewRecorder()
+	setServerTimingHeader(ctx, rw)
+
+	assert.Empty(s.T(), rw.Header().Get("Server-Timing"))
+}
+
+func (s *ServerTimingTestSuite) TestStages() {
+	conf.ServerTimingEnabled = true
+
+	ctx := startServerTiming(context.Background())
+
+	st := getServerTiming(ctx)
+	st.add("load", 1500*time.Microsecond)
+	st.add("resize", 2*time.Millisecond)
+	st.add("load", 500*time.Microsecond)
+
+	rw := httptest.NewRecorder()
+	setServerTimingHeader(ctx, rw)
+
+	assert.Equal(s.T(), "load;dur=2.000, resize;dur=2.000", rw.Header().Get("Server-Timing"))
+}
+
+func TestServerTiming(t *testing.T) {
+	suite.Run(t, new(ServerTimingTestSuite))
+}
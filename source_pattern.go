@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// sourcePattern is an entry of the allowed sources list.
+// Scheme and host are matched exactly, path is matched as a prefix.
+// Wildcard (*) matches a part of a host label or a part of a path segment
+type sourcePattern struct {
+	Scheme string
+	Host   *regexp.Regexp
+	Path   *regexp.Regexp
+}
+
+func wildcardRegexp(pattern, anyChars, suffix string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+
+	return regexp.MustCompile("^" + strings.Join(parts, anyChars) + suffix)
+}
+
+func newSourcePattern(pattern string) (*sourcePattern, error) {
+	schemeEnd := strings.Index(pattern, "://")
+	if schemeEnd <= 0 {
+		return nil, fmt.Errorf("Source pattern should look like scheme://host/path: %s", pattern)
+	}
+
+	scheme := strings.ToLower(pattern[:schemeEnd])
+	rest := pattern[schemeEnd+3:]
+
+	host, pathPrefix := rest, "/"
+	if slash := strings.Index(rest, "/"); slash >= 0 {
+		host, pathPrefix = rest[:slash], rest[slash:]
+	}
+
+	if strings.ContainsAny(host, "@?#") || strings.ContainsAny(pathPrefix, "?#") {
+		return nil, fmt.Errorf("Source pattern can contain only scheme, host, and path: %s", pattern)
+	}
+
+	return &sourcePattern{
+		Scheme: scheme,
+		Host:   wildcardRegexp(strings.ToLower(host), "[^./:]+", "$"),
+		Path:   wildcardRegexp(pathPrefix, "[^/]*", ""),
+	}, nil
+}
+
+func (p *sourcePattern) Match(u *url.URL) bool {
+	if strings.ToLower(u.Scheme) != p.Scheme || len(u.Opaque) > 0 {
+		return false
+	}
+
+	if !p.Host.MatchString(strings.ToLower(u.Host)) {
+		return false
+	}
+
+	// Dot segments are resolved so they can't lead out of the allowed path
+	upath := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && upath != "/" {
+		upath += "/"
+	}
+
+	return p.Path.MatchString(upath)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	srcsetMaxWidths = 32
+
+	msgInvalidSrcsetParams = "Invalid srcset parameters"
+)
+
+var (
+	errSrcsetRequiresSecret = newError(403, "Srcset endpoint requires IMGPROXY_SECRET when URL signing is enabled", msgForbidden)
+	errSrcsetOnlyPresets    = newError(422, "Srcset endpoint is not available when only presets are allowed", msgInvalidSrcsetParams)
+)
+
+type srcsetURL struct {
+	Width int    `json:"width"`
+	URL   string `json:"url"`
+}
+
+type srcsetManifest struct {
+	Srcset string      `json:"srcset"`
+	URLs   []srcsetURL `json:"urls"`
+}
+
+// signURLPath returns the path prefixed with its signature.
+// When signing is disabled, any string can be used as the signature
+func signURLPath(path string) string {
+	if len(conf.Keys) == 0 {
+		return "/insecure" + path
+	}
+
+	return "/" + base64.RawURLEncoding.EncodeToString(signatureFor(path, 0)) + path
+}
+
+func parseSrcsetWidths(str string) ([]int, error) {
+	parts := strings.Split(str, ",")
+
+	if len(str) == 0 || len(parts) > srcsetMaxWidths {
+		return nil, fmt.Errorf("Widths should contain from 1 to %d values", srcsetMaxWidths)
+	}
+
+	widths := make([]int, len(parts))
+
+	for i, p := range parts {
+		w, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("Invalid width: %s", p)
+		}
+		widths[i] = w
+	}
+
+	return widths, nil
+}
+
+// buildSrcsetManifest builds signed URLs of the image resized to every width
+// with the base options. Options are validated but images are not processed
+func buildSrcsetManifest(imageURL string, widths []int, options, format string) (*srcsetManifest, error) {
+	if len(imageURL) == 0 {
+		return nil, fmt.Errorf("Source URL is required")
+	}
+
+	// Options come unescaped from the query string, so each of them is escaped
+	// to be placed in the path and parsed the same way the processing handler does
+	options = strings.Trim(options, "/")
+	if len(options) > 0 {
+		segments := strings.Split(options, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		options = strings.Join(segments, "/")
+	}
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(options) > 0 {
+		parsed, rest := parseURLOptions(strings.Split(options, "/"))
+		if len(rest) > 0 {
+			return nil, fmt.Errorf("Invalid options: %s", options)
+		}
+
+		if err = applyProcessingOptions(po, parsed); err != nil {
+			return nil, err
+		}
+	}
+
+	encodedURL := base64.RawURLEncoding.EncodeToString([]byte(imageURL))
+
+	if len(format) > 0 {
+		if err = applyFormatOption(po, []string{format}); err != nil {
+			return nil, err
+		}
+
+		encodedURL += "." + format
+	}
+
+	manifest := srcsetManifest{URLs: make([]srcsetURL, len(widths))}
+	srcset := make([]string, len(widths))
+
+	for i, w := range widths {
+		path := fmt.Sprintf("/w:%d/%s", w, encodedURL)
+		if len(options) > 0 {
+			path = "/" + options + path
+		}
+
+		u := signURLPath(path)
+
+		manifest.URLs[i] = srcsetURL{Width: w, URL: u}
+		srcset[i] = fmt.Sprintf("%s %dw", u, w)
+	}
+
+	manifest.Srcset = strings.Join(srcset, ", ")
+
+	return &manifest, nil
+}
+
+func handleSrcset(reqID string, rw http.ResponseWriter, r *http.Request) {
+	// Without the secret, anyone would be able to sign any URL
+	if len(conf.Keys) > 0 && len(conf.Secret) == 0 {
+		panic(errSrcsetRequiresSecret)
+	}
+
+	if conf.OnlyPresets {
+		panic(errSrcsetOnlyPresets)
+	}
+
+	query := r.URL.Query()
+
+	widths, err := parseSrcsetWidths(query.Get("widths"))
+	if err != nil {
+		panic(newError(422, err.Error(), msgInvalidSrcsetParams))
+	}
+
+	manifest, err := buildSrcsetManifest(query.Get("url"), widths, query.Get("options"), query.Get("format"))
+	if err != nil {
+		panic(newError(422, err.Error(), msgInvalidSrcsetParams))
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		panic(err)
+	}
+
+	logResponse(reqID, 200, "Respond with srcset: "+query.Get("url"))
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(200)
+	rw.Write(data)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type SrcsetTestSuite struct{ MainTestSuite }
+
+func (s *SrcsetTestSuite) TestParseWidths() {
+	widths, err := parseSrcsetWidths("100, 200,300")
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), []int{100, 200, 300}, widths)
+
+	for _, str := range []string{"", "100,", "abc", "-100", strings.Repeat("1,", srcsetMaxWidths) + "1"} {
+		_, err := parseSrcsetWidths(str)
+		assert.Error(s.T(), err, str)
+	}
+}
+
+func (s *SrcsetTestSuite) TestSignedURLs() {
+	conf.Keys = []securityKey{securityKey("test-key")}
+	conf.Salts = []securityKey{securityKey("test-salt")}
+	conf.SignatureSize = 32
+
+	manifest, err := buildSrcsetManifest("http://images.dev/lorem/ipsum.jpg", []int{100, 200}, "/rs:fill:0:0/q:80/", "png")
+	require.Nil(s.T(), err)
+
+	require.Len(s.T(), manifest.URLs, 2)
+
+	for i, w := range []int{100, 200} {
+		u := manifest.URLs[i]
+		assert.Equal(s.T(), w, u.Width)
+
+		// The URL should be accepted by the processing handler
+		ctx, err := parsePath(context.Background(), httptest.NewRequest(http.MethodGet, u.URL, nil))
+		require.Nil(s.T(), err)
+
+		po := getProcessingOptions(ctx)
+		assert.Equal(s.T(), w, po.Width)
+		assert.Equal(s.T(), resizeFill, po.Resize)
+		assert.Equal(s.T(), 80, po.Quality)
+		assert.Equal(s.T(), imageTypePNG, po.Format)
+		assert.Equal(s.T(), "http://images.dev/lorem/ipsum.jpg", getImageURL(ctx))
+	}
+
+	assert.Equal(s.T(), manifest.URLs[0].URL+" 100w, "+manifest.URLs[1].URL+" 200w", manifest.Srcset)
+}
+
+func (s *SrcsetTestSuite) TestEscapedOptions() {
+	conf.Keys = []securityKey{securityKey("test-key")}
+	conf.Salts = []securityKey{securityKey("test-salt")}
+	conf.SignatureSize = 32
+
+	manifest, err := buildSrcsetManifest("http://images.dev/lorem/ipsum.jpg", []int{100}, "fn:lorem ipsum?100%", "")
+	require.Nil(s.T(), err)
+
+	u := manifest.URLs[0].URL
+	assert.Contains(s.T(), u, "/fn:lorem%20ipsum%3F100%25/")
+
+	ctx, err := parsePath(context.Background(), httptest.NewRequest(http.MethodGet, u, nil))
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), "lorem ipsum?100%", getProcessingOptions(ctx).Filename)
+	assert.Equal(s.T(), "http://images.dev/lorem/ipsum.jpg", getImageURL(ctx))
+}
+
+func (s *SrcsetTestSuite) TestInvalidOptions() {
+	_, err := buildSrcsetManifest("http://images.dev/lorem/ipsum.jpg", []int{100}, "rs:unknown", "")
+	assert.Error(s.T(), err)
+
+	_, err = buildSrcsetManifest("http://images.dev/lorem/ipsum.jpg", []int{100}, "", "unknown")
+	assert.Error(s.T(), err)
+
+	_, err = buildSrcsetManifest("", []int{100}, "", "")
+	assert.Error(s.T(), err)
+}
+
+func (s *SrcsetTestSuite) TestRequiresSecret() {
+	conf.Keys = []securityKey{securityKey("test-key")}
+	conf.Salts = []securityKey{securityKey("test-salt")}
+
+	req := httptest.NewRequest(http.MethodGet, "/srcset?widths=100&url="+url.QueryEscape("http://images.dev/lorem/ipsum.jpg"), nil)
+
+	assert.Panics(s.T(), func() {
+		handleSrcset("test", httptest.NewRecorder(), req)
+	})
+
+	conf.Secret = "secret"
+
+	rw := httptest.NewRecorder()
+	handleSrcset("test", rw, req)
+
+	assert.Equal(s.T(), 200, rw.Code)
+
+	var manifest srcsetManifest
+	require.Nil(s.T(), json.Unmarshal(rw.Body.Bytes(), &manifest))
+	assert.Len(s.T(), manifest.URLs, 1)
+}
+
+func TestSrcset(t *testing.T) {
+	suite.Run(t, new(SrcsetTestSuite))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	tiffHeaderSize   = 8
+	tiffIfdEntrySize = 12
+
+	tiffTagImageWidth  = 256
+	tiffTagImageLength = 257
+
+	tiffTypeShort = 3
+	tiffTypeLong  = 4
+)
+
+// tiffDecodeConfig reads dimensions of the first image from its IFD.
+// IFD can be placed anywhere in the file, so we may need to read the whole file
+func tiffDecodeConfig(r io.Reader) (image.Config, error) {
+	header := make([]byte, tiffHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return image.Config{}, err
+	}
+
+	var order binary.ByteOrder
+
+	switch string(header[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return image.Config{}, errors.New("Invalid TIFF byte order")
+	}
+
+	if order.Uint16(header[2:4]) != 42 {
+		return image.Config{}, errors.New("Unsupported TIFF version")
+	}
+
+	ifdOffset := int64(order.Uint32(header[4:8]))
+	if ifdOffset < tiffHeaderSize {
+		return image.Config{}, errors.New("Invalid TIFF IFD offset")
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r, ifdOffset-tiffHeaderSize); err != nil {
+		return image.Config{}, err
+	}
+
+	countData := make([]byte, 2)
+	if _, err := io.ReadFull(r, countData); err != nil {
+		return image.Config{}, err
+	}
+
+	entries := make([]byte, int(order.Uint16(countData))*tiffIfdEntrySize)
+	if _, err := io.ReadFull(r, entries); err != nil {
+		return image.Config{}, err
+	}
+
+	var width, height int
+
+	for i := 0; i < len(entries); i += tiffIfdEntrySize {
+		entry := entries[i : i+tiffIfdEntrySize]
+
+		var value int
+
+		switch order.Uint16(entry[2:4]) {
+		case tiffTypeShort:
+			value = int(order.Uint16(entry[8:10]))
+		case tiffTypeLong:
+			value = int(order.Uint32(entry[8:12]))
+		default:
+			continue
+		}
+
+		switch order.Uint16(entry[0:2]) {
+		case tiffTagImageWidth:
+			width = value
+		case tiffTagImageLength:
+			height = value
+		}
+	}
+
+	if width == 0 || height == 0 {
+		return image.Config{}, errors.New("TIFF dimensions not found")
+	}
+
+	return image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      width,
+		Height:     height,
+	}, nil
+}
+
+func tiffDecode(r io.Reader) (image.Image, error) {
+	return image.NewRGBA(image.Rect(0, 0, 1, 1)), nil
+}
+
+func init() {
+	image.RegisterFormat("tiff", "II*\x00", tiffDecode, tiffDecodeConfig)
+	image.RegisterFormat("tiff", "MM\x00*", tiffDecode, tiffDecodeConfig)
+}
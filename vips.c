@@ -19,6 +19,12 @@
 #define VIPS_SUPPORT_PNG_QUANTIZATION \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7))
 
+#define VIPS_SUPPORT_ROTATE \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6))
+
+#define VIPS_SUPPORT_FIND_TRIM \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6))
+
 #define VIPS_SUPPORT_WEBP_SCALE_ON_LOAD \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
 
@@ -28,9 +34,27 @@
 #define VIPS_SUPPORT_HEIF \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
 
+#define VIPS_SUPPORT_AVIF \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9))
+
+#define VIPS_SUPPORT_TIFF_BUFFER \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 5))
+
+#define VIPS_SUPPORT_PDF \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7))
+
 #define VIPS_SUPPORT_BUILTIN_ICC \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
 
+#define VIPS_SUPPORT_THUMBNAIL \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+
+#define VIPS_SUPPORT_ARRAY_HEADERS \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9))
+
+#define VIPS_SUPPORT_SOURCE \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9))
+
 #define EXIF_ORIENTATION "exif-ifd0-Orientation"
 
 #if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
@@ -49,6 +73,31 @@ clear_image(VipsImage **in) {
   if (G_IS_OBJECT(*in)) g_clear_object(in);
 }
 
+static void
+vips_eval_timeout_cb(VipsImage *image, VipsProgress *progress, gint64 *deadline) {
+  if (g_get_monotonic_time() > *deadline)
+    vips_image_set_kill(image, TRUE);
+}
+
+void
+vips_set_timeout_go(VipsImage *in, gint64 timeout) {
+  gint64 *deadline = g_object_get_data(G_OBJECT(in), "imgproxy-deadline");
+
+  // The handler is connected once per image, the next calls only move the deadline
+  if (deadline) {
+    *deadline = g_get_monotonic_time() + timeout;
+    return;
+  }
+
+  deadline = g_new(gint64, 1);
+  *deadline = g_get_monotonic_time() + timeout;
+
+  g_object_set_data_full(G_OBJECT(in), "imgproxy-deadline", deadline, g_free);
+
+  vips_image_set_progress(in, TRUE);
+  g_signal_connect(in, "eval", G_CALLBACK(vips_eval_timeout_cb), deadline);
+}
+
 void
 g_free_go(void **buf) {
   g_free(*buf);
@@ -76,6 +125,14 @@ vips_type_find_load_go(int imgtype) {
     return vips_type_find("VipsOperation", "svgload_buffer");
   case (HEIC):
     return vips_type_find("VipsOperation", "heifload_buffer");
+  case (PDF):
+#if VIPS_SUPPORT_PDF
+    return vips_type_find("VipsOperation", "pdfload_buffer");
+#else
+    return 0;
+#endif
+  case (TIFF):
+    return vips_type_find("VipsOperation", "tiffload_buffer");
   }
   return 0;
 }
@@ -92,10 +149,20 @@ vips_type_find_save_go(int imgtype) {
     return vips_type_find("VipsOperation", "webpsave_buffer");
   case (GIF):
     return vips_type_find("VipsOperation", "magicksave_buffer");
-  case (ICO):
-    return vips_type_find("VipsOperation", "magicksave_buffer");
   case (HEIC):
     return vips_type_find("VipsOperation", "heifsave_buffer");
+  case (AVIF):
+#if VIPS_SUPPORT_AVIF
+    return vips_type_find("VipsOperation", "heifsave_buffer");
+#else
+    return 0;
+#endif
+  case (TIFF):
+#if VIPS_SUPPORT_TIFF_BUFFER
+    return vips_type_find("VipsOperation", "tiffsave_buffer");
+#else
+    return 0;
+#endif
   }
 
   return 0;
@@ -142,9 +209,9 @@ vips_gifload_go(void *buf, size_t len, int pages, VipsImage **out) {
 }
 
 int
-vips_svgload_go(void *buf, size_t len, double scale, VipsImage **out) {
+vips_svgload_go(void *buf, size_t len, double scale, double dpi, VipsImage **out) {
   #if VIPS_SUPPORT_SVG
-    return vips_svgload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "scale", scale, NULL);
+    return vips_svgload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "scale", scale, "dpi", dpi, NULL);
   #else
     vips_error("vips_svgload_go", "Loading SVG is not supported");
     return 1;
@@ -161,6 +228,93 @@ vips_heifload_go(void *buf, size_t len, VipsImage **out) {
 #endif
 }
 
+int
+vips_pdfload_go(void *buf, size_t len, double scale, int page, VipsImage **out) {
+#if VIPS_SUPPORT_PDF
+  return vips_pdfload_buffer(buf, len, out, "scale", scale, "page", page, NULL);
+#else
+  vips_error("vips_pdfload_go", "Loading PDF is not supported");
+  return 1;
+#endif
+}
+
+int
+vips_tiffload_go(void *buf, size_t len, int page, VipsImage **out) {
+  return vips_tiffload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "page", page, NULL);
+}
+
+#if VIPS_SUPPORT_SOURCE
+// Implemented in Go, reads the stream registered with the handle
+extern gint64 imgproxyStreamRead(guintptr handle, void *buf, gint64 len);
+
+static gint64
+vips_stream_read_cb(VipsSourceCustom *source, void *buf, gint64 len, gpointer handle) {
+  return imgproxyStreamRead((guintptr) handle, buf, len);
+}
+#endif
+
+int
+vips_support_source_go() {
+#if VIPS_SUPPORT_SOURCE
+  return 1;
+#else
+  return 0;
+#endif
+}
+
+int
+vips_type_find_source_load_go(int imgtype) {
+#if VIPS_SUPPORT_SOURCE
+  switch (imgtype)
+  {
+  case (JPEG):
+    return vips_type_find("VipsOperation", "jpegload_source");
+  case (PNG):
+    return vips_type_find("VipsOperation", "pngload_source");
+  case (WEBP):
+    return vips_type_find("VipsOperation", "webpload_source");
+  }
+#endif
+  return 0;
+}
+
+VipsObject *
+vips_source_new_go(guintptr handle) {
+#if VIPS_SUPPORT_SOURCE
+  VipsSourceCustom *source = vips_source_custom_new();
+  g_signal_connect(source, "read", G_CALLBACK(vips_stream_read_cb), (gpointer) handle);
+  return VIPS_OBJECT(source);
+#else
+  vips_error("vips_source_new_go", "Loading from a stream is not supported");
+  return NULL;
+#endif
+}
+
+void
+vips_source_unref_go(VipsObject *source) {
+  g_object_unref(source);
+}
+
+int
+vips_load_source_go(VipsObject *source, int imgtype, int shrink, double scale, VipsImage **out) {
+#if VIPS_SUPPORT_SOURCE
+  switch (imgtype)
+  {
+  case (JPEG):
+    if (shrink > 1)
+      return vips_jpegload_source(VIPS_SOURCE(source), out, "access", VIPS_ACCESS_SEQUENTIAL, "shrink", shrink, NULL);
+
+    return vips_jpegload_source(VIPS_SOURCE(source), out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+  case (PNG):
+    return vips_pngload_source(VIPS_SOURCE(source), out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+  case (WEBP):
+    return vips_webpload_source(VIPS_SOURCE(source), out, "access", VIPS_ACCESS_SEQUENTIAL, "scale", scale, NULL);
+  }
+#endif
+  vips_error("vips_load_source_go", "Loading this image type from a stream is not supported");
+  return 1;
+}
+
 int
 vips_get_exif_orientation(VipsImage *image) {
   const char *orientation;
@@ -173,11 +327,54 @@ vips_get_exif_orientation(VipsImage *image) {
 	return 1;
 }
 
+void
+vips_remove_exif_orientation_go(VipsImage *image) {
+  vips_image_remove(image, EXIF_ORIENTATION);
+  vips_image_remove(image, "orientation");
+}
+
+int
+vips_image_get_array_int_go(VipsImage *image, const char *name, int **out, int *n) {
+#if VIPS_SUPPORT_ARRAY_HEADERS
+  return vips_image_get_array_int(image, name, out, n);
+#else
+  vips_error("vips_image_get_array_int_go", "Array headers are not supported (libvips 8.9+ required)");
+  return 1;
+#endif
+}
+
+void
+vips_image_set_array_int_go(VipsImage *image, const char *name, const int *array, int n) {
+#if VIPS_SUPPORT_ARRAY_HEADERS
+  vips_image_set_array_int(image, name, array, n);
+#endif
+}
+
 int
 vips_support_smartcrop() {
   return VIPS_SUPPORT_SMARTCROP;
 }
 
+static void *
+vips_count_images_cb(VipsObject *object, int *count, void *b) {
+  if (VIPS_IS_IMAGE(object))
+    (*count)++;
+
+  return NULL;
+}
+
+int
+vips_images_count_go() {
+  int count = 0;
+  vips_object_map((VipsSListMap2Fn) vips_count_images_cb, &count, NULL);
+  return count;
+}
+
+int
+vips_support_thumbnail_go() {
+  return VIPS_SUPPORT_THUMBNAIL;
+}
+
 VipsBandFormat
 vips_band_format(VipsImage *in) {
   return in->BandFmt;
@@ -222,12 +419,29 @@ vips_rad2float_go(VipsImage *in, VipsImage **out) {
 }
 
 int
-vips_resize_go(VipsImage *in, VipsImage **out, double scale) {
-  return vips_resize(in, out, scale, NULL);
+vips_thumbnail_go(void *buf, size_t len, VipsImage **out, int width, int height, int linear) {
+#if VIPS_SUPPORT_THUMBNAIL
+  return vips_thumbnail_buffer(
+    buf, len, out, width,
+    "height", height,
+    "size", VIPS_SIZE_FORCE,
+    "linear", linear,
+    "export_profile", "srgb",
+    NULL
+  );
+#else
+  vips_error("vips_thumbnail_go", "Thumbnail is not supported");
+  return 1;
+#endif
+}
+
+int
+vips_resize_go(VipsImage *in, VipsImage **out, double wscale, double hscale, VipsKernel kernel) {
+  return vips_resize(in, out, wscale, "vscale", hscale, "kernel", kernel, NULL);
 }
 
 int
-vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double scale) {
+vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double wscale, double hscale, VipsKernel kernel) {
 	VipsBandFormat format;
   VipsImage *tmp1, *tmp2;
 
@@ -236,7 +450,7 @@ vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double scale) {
   if (vips_premultiply(in, &tmp1, NULL))
     return 1;
 
-	if (vips_resize(tmp1, &tmp2, scale, NULL)) {
+	if (vips_resize(tmp1, &tmp2, wscale, "vscale", hscale, "kernel", kernel, NULL)) {
     clear_image(&tmp1);
 		return 1;
   }
@@ -288,6 +502,11 @@ vips_has_embedded_icc(VipsImage *in) {
   return vips_image_get_typeof(in, VIPS_META_ICC_NAME) != 0;
 }
 
+const char *
+vips_interpretation_nick_go(VipsImage *in) {
+  return vips_enum_nick(VIPS_TYPE_INTERPRETATION, in->Type);
+}
+
 int
 vips_support_builtin_icc() {
   return VIPS_SUPPORT_BUILTIN_ICC;
@@ -298,6 +517,55 @@ vips_icc_import_go(VipsImage *in, VipsImage **out, char *profile) {
   return vips_icc_import(in, out, "input_profile", profile, "embedded", TRUE, "pcs", VIPS_PCS_XYZ, NULL);
 }
 
+int
+vips_icc_embed_srgb_go(VipsImage *in, VipsImage **out) {
+#if VIPS_SUPPORT_BUILTIN_ICC
+  VipsBlob *profile;
+
+  if (vips_profile_load("srgb", &profile, NULL))
+    return 1;
+
+  if (vips_copy(in, out, NULL)) {
+    vips_area_unref((VipsArea *)profile);
+    return 1;
+  }
+
+  GValue value = { 0 };
+  g_value_init(&value, VIPS_TYPE_BLOB);
+  g_value_set_boxed(&value, profile);
+  vips_image_set(*out, VIPS_META_ICC_NAME, &value);
+  g_value_unset(&value);
+
+  vips_area_unref((VipsArea *)profile);
+
+  return 0;
+#else
+  vips_error("vips_icc_embed_srgb_go", "Embedding sRGB profile is not supported");
+  return 1;
+#endif
+}
+
+int
+vips_strip_keep_icc_go(VipsImage *in, VipsImage **out) {
+  if (vips_copy(in, out, NULL))
+    return 1;
+
+  gchar **fields = vips_image_get_fields(*out);
+
+  for (int i = 0; fields[i] != NULL; i++) {
+    gchar *name = fields[i];
+
+    if (vips_isprefix("exif-", name) ||
+        strcmp(name, VIPS_META_XMP_NAME) == 0 ||
+        strcmp(name, VIPS_META_IPTC_NAME) == 0)
+      vips_image_remove(*out, name);
+  }
+
+  g_strfreev(fields);
+
+  return 0;
+}
+
 int
 vips_colourspace_go(VipsImage *in, VipsImage **out, VipsInterpretation cs) {
   return vips_colourspace(in, out, cs, NULL);
@@ -309,14 +577,37 @@ vips_rot_go(VipsImage *in, VipsImage **out, VipsAngle angle) {
 }
 
 int
-vips_flip_horizontal_go(VipsImage *in, VipsImage **out) {
-  return vips_flip(in, out, VIPS_DIRECTION_HORIZONTAL, NULL);
+vips_rotate_go(VipsImage *in, VipsImage **out, double angle, double *bg, int bgn, int nearest) {
+#if VIPS_SUPPORT_ROTATE
+  VipsArrayDouble *bga = vips_array_double_new(bg, bgn);
+  VipsInterpolate *interpolate = vips_interpolate_new(nearest ? "nearest" : "bilinear");
+  int ret = vips_rotate(in, out, angle, "background", bga, "interpolate", interpolate, NULL);
+  g_object_unref(interpolate);
+  vips_area_unref((VipsArea *)bga);
+  return ret;
+#else
+  vips_error("vips_rotate_go", "Rotation by arbitrary angle is not supported");
+  return 1;
+#endif
+}
+
+int
+vips_flip_go(VipsImage *in, VipsImage **out, VipsDirection direction) {
+  return vips_flip(in, out, direction, NULL);
 }
 
 int
-vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height) {
+vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height, int entropy, int *left, int *top) {
 #if VIPS_SUPPORT_SMARTCROP
-  return vips_smartcrop(in, out, width, height, NULL);
+  VipsInteresting interesting = entropy ? VIPS_INTERESTING_ENTROPY : VIPS_INTERESTING_ATTENTION;
+  if (vips_smartcrop(in, out, width, height, "interesting", interesting, NULL))
+    return 1;
+
+  // vips_extract_area stores the position of the extracted area as negative offsets
+  *left = -(*out)->Xoffset;
+  *top = -(*out)->Yoffset;
+
+  return 0;
 #else
   vips_error("vips_smartcrop_go", "Smart crop is not supported");
   return 1;
@@ -333,6 +624,211 @@ vips_sharpen_go(VipsImage *in, VipsImage **out, double sigma) {
   return vips_sharpen(in, out, "sigma", sigma, NULL);
 }
 
+int
+vips_pixelate_go(VipsImage *in, VipsImage **out, int pixels) {
+  VipsImage *tmp, *tmp2;
+
+  if (vips_resize(in, &tmp, 1.0 / pixels, "kernel", VIPS_KERNEL_NEAREST, NULL))
+    return 1;
+
+  if (vips_zoom(tmp, &tmp2, pixels, pixels, NULL)) {
+    clear_image(&tmp);
+    return 1;
+  }
+  swap_and_clear(&tmp, tmp2);
+
+  // Downsampled size is rounded, so we need to fit the result to the original size
+  if (vips_embed(tmp, out, 0, 0, in->Xsize, in->Ysize, "extend", VIPS_EXTEND_COPY, NULL)) {
+    clear_image(&tmp);
+    return 1;
+  }
+
+  clear_image(&tmp);
+
+  return 0;
+}
+
+int
+vips_adjust_go(VipsImage *in, VipsImage **out, double brightness, double contrast, double saturation) {
+  VipsImage *img, *img_alpha, *tmp;
+
+  VipsBandFormat img_format = vips_image_get_format(in);
+  VipsInterpretation img_interpretation = vips_image_guess_interpretation(in);
+  gboolean has_alpha = vips_image_hasalpha_go(in);
+
+  if (has_alpha) {
+    if (vips_extract_band(in, &img, 0, "n", in->Bands - 1, NULL))
+      return 1;
+
+    if (vips_extract_band(in, &img_alpha, in->Bands - 1, "n", 1, NULL)) {
+      clear_image(&img);
+      return 1;
+    }
+  } else {
+    if (vips_copy(in, &img, NULL))
+      return 1;
+  }
+
+  if (saturation != 1) {
+    double a[] = {1, saturation, 1};
+    double b[] = {0, 0, 0};
+
+    if (vips_colourspace(img, &tmp, VIPS_INTERPRETATION_LCH, NULL)) {
+      clear_image(&img);
+      if (has_alpha) clear_image(&img_alpha);
+      return 1;
+    }
+    swap_and_clear(&img, tmp);
+
+    if (vips_linear(img, &tmp, a, b, 3, NULL)) {
+      clear_image(&img);
+      if (has_alpha) clear_image(&img_alpha);
+      return 1;
+    }
+    swap_and_clear(&img, tmp);
+
+    if (vips_colourspace(img, &tmp, img_interpretation, NULL)) {
+      clear_image(&img);
+      if (has_alpha) clear_image(&img_alpha);
+      return 1;
+    }
+    swap_and_clear(&img, tmp);
+  }
+
+  if (brightness != 0 || contrast != 1) {
+    // Contrast is applied relative to the middle gray
+    if (vips_linear1(img, &tmp, contrast, 128 * (1 - contrast) + brightness, NULL)) {
+      clear_image(&img);
+      if (has_alpha) clear_image(&img_alpha);
+      return 1;
+    }
+    swap_and_clear(&img, tmp);
+  }
+
+  if (vips_cast(img, &tmp, img_format, NULL)) {
+    clear_image(&img);
+    if (has_alpha) clear_image(&img_alpha);
+    return 1;
+  }
+  swap_and_clear(&img, tmp);
+
+  if (has_alpha) {
+    if (vips_bandjoin2(img, img_alpha, &tmp, NULL)) {
+      clear_image(&img);
+      clear_image(&img_alpha);
+      return 1;
+    }
+    swap_and_clear(&img, tmp);
+    clear_image(&img_alpha);
+  }
+
+  *out = img;
+
+  return 0;
+}
+
+int
+vips_invert_go(VipsImage *in, VipsImage **out) {
+  VipsImage *img, *img_alpha, *tmp;
+
+  if (!vips_image_hasalpha_go(in))
+    return vips_invert(in, out, NULL);
+
+  if (vips_extract_band(in, &img, 0, "n", in->Bands - 1, NULL))
+    return 1;
+
+  if (vips_extract_band(in, &img_alpha, in->Bands - 1, "n", 1, NULL)) {
+    clear_image(&img);
+    return 1;
+  }
+
+  if (vips_invert(img, &tmp, NULL)) {
+    clear_image(&img);
+    clear_image(&img_alpha);
+    return 1;
+  }
+  swap_and_clear(&img, tmp);
+
+  if (vips_bandjoin2(img, img_alpha, out, NULL)) {
+    clear_image(&img);
+    clear_image(&img_alpha);
+    return 1;
+  }
+
+  clear_image(&img);
+  clear_image(&img_alpha);
+
+  return 0;
+}
+
+int
+vips_sepia_go(VipsImage *in, VipsImage **out, double strength) {
+  VipsImage *img, *img_alpha, *matrix, *tmp;
+
+  VipsBandFormat img_format = vips_image_get_format(in);
+  gboolean has_alpha = vips_image_hasalpha_go(in);
+
+  double sepia[] = {
+    0.393, 0.769, 0.189,
+    0.349, 0.686, 0.168,
+    0.272, 0.534, 0.131,
+  };
+  double coeffs[9];
+
+  // Partial sepia is a mix of the sepia matrix and the identity matrix
+  for (int i = 0; i < 9; i++)
+    coeffs[i] = sepia[i] * strength + (i % 4 == 0 ? 1 - strength : 0);
+
+  if (has_alpha) {
+    if (vips_extract_band(in, &img, 0, "n", in->Bands - 1, NULL))
+      return 1;
+
+    if (vips_extract_band(in, &img_alpha, in->Bands - 1, "n", 1, NULL)) {
+      clear_image(&img);
+      return 1;
+    }
+  } else {
+    if (vips_copy(in, &img, NULL))
+      return 1;
+  }
+
+  if (!(matrix = vips_image_new_matrix_from_array(3, 3, coeffs, 9))) {
+    clear_image(&img);
+    if (has_alpha) clear_image(&img_alpha);
+    return 1;
+  }
+
+  if (vips_recomb(img, &tmp, matrix, NULL)) {
+    clear_image(&img);
+    clear_image(&matrix);
+    if (has_alpha) clear_image(&img_alpha);
+    return 1;
+  }
+  swap_and_clear(&img, tmp);
+  clear_image(&matrix);
+
+  if (vips_cast(img, &tmp, img_format, NULL)) {
+    clear_image(&img);
+    if (has_alpha) clear_image(&img_alpha);
+    return 1;
+  }
+  swap_and_clear(&img, tmp);
+
+  if (has_alpha) {
+    if (vips_bandjoin2(img, img_alpha, &tmp, NULL)) {
+      clear_image(&img);
+      clear_image(&img_alpha);
+      return 1;
+    }
+    swap_and_clear(&img, tmp);
+    clear_image(&img_alpha);
+  }
+
+  *out = img;
+
+  return 0;
+}
+
 int
 vips_flatten_go(VipsImage *in, VipsImage **out, double r, double g, double b) {
   VipsArrayDouble *bg = vips_array_double_newv(3, r, g, b);
@@ -341,6 +837,59 @@ vips_flatten_go(VipsImage *in, VipsImage **out, double r, double g, double b) {
   return res;
 }
 
+int
+vips_trim_go(VipsImage *in, VipsImage **out, double threshold, int use_color, double r, double g, double b) {
+#if VIPS_SUPPORT_FIND_TRIM
+  VipsImage *tmp, *tmp2;
+  VipsArrayDouble *bga;
+  double *bg;
+  int bgn;
+  int left, top, width, height;
+  int ret;
+
+  // We look for borders in the sRGB copy of the image without alpha
+  if (vips_colourspace(in, &tmp, VIPS_INTERPRETATION_sRGB, NULL))
+    return 1;
+
+  if (vips_image_hasalpha_go(tmp)) {
+    if (vips_flatten_go(tmp, &tmp2, r, g, b)) {
+      clear_image(&tmp);
+      return 1;
+    }
+    swap_and_clear(&tmp, tmp2);
+  }
+
+  if (use_color) {
+    bga = vips_array_double_newv(3, r, g, b);
+  } else {
+    // Use the top-left pixel color as the background
+    if (vips_getpoint(tmp, &bg, &bgn, 0, 0, NULL)) {
+      clear_image(&tmp);
+      return 1;
+    }
+    bga = vips_array_double_new(bg, bgn);
+    g_free(bg);
+  }
+
+  ret = vips_find_trim(tmp, &left, &top, &width, &height, "threshold", threshold, "background", bga, NULL);
+
+  vips_area_unref((VipsArea *)bga);
+  clear_image(&tmp);
+
+  if (ret)
+    return 1;
+
+  // Nothing differs from the background, so there is nothing to keep
+  if (width == 0 || height == 0)
+    return vips_copy(in, out, NULL);
+
+  return vips_extract_area(in, out, left, top, width, height, NULL);
+#else
+  vips_error("vips_trim_go", "Trim is not supported");
+  return 1;
+#endif
+}
+
 int
 vips_extract_area_go(VipsImage *in, VipsImage **out, int left, int top, int width, int height) {
   return vips_extract_area(in, out, left, top, width, height, NULL);
@@ -462,7 +1011,7 @@ vips_apply_watermark(VipsImage *in, VipsImage *watermark, VipsImage **out, doubl
 	}
 
 	VipsBandFormat img_format;
-	VipsImage *img, *img_alpha;
+	VipsImage *img, *img_alpha = NULL;
 
 	img_format = vips_image_get_format(in);
 
@@ -525,39 +1074,157 @@ vips_apply_watermark(VipsImage *in, VipsImage *watermark, VipsImage **out, doubl
   return 0;
 }
 
+static int
+vips_rounded_mask(VipsImage **out, int width, int height, int radius) {
+  VipsImage *mask, *tmp;
+
+  if (vips_black(&mask, width, height, NULL))
+    return 1;
+
+  if (vips_invert(mask, &tmp, NULL)) {
+    clear_image(&mask);
+    return 1;
+  }
+  swap_and_clear(&mask, tmp);
+
+  // Drawing operations modify the image in place, so it should be in memory
+  if (!(tmp = vips_image_copy_memory(mask))) {
+    clear_image(&mask);
+    return 1;
+  }
+  swap_and_clear(&mask, tmp);
+
+  int right = width - radius, bottom = height - radius;
+
+  if (
+    vips_draw_rect1(mask, 0, 0, 0, radius, radius, "fill", TRUE, NULL) ||
+    vips_draw_rect1(mask, 0, right, 0, radius, radius, "fill", TRUE, NULL) ||
+    vips_draw_rect1(mask, 0, 0, bottom, radius, radius, "fill", TRUE, NULL) ||
+    vips_draw_rect1(mask, 0, right, bottom, radius, radius, "fill", TRUE, NULL) ||
+    vips_draw_circle1(mask, 255, radius, radius, radius, "fill", TRUE, NULL) ||
+    vips_draw_circle1(mask, 255, right - 1, radius, radius, "fill", TRUE, NULL) ||
+    vips_draw_circle1(mask, 255, radius, bottom - 1, radius, "fill", TRUE, NULL) ||
+    vips_draw_circle1(mask, 255, right - 1, bottom - 1, radius, "fill", TRUE, NULL)
+  ) {
+    clear_image(&mask);
+    return 1;
+  }
+
+  *out = mask;
+
+  return 0;
+}
+
+int
+vips_round_corners_go(VipsImage *in, VipsImage **out, int radius) {
+  VipsImage *mask, *img, *img_alpha, *tmp;
+
+  VipsBandFormat img_format = vips_image_get_format(in);
+  double max_alpha = img_format == VIPS_FORMAT_USHORT ? 65535 : 255;
+
+  if (vips_rounded_mask(&mask, in->Xsize, in->Ysize, radius))
+    return 1;
+
+  if (vips_image_hasalpha_go(in)) {
+    if (vips_extract_band(in, &img, 0, "n", in->Bands - 1, NULL)) {
+      clear_image(&mask);
+      return 1;
+    }
+
+    if (vips_extract_band(in, &img_alpha, in->Bands - 1, "n", 1, NULL)) {
+      clear_image(&mask);
+      clear_image(&img);
+      return 1;
+    }
+
+    if (vips_multiply(img_alpha, mask, &tmp, NULL)) {
+      clear_image(&mask);
+      clear_image(&img);
+      clear_image(&img_alpha);
+      return 1;
+    }
+    swap_and_clear(&img_alpha, tmp);
+
+    if (vips_linear1(img_alpha, &tmp, 1.0 / 255, 0, NULL)) {
+      clear_image(&mask);
+      clear_image(&img);
+      clear_image(&img_alpha);
+      return 1;
+    }
+    swap_and_clear(&img_alpha, tmp);
+  } else {
+    if (vips_copy(in, &img, NULL)) {
+      clear_image(&mask);
+      return 1;
+    }
+
+    if (vips_linear1(mask, &img_alpha, max_alpha / 255, 0, NULL)) {
+      clear_image(&mask);
+      clear_image(&img);
+      return 1;
+    }
+  }
+
+  clear_image(&mask);
+
+  if (vips_cast(img_alpha, &tmp, img_format, NULL)) {
+    clear_image(&img);
+    clear_image(&img_alpha);
+    return 1;
+  }
+  swap_and_clear(&img_alpha, tmp);
+
+  if (vips_bandjoin2(img, img_alpha, out, NULL)) {
+    clear_image(&img);
+    clear_image(&img_alpha);
+    return 1;
+  }
+
+  clear_image(&img);
+  clear_image(&img_alpha);
+
+  return 0;
+}
+
 int
 vips_arrayjoin_go(VipsImage **in, VipsImage **out, int n) {
   return vips_arrayjoin(in, out, n, "across", 1, NULL);
 }
 
 int
-vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int quality, int interlace) {
-  return vips_jpegsave_buffer(in, buf, len, "profile", "none", "Q", quality, "strip", TRUE, "optimize_coding", TRUE, "interlace", interlace, NULL);
+vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int quality, int interlace, int no_subsample, int keep_icc) {
+  if (keep_icc)
+    return vips_jpegsave_buffer(in, buf, len, "Q", quality, "optimize_coding", TRUE, "interlace", interlace, "no_subsample", no_subsample, NULL);
+
+  return vips_jpegsave_buffer(in, buf, len, "profile", "none", "Q", quality, "strip", TRUE, "optimize_coding", TRUE, "interlace", interlace, "no_subsample", no_subsample, NULL);
 }
 
 int
-vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int interlace, int quantize, int colors) {
+vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int compression, int interlace, int quantize, int colors, double dither, int strip, int keep_icc) {
   return vips_pngsave_buffer(
     in, buf, len,
-    "profile", "none",
+    "profile", keep_icc ? NULL : "none",
+    "strip", strip,
+    "compression", compression,
     "filter", VIPS_FOREIGN_PNG_FILTER_NONE,
     "interlace", interlace,
 #if VIPS_SUPPORT_PNG_QUANTIZATION
     "palette", quantize,
     "colours", colors,
+    "dither", dither,
 #endif // VIPS_SUPPORT_PNG_QUANTIZATION
     NULL);
 }
 
 int
-vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int quality) {
-  return vips_webpsave_buffer(in, buf, len, "Q", quality, "strip", TRUE, NULL);
+vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int quality, int keep_icc) {
+  return vips_webpsave_buffer(in, buf, len, "Q", quality, "strip", !keep_icc, NULL);
 }
 
 int
-vips_gifsave_go(VipsImage *in, void **buf, size_t *len) {
+vips_gifsave_go(VipsImage *in, void **buf, size_t *len, int strip) {
 #if VIPS_SUPPORT_MAGICK
-  return vips_magicksave_buffer(in, buf, len, "format", "gif", NULL);
+  return vips_magicksave_buffer(in, buf, len, "format", "gif", "strip", strip, NULL);
 #else
   vips_error("vips_gifsave_go", "Saving GIF is not supported");
   return 1;
@@ -565,21 +1232,57 @@ vips_gifsave_go(VipsImage *in, void **buf, size_t *len) {
 }
 
 int
-vips_icosave_go(VipsImage *in, void **buf, size_t *len) {
-#if VIPS_SUPPORT_MAGICK
-  return vips_magicksave_buffer(in, buf, len, "format", "ico", NULL);
+vips_heifsave_go(VipsImage *in, void **buf, size_t *len, int quality, int strip) {
+#if VIPS_SUPPORT_HEIF
+  return vips_heifsave_buffer(in, buf, len, "Q", quality, "strip", strip, NULL);
 #else
-  vips_error("vips_icosave_go", "Saving ICO is not supported");
+  vips_error("vips_heifsave_go", "Saving HEIF is not supported");
   return 1;
 #endif
 }
 
 int
-vips_heifsave_go(VipsImage *in, void **buf, size_t *len, int quality) {
-#if VIPS_SUPPORT_HEIF
-  return vips_heifsave_buffer(in, buf, len, "Q", quality, NULL);
+vips_avifsave_go(VipsImage *in, void **buf, size_t *len, int quality, int strip) {
+#if VIPS_SUPPORT_AVIF
+  return vips_heifsave_buffer(in, buf, len, "Q", quality, "compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1, "strip", strip, NULL);
 #else
-  vips_error("vips_heifsave_go", "Saving HEIF is not supported");
+  vips_error("vips_avifsave_go", "Saving AVIF is not supported");
+  return 1;
+#endif
+}
+
+int
+vips_support_avifsave_go() {
+#if VIPS_SUPPORT_AVIF
+  // libheif can be built without AV1 encoder, so we try to save a tiny image
+  VipsImage *img;
+  void *buf = NULL;
+  size_t len;
+  int res;
+
+  if (vips_black(&img, 1, 1, "bands", 3, NULL)) {
+    vips_error_clear();
+    return 0;
+  }
+
+  res = vips_avifsave_go(img, &buf, &len, 50, 1) == 0;
+
+  g_free(buf);
+  clear_image(&img);
+  vips_error_clear();
+
+  return res;
+#else
+  return 0;
+#endif
+}
+
+int
+vips_tiffsave_go(VipsImage *in, void **buf, size_t *len, int compression, int quality, int strip) {
+#if VIPS_SUPPORT_TIFF_BUFFER
+  return vips_tiffsave_buffer(in, buf, len, "compression", compression, "Q", quality, "strip", strip, NULL);
+#else
+  vips_error("vips_tiffsave_go", "Saving TIFF is not supported");
   return 1;
 #endif
 }
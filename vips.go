@@ -9,9 +9,13 @@ package main
 import "C"
 import (
 	"context"
+	"fmt"
 	"math"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -22,18 +26,30 @@ type vipsImage struct {
 
 var (
 	vipsSupportSmartcrop bool
+	vipsSupportThumbnail bool
 	vipsTypeSupportLoad  = make(map[imageType]bool)
 	vipsTypeSupportSave  = make(map[imageType]bool)
 
-	watermark *vipsImage
+	// Types that can be decoded while they're being downloaded
+	vipsTypeSupportStream = make(map[imageType]bool)
+
+	watermark   *vipsImage
+	watermark2x *vipsImage
+
+	// vipsInitialized is read by request handlers, so it's accessed atomically
+	vipsInitialized int32
 )
 
+var vipsKernels = map[resizeKernel]C.VipsKernel{
+	resizeKernelLanczos3: C.VIPS_KERNEL_LANCZOS3,
+	resizeKernelCubic:    C.VIPS_KERNEL_CUBIC,
+	resizeKernelLinear:   C.VIPS_KERNEL_LINEAR,
+	resizeKernelNearest:  C.VIPS_KERNEL_NEAREST,
+}
+
 var vipsConf struct {
-	JpegProgressive       C.int
-	PngInterlaced         C.int
-	PngQuantize           C.int
-	PngQuantizationColors C.int
-	WatermarkOpacity      C.double
+	EmbedSRGBProfile C.int
+	WatermarkOpacity C.double
 }
 
 const (
@@ -41,8 +57,18 @@ const (
 	vipsAngleD90  = C.VIPS_ANGLE_D90
 	vipsAngleD180 = C.VIPS_ANGLE_D180
 	vipsAngleD270 = C.VIPS_ANGLE_D270
+
+	vipsDirectionHorizontal = C.VIPS_DIRECTION_HORIZONTAL
+	vipsDirectionVertical   = C.VIPS_DIRECTION_VERTICAL
 )
 
+var vipsTiffCompressions = map[tiffCompression]C.int{
+	tiffCompressionNone:    C.VIPS_FOREIGN_TIFF_COMPRESSION_NONE,
+	tiffCompressionLZW:     C.VIPS_FOREIGN_TIFF_COMPRESSION_LZW,
+	tiffCompressionDeflate: C.VIPS_FOREIGN_TIFF_COMPRESSION_DEFLATE,
+	tiffCompressionJPEG:    C.VIPS_FOREIGN_TIFF_COMPRESSION_JPEG,
+}
+
 func initVips() {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -52,12 +78,13 @@ func initVips() {
 		logFatal("unable to start vips!")
 	}
 
-	// Disable libvips cache. Since processing pipeline is fine tuned, we won't get much profit from it.
+	// libvips cache is disabled by default. Since processing pipeline is fine tuned, we won't get much profit from it.
 	// Enabled cache can cause SIGSEGV on Musl-based systems like Alpine.
-	C.vips_cache_set_max_mem(0)
-	C.vips_cache_set_max(0)
+	C.vips_cache_set_max_mem(C.size_t(conf.VipsCacheMem))
+	C.vips_cache_set_max(C.int(conf.VipsCacheMaxOps))
 
-	C.vips_concurrency_set(1)
+	// When 0, libvips detects the number of threads itself
+	C.vips_concurrency_set(C.int(conf.VipsConcurrency))
 
 	if len(os.Getenv("IMGPROXY_VIPS_LEAK_CHECK")) > 0 {
 		C.vips_leak_set(C.gboolean(1))
@@ -68,6 +95,7 @@ func initVips() {
 	}
 
 	vipsSupportSmartcrop = C.vips_support_smartcrop() == 1
+	vipsSupportThumbnail = C.vips_support_thumbnail_go() == 1
 
 	if int(C.vips_type_find_load_go(C.int(imageTypeJPEG))) != 0 {
 		vipsTypeSupportLoad[imageTypeJPEG] = true
@@ -84,12 +112,20 @@ func initVips() {
 	if int(C.vips_type_find_load_go(C.int(imageTypeSVG))) != 0 {
 		vipsTypeSupportLoad[imageTypeSVG] = true
 	}
+	if int(C.vips_type_find_load_go(C.int(imageTypePDF))) != 0 {
+		vipsTypeSupportLoad[imageTypePDF] = true
+	}
 	if int(C.vips_type_find_load_go(C.int(imageTypeHEIC))) != 0 {
 		vipsTypeSupportLoad[imageTypeHEIC] = true
 	}
+	if int(C.vips_type_find_load_go(C.int(imageTypeTIFF))) != 0 {
+		vipsTypeSupportLoad[imageTypeTIFF] = true
+	}
 
-	// we load ICO with github.com/mat/besticon/ico and send decoded data to vips
+	// we load ICO with github.com/mat/besticon/ico and BMP with golang.org/x/image/bmp
+	// and send decoded data to vips
 	vipsTypeSupportLoad[imageTypeICO] = true
+	vipsTypeSupportLoad[imageTypeBMP] = true
 
 	if int(C.vips_type_find_save_go(C.int(imageTypeJPEG))) != 0 {
 		vipsTypeSupportSave[imageTypeJPEG] = true
@@ -103,26 +139,36 @@ func initVips() {
 	if int(C.vips_type_find_save_go(C.int(imageTypeGIF))) != 0 {
 		vipsTypeSupportSave[imageTypeGIF] = true
 	}
-	if int(C.vips_type_find_save_go(C.int(imageTypeICO))) != 0 {
-		vipsTypeSupportSave[imageTypeICO] = true
-	}
 	if int(C.vips_type_find_save_go(C.int(imageTypeHEIC))) != 0 {
 		vipsTypeSupportSave[imageTypeHEIC] = true
 	}
-
-	if conf.JpegProgressive {
-		vipsConf.JpegProgressive = C.int(1)
+	// heifsave is available even when libheif has no AV1 encoder,
+	// so AVIF support is checked by saving a test image
+	if int(C.vips_type_find_save_go(C.int(imageTypeAVIF))) != 0 && C.vips_support_avifsave_go() != 0 {
+		vipsTypeSupportSave[imageTypeAVIF] = true
+	}
+	if int(C.vips_type_find_save_go(C.int(imageTypeTIFF))) != 0 {
+		vipsTypeSupportSave[imageTypeTIFF] = true
 	}
 
-	if conf.PngInterlaced {
-		vipsConf.PngInterlaced = C.int(1)
+	// we pack PNG images into ICO by ourselves
+	vipsTypeSupportSave[imageTypeICO] = vipsTypeSupportSave[imageTypePNG]
+
+	for _, imgtype := range []imageType{imageTypeJPEG, imageTypePNG, imageTypeWEBP} {
+		vipsTypeSupportStream[imgtype] = C.vips_type_find_source_load_go(C.int(imgtype)) != 0
 	}
 
-	if conf.PngQuantize {
-		vipsConf.PngQuantize = C.int(1)
+	if conf.StreamSource && C.vips_support_source_go() == 0 {
+		logWarning("Streaming source images requires libvips 8.9+, so they are buffered")
 	}
 
-	vipsConf.PngQuantizationColors = C.int(conf.PngQuantizationColors)
+	if conf.EmbedSRGBProfile {
+		if C.vips_support_builtin_icc() != 0 {
+			vipsConf.EmbedSRGBProfile = C.int(1)
+		} else {
+			logWarning("Embedding sRGB profile requires libvips 8.8+, ignoring IMGPROXY_EMBED_SRGB_PROFILE")
+		}
+	}
 
 	vipsConf.WatermarkOpacity = C.double(conf.WatermarkOpacity)
 
@@ -130,14 +176,76 @@ func initVips() {
 		logFatal(err.Error())
 	}
 
+	// Fallback images are checked against the supported types, so they can be loaded
+	// only when these types are known
+	initFallbackImage()
+
 	vipsCollectMetrics()
+
+	logVipsCapabilities()
+
+	setVipsInitialized(true)
+}
+
+func isVipsInitialized() bool {
+	return atomic.LoadInt32(&vipsInitialized) == 1
+}
+
+func setVipsInitialized(initialized bool) {
+	var value int32
+	if initialized {
+		value = 1
+	}
+
+	atomic.StoreInt32(&vipsInitialized, value)
+}
+
+type vipsCapabilities struct {
+	Load      []string `json:"load"`
+	Save      []string `json:"save"`
+	Smartcrop bool     `json:"smartcrop"`
+}
+
+// getVipsCapabilities returns the formats and features supported by the linked libvips
+func getVipsCapabilities() vipsCapabilities {
+	supportedTypes := func(support map[imageType]bool) []string {
+		names := make([]string, 0, len(imageTypes))
+		for name, imgtype := range imageTypes {
+			if support[imgtype] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	return vipsCapabilities{
+		Load:      supportedTypes(vipsTypeSupportLoad),
+		Save:      supportedTypes(vipsTypeSupportSave),
+		Smartcrop: vipsSupportSmartcrop,
+	}
+}
+
+func logVipsCapabilities() {
+	caps := getVipsCapabilities()
+
+	logNotice(
+		"Supported formats: load - %s; save - %s; smart crop support - %t",
+		strings.Join(caps.Load, ", "), strings.Join(caps.Save, ", "), caps.Smartcrop,
+	)
 }
 
 func shutdownVips() {
+	setVipsInitialized(false)
+
 	if watermark != nil {
 		watermark.Clear()
 	}
 
+	if watermark2x != nil {
+		watermark2x.Clear()
+	}
+
 	C.vips_shutdown()
 }
 
@@ -157,45 +265,84 @@ func vipsCleanup() {
 	C.vips_cleanup()
 }
 
+// vipsImagesCount returns the number of living VipsImage objects. It's used to check leaks
+func vipsImagesCount() int {
+	return int(C.vips_images_count_go())
+}
+
+// vipsLoaderErrorDomains are the prefixes of libvips image loaders errors
+var vipsLoaderErrorDomains = []string{
+	"VipsForeignLoad", "VipsJpeg", "vipspng", "webp2vips", "tiff2vips",
+	"jpegload", "pngload", "webpload", "gifload", "svgload", "heifload", "pdfload", "tiffload", "magickload",
+}
+
 func vipsError() error {
-	return newUnexpectedError(C.GoString(C.vips_error_buffer()), 1)
+	msg := C.GoString(C.vips_error_buffer())
+
+	// libvips decodes images lazily, so broken source images can fail
+	// any operation that reads pixels, including saving
+	for _, line := range strings.Split(msg, "\n") {
+		for _, domain := range vipsLoaderErrorDomains {
+			if strings.HasPrefix(line, domain) {
+				return newError(422, fmt.Sprintf("Can't decode source image: %s", msg), "Invalid source image")
+			}
+		}
+	}
+
+	return newUnexpectedError(msg, 1)
+}
+
+// vipsLoadError returns the error of the image loading.
+// Broken, truncated, and password-protected images can't be loaded, so it's a client error
+func vipsLoadError(imgtype imageType, msg string) error {
+	return newError(422, fmt.Sprintf("Can't load %s image: %s", imgtype, msg), fmt.Sprintf("Can't load %s image", imgtype))
+}
+
+func vipsPrepareWatermark() (err error) {
+	if watermark, err = vipsLoadWatermark(conf.WatermarkData, conf.WatermarkPath, conf.WatermarkURL); err != nil {
+		return
+	}
+
+	watermark2x, err = vipsLoadWatermark(conf.Watermark2xData, conf.Watermark2xPath, conf.Watermark2xURL)
+
+	return
 }
 
-func vipsPrepareWatermark() error {
-	data, imgtype, cancel, err := watermarkData()
+func vipsLoadWatermark(b64, path, url string) (*vipsImage, error) {
+	data, imgtype, cancel, err := watermarkData(b64, path, url)
 	defer cancel()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if data == nil {
-		return nil
+		return nil, nil
 	}
 
-	watermark = new(vipsImage)
+	wm := new(vipsImage)
 
-	if err = watermark.Load(data, imgtype, 1, 1.0, 1); err != nil {
-		return err
+	if err = wm.Load(data, imgtype, 1, 1.0, 0, 1); err != nil {
+		return nil, err
 	}
 
 	var tmp *C.VipsImage
 
-	if C.vips_apply_opacity(watermark.VipsImage, &tmp, C.double(conf.WatermarkOpacity)) != 0 {
-		return vipsError()
+	if C.vips_apply_opacity(wm.VipsImage, &tmp, C.double(conf.WatermarkOpacity)) != 0 {
+		return nil, vipsError()
 	}
-	C.swap_and_clear(&watermark.VipsImage, tmp)
+	C.swap_and_clear(&wm.VipsImage, tmp)
 
-	if err = watermark.CopyMemory(); err != nil {
-		return err
+	if err = wm.CopyMemory(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return wm, nil
 }
 
-func vipsResizeWatermark(width, height int) (wm *vipsImage, err error) {
-	wmW := float64(watermark.VipsImage.Xsize)
-	wmH := float64(watermark.VipsImage.Ysize)
+func vipsResizeWatermark(src *vipsImage, width, height int) (wm *vipsImage, err error) {
+	wmW := float64(src.VipsImage.Xsize)
+	wmH := float64(src.VipsImage.Ysize)
 
 	wr := float64(width) / wmW
 	hr := float64(height) / wmH
@@ -212,7 +359,7 @@ func vipsResizeWatermark(width, height int) (wm *vipsImage, err error) {
 
 	wm = new(vipsImage)
 
-	if C.vips_resize_with_premultiply(watermark.VipsImage, &wm.VipsImage, C.double(scale)) != 0 {
+	if C.vips_resize_with_premultiply(src.VipsImage, &wm.VipsImage, C.double(scale), C.double(scale), C.VIPS_KERNEL_LANCZOS3) != 0 {
 		err = vipsError()
 	}
 
@@ -227,7 +374,11 @@ func (img *vipsImage) Height() int {
 	return int(img.VipsImage.Ysize)
 }
 
-func (img *vipsImage) Load(data []byte, imgtype imageType, shrink int, scale float64, pages int) error {
+func (img *vipsImage) Load(data []byte, imgtype imageType, shrink int, scale float64, page, pages int) error {
+	if len(data) == 0 {
+		return errSourceImageEmpty
+	}
+
 	var tmp *C.VipsImage
 
 	err := C.int(0)
@@ -242,19 +393,25 @@ func (img *vipsImage) Load(data []byte, imgtype imageType, shrink int, scale flo
 	case imageTypeGIF:
 		err = C.vips_gifload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(pages), &tmp)
 	case imageTypeSVG:
-		err = C.vips_svgload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.double(scale), &tmp)
-	case imageTypeICO:
-		rawData, width, height, icoErr := icoData(data)
-		if icoErr != nil {
-			return icoErr
+		err = C.vips_svgload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.double(scale), C.double(conf.SvgDpi), &tmp)
+	case imageTypeICO, imageTypeBMP:
+		rawData, width, height, rgbaErr := rgbaData(data)
+		if rgbaErr != nil {
+			return vipsLoadError(imgtype, rgbaErr.Error())
 		}
 
 		tmp = C.vips_image_new_from_memory_copy(unsafe.Pointer(&rawData[0]), C.size_t(width*height*4), C.int(width), C.int(height), 4, C.VIPS_FORMAT_UCHAR)
 	case imageTypeHEIC:
 		err = C.vips_heifload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), &tmp)
+	case imageTypePDF:
+		err = C.vips_pdfload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.double(scale), C.int(page), &tmp)
+	case imageTypeTIFF:
+		err = C.vips_tiffload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(page), &tmp)
+	default:
+		return newSourceImageTypeError(data)
 	}
 	if err != 0 {
-		return vipsError()
+		return vipsLoadError(imgtype, C.GoString(C.vips_error_buffer()))
 	}
 
 	C.swap_and_clear(&img.VipsImage, tmp)
@@ -262,7 +419,29 @@ func (img *vipsImage) Load(data []byte, imgtype imageType, shrink int, scale flo
 	return nil
 }
 
-func (img *vipsImage) Save(imgtype imageType, quality int) ([]byte, context.CancelFunc, error) {
+// LoadStream loads the image from the stream. Like Load, it reads only the header,
+// and the image is decoded while it's being processed
+func (img *vipsImage) LoadStream(stream *imageStream, imgtype imageType, shrink int, scale float64) error {
+	source, err := stream.vipsSource()
+	if err != nil {
+		return err
+	}
+
+	var tmp *C.VipsImage
+
+	if C.vips_load_source_go(source, C.int(imgtype), C.int(shrink), C.double(scale), &tmp) != 0 {
+		if stream.err != nil {
+			return stream.err
+		}
+		return vipsLoadError(imgtype, C.GoString(C.vips_error_buffer()))
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+
+	return nil
+}
+
+func (img *vipsImage) Save(po *processingOptions, quality int) ([]byte, context.CancelFunc, error) {
 	var ptr unsafe.Pointer
 
 	cancel := func() {
@@ -273,19 +452,57 @@ func (img *vipsImage) Save(imgtype imageType, quality int) ([]byte, context.Canc
 
 	imgsize := C.size_t(0)
 
-	switch imgtype {
+	strip := C.int(0)
+	if po.StripMetadata {
+		strip = C.int(1)
+	}
+
+	progressive := C.int(0)
+	if po.Progressive {
+		progressive = C.int(1)
+	}
+
+	noSubsample := C.int(0)
+	if po.Subsample == jpegSubsample444 {
+		noSubsample = C.int(1)
+	}
+
+	pngInterlaced := C.int(0)
+	if po.PngOptions.Interlaced {
+		pngInterlaced = C.int(1)
+	}
+
+	pngQuantize := C.int(0)
+	if po.PngOptions.Quantize {
+		pngQuantize = C.int(1)
+	}
+
+	if vipsConf.EmbedSRGBProfile != 0 {
+		// Savers strip ICC profile along with the rest of metadata,
+		// so we strip metadata by ourselves to keep the profile
+		if po.StripMetadata || po.Format == imageTypeJPEG || po.Format == imageTypeWEBP {
+			if err := img.StripKeepICC(); err != nil {
+				return nil, cancel, err
+			}
+		}
+		strip = C.int(0)
+	}
+
+	switch po.Format {
 	case imageTypeJPEG:
-		err = C.vips_jpegsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), vipsConf.JpegProgressive)
+		err = C.vips_jpegsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), progressive, noSubsample, vipsConf.EmbedSRGBProfile)
 	case imageTypePNG:
-		err = C.vips_pngsave_go(img.VipsImage, &ptr, &imgsize, vipsConf.PngInterlaced, vipsConf.PngQuantize, vipsConf.PngQuantizationColors)
+		err = C.vips_pngsave_go(img.VipsImage, &ptr, &imgsize, C.int(po.PngOptions.Compression), pngInterlaced, pngQuantize, C.int(po.PngOptions.QuantizationColors), C.double(po.PngOptions.QuantizationDither), strip, vipsConf.EmbedSRGBProfile)
 	case imageTypeWEBP:
-		err = C.vips_webpsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality))
+		err = C.vips_webpsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), vipsConf.EmbedSRGBProfile)
 	case imageTypeGIF:
-		err = C.vips_gifsave_go(img.VipsImage, &ptr, &imgsize)
-	case imageTypeICO:
-		err = C.vips_icosave_go(img.VipsImage, &ptr, &imgsize)
+		err = C.vips_gifsave_go(img.VipsImage, &ptr, &imgsize, strip)
 	case imageTypeHEIC:
-		err = C.vips_heifsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality))
+		err = C.vips_heifsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), strip)
+	case imageTypeAVIF:
+		err = C.vips_avifsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), strip)
+	case imageTypeTIFF:
+		err = C.vips_tiffsave_go(img.VipsImage, &ptr, &imgsize, vipsTiffCompressions[po.TiffCompression], C.int(quality), strip)
 	}
 	if err != 0 {
 		C.g_free_go(&ptr)
@@ -299,12 +516,28 @@ func (img *vipsImage) Save(imgtype imageType, quality int) ([]byte, context.Canc
 	return b, cancel, nil
 }
 
+// SetTimeout makes libvips abort the image evaluation when the timeout is reached
+func (img *vipsImage) SetTimeout(timeout time.Duration) {
+	C.vips_set_timeout_go(img.VipsImage, C.gint64(timeout/time.Microsecond))
+}
+
 func (img *vipsImage) Clear() {
 	if img.VipsImage != nil {
 		C.clear_image(&img.VipsImage)
 	}
 }
 
+func (img *vipsImage) RoundCorners(radius int) error {
+	var tmp *C.VipsImage
+
+	if C.vips_round_corners_go(img.VipsImage, &tmp, C.int(radius)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
 func (img *vipsImage) Arrayjoin(in []*vipsImage) error {
 	var tmp *C.VipsImage
 
@@ -330,6 +563,38 @@ func (img *vipsImage) IsAnimated() bool {
 	return C.vips_is_animated(img.VipsImage) > 0
 }
 
+func (img *vipsImage) ExtractFrame(frame int) error {
+	frameHeight, err := img.GetInt("page-height")
+	if err != nil {
+		return err
+	}
+
+	framesCount := img.Height() / frameHeight
+	frame = minInt(frame, framesCount-1)
+
+	return img.Crop(0, frame*frameHeight, img.Width(), frameHeight)
+}
+
+func (img *vipsImage) FramesCount() int {
+	if !img.IsAnimated() {
+		return 1
+	}
+
+	if nPages, err := img.GetInt("n-pages"); err == nil && nPages > 0 {
+		return nPages
+	}
+
+	if frameHeight, err := img.GetInt("page-height"); err == nil && frameHeight > 0 {
+		return img.Height() / frameHeight
+	}
+
+	return 1
+}
+
+func (img *vipsImage) Interpretation() string {
+	return C.GoString(C.vips_interpretation_nick_go(img.VipsImage))
+}
+
 func (img *vipsImage) HasAlpha() bool {
 	return C.vips_image_hasalpha_go(img.VipsImage) > 0
 }
@@ -347,6 +612,40 @@ func (img *vipsImage) SetInt(name string, value int) {
 	C.vips_image_set_int(img.VipsImage, cachedCString(name), C.int(value))
 }
 
+func (img *vipsImage) HasField(name string) bool {
+	return C.vips_image_get_typeof(img.VipsImage, cachedCString(name)) != 0
+}
+
+func (img *vipsImage) GetIntSlice(name string) ([]int, error) {
+	var ptr *C.int
+	size := C.int(0)
+
+	if C.vips_image_get_array_int_go(img.VipsImage, cachedCString(name), &ptr, &size) != 0 {
+		return nil, vipsError()
+	}
+
+	if size == 0 {
+		return []int{}, nil
+	}
+
+	cOut := (*[math.MaxInt32]C.int)(unsafe.Pointer(ptr))[:int(size):int(size)]
+	out := make([]int, len(cOut))
+
+	for i, el := range cOut {
+		out[i] = int(el)
+	}
+
+	return out, nil
+}
+
+func (img *vipsImage) SetIntSlice(name string, value []int) {
+	in := make([]C.int, len(value))
+	for i, el := range value {
+		in[i] = C.int(el)
+	}
+	C.vips_image_set_array_int_go(img.VipsImage, cachedCString(name), &in[0], C.int(len(value)))
+}
+
 func (img *vipsImage) CastUchar() error {
 	var tmp *C.VipsImage
 
@@ -360,6 +659,23 @@ func (img *vipsImage) CastUchar() error {
 	return nil
 }
 
+// To8Bit converts 16-bit RGB and grayscale images to 8-bit ones.
+// vips_colourspace scales both colour and alpha channels, while vips_cast would just clip them
+func (img *vipsImage) To8Bit() error {
+	if C.vips_image_get_format(img.VipsImage) != C.VIPS_FORMAT_USHORT {
+		return nil
+	}
+
+	switch img.VipsImage.Type {
+	case C.VIPS_INTERPRETATION_RGB16:
+		return img.Colorspace(C.VIPS_INTERPRETATION_sRGB)
+	case C.VIPS_INTERPRETATION_GREY16:
+		return img.Colorspace(C.VIPS_INTERPRETATION_B_W)
+	}
+
+	return nil
+}
+
 func (img *vipsImage) Rad2Float() error {
 	var tmp *C.VipsImage
 
@@ -373,15 +689,40 @@ func (img *vipsImage) Rad2Float() error {
 	return nil
 }
 
-func (img *vipsImage) Resize(scale float64, hasAlpa bool) error {
+// Thumbnail loads the image from data and resizes it to the exact size.
+// libvips does shrink-on-load, colour management, and alpha premultiplication by itself
+func (img *vipsImage) Thumbnail(data []byte, width, height int, linear bool) error {
+	if len(data) == 0 {
+		return errSourceImageEmpty
+	}
+
+	var tmp *C.VipsImage
+
+	cLinear := C.int(0)
+	if linear {
+		cLinear = C.int(1)
+	}
+
+	if C.vips_thumbnail_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), &tmp, C.int(width), C.int(height), cLinear) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+
+	return nil
+}
+
+func (img *vipsImage) Resize(wscale, hscale float64, hasAlpa bool, kernel resizeKernel) error {
 	var tmp *C.VipsImage
 
+	vkernel := vipsKernels[kernel]
+
 	if hasAlpa {
-		if C.vips_resize_with_premultiply(img.VipsImage, &tmp, C.double(scale)) != 0 {
+		if C.vips_resize_with_premultiply(img.VipsImage, &tmp, C.double(wscale), C.double(hscale), vkernel) != 0 {
 			return vipsError()
 		}
 	} else {
-		if C.vips_resize_go(img.VipsImage, &tmp, C.double(scale)) != 0 {
+		if C.vips_resize_go(img.VipsImage, &tmp, C.double(wscale), C.double(hscale), vkernel) != 0 {
 			return vipsError()
 		}
 	}
@@ -391,8 +732,20 @@ func (img *vipsImage) Resize(scale float64, hasAlpa bool) error {
 	return nil
 }
 
-func (img *vipsImage) Orientation() C.int {
-	return C.vips_get_exif_orientation(img.VipsImage)
+// Orientation returns the EXIF orientation of the image.
+// Some cameras write non-standard values like 0 or 9, they're treated as 1 (no transformation)
+func (img *vipsImage) Orientation() int {
+	orientation := int(C.vips_get_exif_orientation(img.VipsImage))
+
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+
+	return orientation
+}
+
+func (img *vipsImage) RemoveOrientation() {
+	C.vips_remove_exif_orientation_go(img.VipsImage)
 }
 
 func (img *vipsImage) Rotate(angle int) error {
@@ -406,10 +759,32 @@ func (img *vipsImage) Rotate(angle int) error {
 	return nil
 }
 
-func (img *vipsImage) Flip() error {
+func (img *vipsImage) RotateArbitrary(angle float64, bg rgbColor, nearest bool) error {
+	var bgc []C.double
+	if img.HasAlpha() {
+		bgc = []C.double{C.double(0)}
+	} else {
+		bgc = []C.double{C.double(bg.R), C.double(bg.G), C.double(bg.B)}
+	}
+
+	cNearest := C.int(0)
+	if nearest {
+		cNearest = C.int(1)
+	}
+
 	var tmp *C.VipsImage
+	if C.vips_rotate_go(img.VipsImage, &tmp, C.double(angle), &bgc[0], C.int(len(bgc)), cNearest) != 0 {
+		return vipsError()
+	}
 
-	if C.vips_flip_horizontal_go(img.VipsImage, &tmp) != 0 {
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) Flip(direction int) error {
+	var tmp *C.VipsImage
+
+	if C.vips_flip_go(img.VipsImage, &tmp, C.VipsDirection(direction)) != 0 {
 		return vipsError()
 	}
 
@@ -435,10 +810,29 @@ func (img *vipsImage) Extract(out *vipsImage, left, top, width, height int) erro
 	return nil
 }
 
-func (img *vipsImage) SmartCrop(width, height int) error {
+func (img *vipsImage) Copy(out *vipsImage) error {
+	if C.vips_copy_go(img.VipsImage, &out.VipsImage) != 0 {
+		return vipsError()
+	}
+	return nil
+}
+
+func (img *vipsImage) Trim(threshold float64, color rgbColor, useColor bool) error {
 	var tmp *C.VipsImage
 
-	if C.vips_smartcrop_go(img.VipsImage, &tmp, C.int(width), C.int(height)) != 0 {
+	// vips_find_trim reads the whole image, so we need to copy it to memory
+	// to read it once again
+	if err := img.CopyMemory(); err != nil {
+		return err
+	}
+
+	uc := C.int(0)
+	if useColor {
+		uc = C.int(1)
+	}
+
+	if C.vips_trim_go(img.VipsImage, &tmp, C.double(threshold), uc,
+		C.double(color.R), C.double(color.G), C.double(color.B)) != 0 {
 		return vipsError()
 	}
 
@@ -446,6 +840,24 @@ func (img *vipsImage) SmartCrop(width, height int) error {
 	return nil
 }
 
+// SmartCrop crops the image to the most interesting area and returns its position
+func (img *vipsImage) SmartCrop(width, height int, strategy smartCropStrategy) (int, int, error) {
+	var tmp *C.VipsImage
+	var left, top C.int
+
+	entropy := C.int(0)
+	if strategy == smartCropEntropy {
+		entropy = C.int(1)
+	}
+
+	if C.vips_smartcrop_go(img.VipsImage, &tmp, C.int(width), C.int(height), entropy, &left, &top) != 0 {
+		return 0, 0, vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return int(left), int(top), nil
+}
+
 func (img *vipsImage) EnsureAlpha() error {
 	var tmp *C.VipsImage
 
@@ -490,6 +902,57 @@ func (img *vipsImage) Sharpen(sigma float32) error {
 	return nil
 }
 
+func (img *vipsImage) Pixelate(pixels int) error {
+	var tmp *C.VipsImage
+
+	if C.vips_pixelate_go(img.VipsImage, &tmp, C.int(pixels)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) Adjust(brightness int, contrast, saturation float64) error {
+	var tmp *C.VipsImage
+
+	if C.vips_adjust_go(img.VipsImage, &tmp, C.double(brightness), C.double(contrast), C.double(saturation)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) Invert() error {
+	var tmp *C.VipsImage
+
+	if C.vips_invert_go(img.VipsImage, &tmp) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+// Sepia tones the image with the sepia colour matrix.
+// strength mixes the matrix with the identity one, so 0 keeps the image intact
+func (img *vipsImage) Sepia(strength float64) error {
+	// Grayscale image has a single colour band while the matrix needs three
+	if err := img.RgbColourspace(); err != nil {
+		return err
+	}
+
+	var tmp *C.VipsImage
+
+	if C.vips_sepia_go(img.VipsImage, &tmp, C.double(strength)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
 func (img *vipsImage) ImportColourProfile(evenSRGB bool) error {
 	var tmp *C.VipsImage
 
@@ -534,6 +997,28 @@ func (img *vipsImage) ImportColourProfile(evenSRGB bool) error {
 	return nil
 }
 
+func (img *vipsImage) EmbedSRGBProfile() error {
+	var tmp *C.VipsImage
+
+	if C.vips_icc_embed_srgb_go(img.VipsImage, &tmp) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) StripKeepICC() error {
+	var tmp *C.VipsImage
+
+	if C.vips_strip_keep_icc_go(img.VipsImage, &tmp) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
 func (img *vipsImage) IsSRGB() bool {
 	return img.VipsImage.Type == C.VIPS_INTERPRETATION_sRGB
 }
@@ -559,6 +1044,10 @@ func (img *vipsImage) Colorspace(colorspace C.VipsInterpretation) error {
 	return nil
 }
 
+func (img *vipsImage) Grayscale() error {
+	return img.Colorspace(C.VIPS_INTERPRETATION_B_W)
+}
+
 func (img *vipsImage) CopyMemory() error {
 	var tmp *C.VipsImage
 	if tmp = C.vips_image_copy_memory(img.VipsImage); tmp == nil {
@@ -634,11 +1123,39 @@ func (img *vipsImage) Embed(gravity gravityType, width, height int, offX, offY i
 	return nil
 }
 
-func (img *vipsImage) ApplyWatermark(opts *watermarkOptions) error {
+func (img *vipsImage) Border(width int, color rgbColor) error {
+	if err := img.RgbColourspace(); err != nil {
+		return err
+	}
+
+	bgc := []C.double{C.double(color.R), C.double(color.G), C.double(color.B)}
+	if img.HasAlpha() {
+		bgc = append(bgc, C.double(255))
+	}
+
+	var tmp *C.VipsImage
+	if C.vips_embed_go(img.VipsImage, &tmp, C.int(width), C.int(width), C.int(img.Width()+width*2), C.int(img.Height()+width*2), &bgc[0], C.int(len(bgc))) != 0 {
+		return vipsError()
+	}
+	C.swap_and_clear(&img.VipsImage, tmp)
+
+	return nil
+}
+
+func (img *vipsImage) ApplyWatermark(opts *watermarkOptions, dpr float64) error {
 	if watermark == nil {
 		return nil
 	}
 
+	// High-DPI variant of the watermark is used for high-DPI images when it's set
+	src, srcDpr := watermark, 1.0
+	if watermark2x != nil && dpr > 1 {
+		src, srcDpr = watermark2x, 2.0
+	}
+
+	// Natural watermark size is multiplied by dpr like the rest of the resulting image
+	wmScale := dpr / srcDpr
+
 	var (
 		wm  *vipsImage
 		tmp *C.VipsImage
@@ -650,17 +1167,28 @@ func (img *vipsImage) ApplyWatermark(opts *watermarkOptions) error {
 	imgW := img.Width()
 	imgH := img.Height()
 
-	if opts.Scale == 0 {
+	naturalW := maxInt(roundToInt(float64(src.Width())*wmScale), 1)
+	naturalH := maxInt(roundToInt(float64(src.Height())*wmScale), 1)
+
+	if opts.Scale == 0 && wmScale == 1 && naturalW <= imgW && naturalH <= imgH {
 		wm = new(vipsImage)
 
-		if C.vips_copy_go(watermark.VipsImage, &wm.VipsImage) != 0 {
+		if C.vips_copy_go(src.VipsImage, &wm.VipsImage) != 0 {
 			return vipsError()
 		}
 	} else {
-		wmW := maxInt(int(float64(imgW)*opts.Scale), 1)
-		wmH := maxInt(int(float64(imgH)*opts.Scale), 1)
+		var wmW, wmH int
 
-		if wm, err = vipsResizeWatermark(wmW, wmH); err != nil {
+		if opts.Scale > 0 {
+			// Relative scale is applied to the image that is multiplied by dpr already
+			wmW = maxInt(int(float64(imgW)*opts.Scale), 1)
+			wmH = maxInt(int(float64(imgH)*opts.Scale), 1)
+		} else {
+			// Watermark that is larger than the image is scaled down to fit it
+			wmW, wmH = minInt(naturalW, imgW), minInt(naturalH, imgH)
+		}
+
+		if wm, err = vipsResizeWatermark(src, wmW, wmH); err != nil {
 			return err
 		}
 	}
@@ -670,7 +1198,12 @@ func (img *vipsImage) ApplyWatermark(opts *watermarkOptions) error {
 			return err
 		}
 	} else {
-		if err = wm.Embed(opts.Gravity, imgW, imgH, opts.OffsetX, opts.OffsetY, rgbColor{0, 0, 0}); err != nil {
+		// Offsets are set in resulting pixels, so they're multiplied by dpr too.
+		// Embed positions the watermark by its actual size, so the scaled size is respected
+		offX := roundToInt(float64(opts.OffsetX) * dpr)
+		offY := roundToInt(float64(opts.OffsetY) * dpr)
+
+		if err = wm.Embed(opts.Gravity, imgW, imgH, offX, offY, rgbColor{0, 0, 0}); err != nil {
 			return err
 		}
 	}
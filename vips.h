@@ -11,12 +11,18 @@ enum ImgproxyImageTypes {
   GIF,
   ICO,
   SVG,
-  HEIC
+  HEIC,
+  AVIF,
+  PDF,
+  TIFF,
+  BMP
 };
 
 int vips_initialize();
 
 void clear_image(VipsImage **in);
+int vips_images_count_go();
+void vips_set_timeout_go(VipsImage *in, gint64 timeout);
 void g_free_go(void **buf);
 
 void swap_and_clear(VipsImage **in, VipsImage *out);
@@ -28,13 +34,26 @@ int vips_jpegload_go(void *buf, size_t len, int shrink, VipsImage **out);
 int vips_pngload_go(void *buf, size_t len, VipsImage **out);
 int vips_webpload_go(void *buf, size_t len, double scale, int pages, VipsImage **out);
 int vips_gifload_go(void *buf, size_t len, int pages, VipsImage **out);
-int vips_svgload_go(void *buf, size_t len, double scale, VipsImage **out);
+int vips_svgload_go(void *buf, size_t len, double scale, double dpi, VipsImage **out);
 int vips_heifload_go(void *buf, size_t len, VipsImage **out);
+int vips_pdfload_go(void *buf, size_t len, double scale, int page, VipsImage **out);
+int vips_tiffload_go(void *buf, size_t len, int page, VipsImage **out);
+
+int vips_support_source_go();
+int vips_type_find_source_load_go(int imgtype);
+VipsObject *vips_source_new_go(guintptr handle);
+void vips_source_unref_go(VipsObject *source);
+int vips_load_source_go(VipsObject *source, int imgtype, int shrink, double scale, VipsImage **out);
 
 int vips_get_exif_orientation(VipsImage *image);
+void vips_remove_exif_orientation_go(VipsImage *image);
 void vips_strip_meta(VipsImage *image);
 
+int vips_image_get_array_int_go(VipsImage *image, const char *name, int **out, int *n);
+void vips_image_set_array_int_go(VipsImage *image, const char *name, const int *array, int n);
+
 int vips_support_smartcrop();
+int vips_support_thumbnail_go();
 
 VipsBandFormat vips_band_format(VipsImage *in);
 
@@ -47,24 +66,34 @@ int vips_copy_go(VipsImage *in, VipsImage **out);
 int vips_cast_go(VipsImage *in, VipsImage **out, VipsBandFormat format);
 int vips_rad2float_go(VipsImage *in, VipsImage **out);
 
-int vips_resize_go(VipsImage *in, VipsImage **out, double scale);
-int vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double scale);
+int vips_thumbnail_go(void *buf, size_t len, VipsImage **out, int width, int height, int linear);
+int vips_resize_go(VipsImage *in, VipsImage **out, double wscale, double hscale, VipsKernel kernel);
+int vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double wscale, double hscale, VipsKernel kernel);
 
 int vips_icc_is_srgb_iec61966(VipsImage *in);
 int vips_has_embedded_icc(VipsImage *in);
+const char *vips_interpretation_nick_go(VipsImage *in);
 int vips_support_builtin_icc();
 int vips_icc_import_go(VipsImage *in, VipsImage **out, char *profile);
+int vips_icc_embed_srgb_go(VipsImage *in, VipsImage **out);
+int vips_strip_keep_icc_go(VipsImage *in, VipsImage **out);
 int vips_colourspace_go(VipsImage *in, VipsImage **out, VipsInterpretation cs);
 
 int vips_rot_go(VipsImage *in, VipsImage **out, VipsAngle angle);
-int vips_flip_horizontal_go(VipsImage *in, VipsImage **out);
+int vips_rotate_go(VipsImage *in, VipsImage **out, double angle, double *bg, int bgn, int nearest);
+int vips_flip_go(VipsImage *in, VipsImage **out, VipsDirection direction);
 
+int vips_trim_go(VipsImage *in, VipsImage **out, double threshold, int use_color, double r, double g, double b);
 int vips_extract_area_go(VipsImage *in, VipsImage **out, int left, int top, int width, int height);
-int vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height);
+int vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height, int entropy, int *left, int *top);
 
 int vips_gaussblur_go(VipsImage *in, VipsImage **out, double sigma);
 int vips_sharpen_go(VipsImage *in, VipsImage **out, double sigma);
 
+int vips_pixelate_go(VipsImage *in, VipsImage **out, int pixels);
+int vips_adjust_go(VipsImage *in, VipsImage **out, double brightness, double contrast, double saturation);
+int vips_invert_go(VipsImage *in, VipsImage **out);
+int vips_sepia_go(VipsImage *in, VipsImage **out, double strength);
 int vips_flatten_go(VipsImage *in, VipsImage **out, double r, double g, double b);
 
 int vips_replicate_go(VipsImage *in, VipsImage **out, int across, int down);
@@ -75,13 +104,16 @@ int vips_apply_opacity(VipsImage *in, VipsImage **out, double opacity);
 
 int vips_apply_watermark(VipsImage *in, VipsImage *watermark, VipsImage **out, double opacity);
 
+int vips_round_corners_go(VipsImage *in, VipsImage **out, int radius);
 int vips_arrayjoin_go(VipsImage **in, VipsImage **out, int n);
 
-int vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int quality, int interlace);
-int vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int interlace, int quantize, int colors);
-int vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int quality);
-int vips_gifsave_go(VipsImage *in, void **buf, size_t *len);
-int vips_icosave_go(VipsImage *in, void **buf, size_t *len);
-int vips_heifsave_go(VipsImage *in, void **buf, size_t *len, int quality);
+int vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int quality, int interlace, int no_subsample, int keep_icc);
+int vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int compression, int interlace, int quantize, int colors, double dither, int strip, int keep_icc);
+int vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int quality, int keep_icc);
+int vips_gifsave_go(VipsImage *in, void **buf, size_t *len, int strip);
+int vips_heifsave_go(VipsImage *in, void **buf, size_t *len, int quality, int strip);
+int vips_avifsave_go(VipsImage *in, void **buf, size_t *len, int quality, int strip);
+int vips_support_avifsave_go();
+int vips_tiffsave_go(VipsImage *in, void **buf, size_t *len, int compression, int quality, int strip);
 
 void vips_cleanup();
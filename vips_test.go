@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type VipsTestSuite struct{ MainTestSuite }
+
+func (s *VipsTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	if len(os.Getenv("IMGPROXY_VIPS_LEAK_CHECK")) == 0 {
+		s.T().Skip("IMGPROXY_VIPS_LEAK_CHECK is not set")
+	}
+}
+
+func (s *VipsTestSuite) TestNoLeaksOnFailedOperation() {
+	data := testPng(s.T(), 32, 32).Bytes()
+
+	before := vipsImagesCount()
+
+	img := new(vipsImage)
+	require.Nil(s.T(), img.Load(data, imageTypePNG, 1, 1.0, 0, 1))
+
+	require.Nil(s.T(), img.Resize(0.5, 0.5, img.HasAlpha(), resizeKernelLanczos3))
+	require.Nil(s.T(), img.CopyMemory())
+
+	// Area is outside of the image, so the operation fails
+	// and the image should stay untouched
+	assert.NotNil(s.T(), img.Crop(100, 100, 10, 10))
+	assert.Equal(s.T(), 16, img.Width())
+
+	img.Clear()
+
+	assert.Equal(s.T(), before, vipsImagesCount())
+}
+
+func (s *VipsTestSuite) TestNoLeaksOnFailedProcessing() {
+	data := testPng(s.T(), 32, 32).Bytes()
+
+	before := vipsImagesCount()
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypePNG
+	po.Width = 16
+
+	// Truncated data passes the header check
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypePNG)
+	ctx = context.WithValue(ctx, imageDataCtxKey, bytes.NewBuffer(data[:len(data)/2]))
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	// libvips may either fail or decode the available part of the image depending on its version,
+	// but the images should be freed in both cases
+	_, cancel, _ := processImage(ctx)
+	cancel()
+
+	assert.Equal(s.T(), before, vipsImagesCount())
+}
+
+func (s *VipsTestSuite) TestNoLeaksOnAnimatedProcessing() {
+	before := vipsImagesCount()
+
+	po, err := defaultProcessingOptions(&processingHeaders{})
+	require.Nil(s.T(), err)
+
+	po.Format = imageTypeGIF
+	po.Width = 4
+
+	ctx := context.WithValue(context.Background(), imageTypeCtxKey, imageTypeGIF)
+	ctx = context.WithValue(ctx, imageDataCtxKey, testAnimatedGif(s.T(), 3))
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	_, cancel, err := processImage(ctx)
+	cancel()
+
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), before, vipsImagesCount())
+}
+
+func TestVips(t *testing.T) {
+	suite.Run(t, new(VipsTestSuite))
+}
@@ -9,26 +9,26 @@ import (
 	"os"
 )
 
-func watermarkData() ([]byte, imageType, context.CancelFunc, error) {
-	if len(conf.WatermarkData) > 0 {
-		data, imgtype, err := base64WatermarkData()
+func watermarkData(b64, path, url string) ([]byte, imageType, context.CancelFunc, error) {
+	if len(b64) > 0 {
+		data, imgtype, err := base64WatermarkData(b64)
 		return data, imgtype, func() {}, err
 	}
 
-	if len(conf.WatermarkPath) > 0 {
-		data, imgtype, err := fileWatermarkData()
+	if len(path) > 0 {
+		data, imgtype, err := fileWatermarkData(path)
 		return data, imgtype, func() {}, err
 	}
 
-	if len(conf.WatermarkURL) > 0 {
-		return remoteWatermarkData()
+	if len(url) > 0 {
+		return remoteWatermarkData(url)
 	}
 
 	return nil, imageTypeUnknown, func() {}, nil
 }
 
-func base64WatermarkData() ([]byte, imageType, error) {
-	data, err := base64.StdEncoding.DecodeString(conf.WatermarkData)
+func base64WatermarkData(b64 string) ([]byte, imageType, error) {
+	data, err := base64.StdEncoding.DecodeString(b64)
 	if err != nil {
 		return nil, imageTypeUnknown, fmt.Errorf("Can't decode watermark data: %s", err)
 	}
@@ -41,8 +41,8 @@ func base64WatermarkData() ([]byte, imageType, error) {
 	return data, imgtype, nil
 }
 
-func fileWatermarkData() ([]byte, imageType, error) {
-	f, err := os.Open(conf.WatermarkPath)
+func fileWatermarkData(path string) ([]byte, imageType, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, imageTypeUnknown, fmt.Errorf("Can't read watermark: %s", err)
 	}
@@ -63,8 +63,8 @@ func fileWatermarkData() ([]byte, imageType, error) {
 	return data, imgtype, nil
 }
 
-func remoteWatermarkData() ([]byte, imageType, context.CancelFunc, error) {
-	ctx := context.WithValue(context.Background(), imageURLCtxKey, conf.WatermarkURL)
+func remoteWatermarkData(url string) ([]byte, imageType, context.CancelFunc, error) {
+	ctx := context.WithValue(context.Background(), imageURLCtxKey, url)
 	ctx, cancel, err := downloadImage(ctx)
 
 	if err != nil {